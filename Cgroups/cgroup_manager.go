@@ -2,6 +2,7 @@ package Cgroups
 
 import (
 	"cocin_dokcer/Cgroups/subsystems"
+	"fmt"
 	"github.com/sirupsen/logrus"
 )
 
@@ -10,26 +11,58 @@ type CgroupManager struct { // 这里给出一个相对路径就行，因为subs
 	Resource *subsystems.ResourceConfig // 资源配置
 }
 
+// ContainerCgroupPath 每个容器独占一个cgroup，按容器ID放在cocin_docker下面
+func ContainerCgroupPath(containerID string) string {
+	return "cocin_docker/" + containerID
+}
+
 func NewCgroupManager(path string) *CgroupManager {
 	return &CgroupManager{Path: path}
 }
 
-// Apply 将进程PID加入到每个cgroup中
+/*
+	Apply 将进程PID加入到每个cgroup中
+	只有设置了资源限制的subsystem加不进去才返回错误，限制没生效就启动容器比失败更糟
+	其他subsystem(比如只有cgroup v2的宿主机上没有挂载v1的hierarchy)只打警告，pause时再报错
+*/
 func (c *CgroupManager) Apply(pid int) error {
 	for _, subSysIns := range subsystems.SubsystemIns {
-		subSysIns.Apply(c.Path, pid)
+		if err := subSysIns.Apply(c.Path, pid); err != nil {
+			if c.Resource.Requires(subSysIns.Name()) {
+				return fmt.Errorf("apply cgroup %s error %v", subSysIns.Name(), err)
+			}
+			logrus.Warnf("apply cgroup %s error %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
-// Set 设置各个subsystem挂载中的cgroup资源限制
+// Set 设置各个subsystem挂载中的cgroup资源限制，要求的限制设置不上时返回错误，没有要求限制的subsystem出错只打警告
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
+	c.Resource = res
 	for _, subSysIns := range subsystems.SubsystemIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil {
+			if res.Requires(subSysIns.Name()) {
+				return fmt.Errorf("set cgroup %s error %v", subSysIns.Name(), err)
+			}
+			logrus.Warnf("set cgroup %s error %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
+// Freeze 暂停cgroup里的所有进程，返回时进程已经全部冻结
+func (c *CgroupManager) Freeze() error {
+	freezer := &subsystems.FreezerSubSystem{}
+	return freezer.Freeze(c.Path)
+}
+
+// Thaw 恢复被Freeze暂停的进程
+func (c *CgroupManager) Thaw() error {
+	freezer := &subsystems.FreezerSubSystem{}
+	return freezer.Thaw(c.Path)
+}
+
 // Destroy 释放各个subsystem挂载中的cgroup
 func (c *CgroupManager) Destroy() error {
 	for _, subSysIns := range subsystems.SubsystemIns {
@@ -0,0 +1,124 @@
+package Cgroups
+
+import (
+	"cocin_dokcer/Cgroups/subsystems"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// freezerState 读出cgroup当前的freezer.state
+func freezerState(t *testing.T, cgroupPath string) string {
+	dir, err := subsystems.GetCgroupPath("freezer", cgroupPath, false)
+	if err != nil {
+		t.Fatalf("get freezer cgroup error %v", err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, "freezer.state"))
+	if err != nil {
+		t.Fatalf("read freezer state error %v", err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func TestPauseUnpause(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to create cgroups")
+	}
+	for _, subSysIns := range subsystems.SubsystemIns {
+		if subsystems.FindCgroupMountpoint(subSysIns.Name()) == "" {
+			t.Skipf("subsystem %s is not mounted", subSysIns.Name())
+		}
+	}
+	manager := NewCgroupManager(ContainerCgroupPath("test-" + strconv.Itoa(os.Getpid())))
+	if err := manager.Set(&subsystems.ResourceConfig{}); err != nil {
+		t.Fatalf("set cgroup error %v", err)
+	}
+	defer manager.Destroy()
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	// 新建的cpuset cgroup要先继承cpus和mems，进程才加得进去
+	if err := manager.Apply(cmd.Process.Pid); err != nil {
+		t.Fatalf("apply cgroup error %v", err)
+	}
+
+	if state := freezerState(t, manager.Path); state != subsystems.Thawed {
+		t.Errorf("new cgroup state = %s, want %s", state, subsystems.Thawed)
+	}
+	if err := manager.Freeze(); err != nil {
+		t.Fatalf("freeze error %v", err)
+	}
+	if state := freezerState(t, manager.Path); state != subsystems.Frozen {
+		t.Errorf("state after freeze = %s, want %s", state, subsystems.Frozen)
+	}
+	// 重复冻结不会出错
+	if err := manager.Freeze(); err != nil {
+		t.Errorf("freeze frozen cgroup error %v", err)
+	}
+	if err := manager.Thaw(); err != nil {
+		t.Fatalf("thaw error %v", err)
+	}
+	if state := freezerState(t, manager.Path); state != subsystems.Thawed {
+		t.Errorf("state after thaw = %s, want %s", state, subsystems.Thawed)
+	}
+}
+
+func TestPauseWithoutCgroup(t *testing.T) {
+	manager := NewCgroupManager(ContainerCgroupPath("missing-" + strconv.Itoa(os.Getpid())))
+	if err := manager.Freeze(); err == nil {
+		t.Errorf("freeze a cgroup that does not exist should fail")
+	}
+}
+
+// brokenSubsystem 模拟没有挂载hierarchy的subsystem
+type brokenSubsystem struct {
+	name string
+}
+
+func (s *brokenSubsystem) Name() string { return s.name }
+
+func (s *brokenSubsystem) Set(path string, res *subsystems.ResourceConfig) error {
+	return fmt.Errorf("subsystem %s is not mounted", s.name)
+}
+
+func (s *brokenSubsystem) Apply(path string, pid int) error {
+	return fmt.Errorf("subsystem %s is not mounted", s.name)
+}
+
+func (s *brokenSubsystem) Remove(path string) error { return nil }
+
+func TestMissingSubsystems(t *testing.T) {
+	saved := subsystems.SubsystemIns
+	defer func() { subsystems.SubsystemIns = saved }()
+	subsystems.SubsystemIns = []subsystems.Subsystem{
+		&brokenSubsystem{"cpuset"}, &brokenSubsystem{"memory"}, &brokenSubsystem{"cpu"}, &brokenSubsystem{"freezer"},
+	}
+
+	// 没有要求资源限制时，缺少hierarchy不影响启动容器
+	manager := NewCgroupManager("cocin_docker/test")
+	if err := manager.Set(&subsystems.ResourceConfig{}); err != nil {
+		t.Errorf("set without limits should not fail, got %v", err)
+	}
+	if err := manager.Apply(os.Getpid()); err != nil {
+		t.Errorf("apply without limits should not fail, got %v", err)
+	}
+
+	// 要求的限制设置不上必须失败
+	for _, res := range []*subsystems.ResourceConfig{{MemoryLimit: "100m"}, {CpuShare: "512"}, {CpuSet: "0"}} {
+		manager := NewCgroupManager("cocin_docker/test")
+		if err := manager.Set(res); err == nil {
+			t.Errorf("set %+v should fail when the subsystem is missing", res)
+		}
+		if err := manager.Apply(os.Getpid()); err == nil {
+			t.Errorf("apply with %+v should fail when the subsystem is missing", res)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type CpusetSubSystem struct {
@@ -17,10 +18,13 @@ func (s *CpusetSubSystem) Name() string {
 
 func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if err := inheritCpuset(cgroupPath); err != nil {
+			return err
+		}
 		if res.CpuSet != "" {
 			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpuset.cpus"),
 				[]byte(res.CpuSet), 0644); err != nil {
-				fmt.Errorf("set cgroup cpuset fail %v", err)
+				return fmt.Errorf("set cgroup cpuset fail %v", err)
 			}
 		}
 		return nil
@@ -32,8 +36,8 @@ func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 func (s *CpusetSubSystem) Apply(cgroupPath string, pid int) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"),
-			[]byte(strconv.Itoa(pid)), 0644); err == nil {
-			fmt.Errorf("set cgroup proc fail %v", err)
+			[]byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
 		}
 		return nil
 	} else {
@@ -48,3 +52,32 @@ func (s *CpusetSubSystem) Remove(cgroupPath string) error {
 		return err
 	}
 }
+
+/*
+	inheritCpuset 新建的cpuset cgroup的cpuset.cpus和cpuset.mems是空的，这时进程加不进去(写tasks报ENOSPC)
+	从hierarchy的根开始逐级检查，空的就从上一级复制下来
+*/
+func inheritCpuset(cgroupPath string) error {
+	dir := FindCgroupMountpoint("cpuset")
+	for _, name := range strings.Split(strings.Trim(cgroupPath, "/"), "/") {
+		parent := dir
+		dir = path.Join(dir, name)
+		for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+			current, err := ioutil.ReadFile(path.Join(dir, file))
+			if err != nil {
+				return fmt.Errorf("read %s error %v", file, err)
+			}
+			if strings.TrimSpace(string(current)) != "" {
+				continue
+			}
+			value, err := ioutil.ReadFile(path.Join(parent, file))
+			if err != nil {
+				return fmt.Errorf("read %s error %v", file, err)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, file), value, 0644); err != nil {
+				return fmt.Errorf("set cgroup %s fail %v", file, err)
+			}
+		}
+	}
+	return nil
+}
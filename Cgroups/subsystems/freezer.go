@@ -0,0 +1,90 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreezerSubSystem 不限制资源，用来暂停和恢复容器里的所有进程，commit时保证文件系统不在变化
+type FreezerSubSystem struct {
+}
+
+// freezer.state 的取值
+const (
+	Frozen = "FROZEN"
+	Thawed = "THAWED"
+)
+
+// Set 没有资源要限制，只是先把cgroup建出来，Apply时要用
+func (s *FreezerSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	_, err := GetCgroupPath(s.Name(), cgroupPath, true)
+	return err
+}
+
+// Remove 删除cgroupPath对应的cgroup
+func (s *FreezerSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.Remove(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+// Apply 将一个进程加入到cgroupPath对应的cgroup中
+func (s *FreezerSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"),
+			[]byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+// Freeze 冻结cgroup里的所有进程
+func (s *FreezerSubSystem) Freeze(cgroupPath string) error {
+	return s.setState(cgroupPath, Frozen)
+}
+
+// Thaw 恢复被冻结的进程
+func (s *FreezerSubSystem) Thaw(cgroupPath string) error {
+	return s.setState(cgroupPath, Thawed)
+}
+
+/*
+	setState 写入freezer.state，再读回来确认
+	冻结不是立即完成的，中间会读到FREEZING，有进程卡在不可中断的睡眠里时还需要重新写一次
+*/
+func (s *FreezerSubSystem) setState(cgroupPath, state string) error {
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+	stateFile := path.Join(subsysCgroupPath, "freezer.state")
+	for i := 0; i < 1000; i++ {
+		if err := ioutil.WriteFile(stateFile, []byte(state), 0644); err != nil {
+			return fmt.Errorf("set freezer state %s error %v", state, err)
+		}
+		current, err := ioutil.ReadFile(stateFile)
+		if err != nil {
+			return fmt.Errorf("read freezer state error %v", err)
+		}
+		if strings.TrimSpace(string(current)) == state {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("cgroup %s did not become %s in time", cgroupPath, state)
+}
+
+// Name 返回cgroup名字
+func (s *FreezerSubSystem) Name() string {
+	return "freezer"
+}
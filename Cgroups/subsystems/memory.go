@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type MemorySubSystem struct {
@@ -55,6 +56,27 @@ func (s *MemorySubSystem) Apply(cgroupPath string, pid int) error {
 	}
 }
 
+// OOMKilled 判断cgroup内是否有进程因为超出内存限制被OOM killer杀掉过
+// memory.oom_control 中的 oom_kill 计数从4.13内核开始才有
+func (s *MemorySubSystem) OOMKilled(cgroupPath string) bool {
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return false
+	}
+	content, err := ioutil.ReadFile(path.Join(subsysCgroupPath, "memory.oom_control"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count > 0
+		}
+	}
+	return false
+}
+
 // Name 返回cgroup名字
 func (s *MemorySubSystem) Name() string {
 	return "memory"
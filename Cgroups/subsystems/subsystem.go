@@ -7,6 +7,22 @@ type ResourceConfig struct {
 	CpuSet      string // CPU核心数
 }
 
+// Requires 判断是否要求了subsystem的资源限制，freezer不限制资源，只在pause时用到
+func (r *ResourceConfig) Requires(subsystem string) bool {
+	if r == nil {
+		return false
+	}
+	switch subsystem {
+	case "memory":
+		return r.MemoryLimit != ""
+	case "cpu":
+		return r.CpuShare != ""
+	case "cpuset":
+		return r.CpuSet != ""
+	}
+	return false
+}
+
 // Subsystem 接口，每个Subsystem可以实现下面的4个接口
 // 这里把cgroup抽象成了path，即字符串，一个路径。
 // 原因是cgroup在Hierarchy的路径，下面包含它的限制文件
@@ -22,4 +38,5 @@ var SubsystemIns = []Subsystem{
 	&CpusetSubSystem{},
 	&MemorySubSystem{},
 	&CpuSubSystem{},
+	&FreezerSubSystem{},
 }
@@ -36,10 +36,14 @@ func FindCgroupMountpoint(subsystem string) string {
 // GetCgroupPath 得到cgroup在文件系统的绝对路径
 func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string, error) {
 	cgroupRoot := FindCgroupMountpoint(subsystem)
+	if cgroupRoot == "" {
+		return "", fmt.Errorf("subsystem %s is not mounted", subsystem)
+	}
 	// 判断文件是否存在，需不需要自动创建
 	if _, err := os.Stat(path.Join(cgroupRoot, cgroupPath)); err == nil || (autoCreate && os.IsNotExist(err)) {
 		if os.IsNotExist(err) {
-			if err := os.Mkdir(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
+			// 每个容器的cgroup放在cocin_docker/{容器ID}下面，父目录可能还不存在
+			if err := os.MkdirAll(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
 			} else {
 				return "", fmt.Errorf("error create cgroup %v", err)
 			}
@@ -0,0 +1,22 @@
+package subsystems
+
+import "testing"
+
+func TestGetCgroupPathNotMounted(t *testing.T) {
+	if _, err := GetCgroupPath("no_such_subsystem", "cocin_docker/test", true); err == nil {
+		t.Errorf("subsystem without a mounted hierarchy should fail")
+	}
+}
+
+func TestRequires(t *testing.T) {
+	res := &ResourceConfig{MemoryLimit: "100m"}
+	for name, want := range map[string]bool{"memory": true, "cpu": false, "cpuset": false, "freezer": false} {
+		if got := res.Requires(name); got != want {
+			t.Errorf("Requires(%s) = %v, want %v", name, got, want)
+		}
+	}
+	var empty *ResourceConfig
+	if empty.Requires("memory") {
+		t.Errorf("nil config requires nothing")
+	}
+}
@@ -0,0 +1,348 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	Tar 把srcDir下的所有内容以tar格式流式写到w，不产生临时文件
+	1. 路径都是相对srcDir的，和 tar -C srcDir . 的效果一样
+	2. 保留权限、属主、修改时间、符号链接和设备文件
+	3. 同一个inode的多个路径只写一次内容，其余的写成硬链接
+*/
+func Tar(srcDir string, w io.Writer) error {
+	return TarPath(srcDir, "", w)
+}
+
+// TarPath 打包一个文件或目录，条目以name为根，name为空时和Tar一样不包含根本身
+// 符号链接本身会被打包，不会跟随
+func TarPath(path, name string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// inode -> 第一次出现的路径
+	inodes := make(map[uint64]string)
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		entryName := filepath.Join(name, rel)
+		if entryName == "." {
+			return nil
+		}
+		return writeEntry(tw, file, entryName, fi, inodes)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+/*
+	TarLayers 和TarPath一样打包rel，但容器的文件系统没有挂载，rel看到的内容由layers叠加而成
+	layers从最上层开始排列，同一个路径只打包最上面一层的，被上层删掉或者遮住的不打包，whiteout本身也不打包
+	从上往下遍历，下层的条目的上级目录一定已经从上层或者同一层输出过了
+*/
+func TarLayers(layers []string, rel, name string, w io.Writer) error {
+	rel = filepath.Clean("/" + rel)[1:]
+	if _, ok := LookupLower(layers, rel); !ok {
+		return &os.PathError{Op: "lstat", Path: "/" + rel, Err: os.ErrNotExist}
+	}
+	tw := tar.NewWriter(w)
+	inodes := make(map[uint64]string)
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		root := filepath.Join(layer, rel)
+		err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && file == root {
+					return nil
+				}
+				return err
+			}
+			sub, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			entryRel := filepath.Join(rel, sub)
+			if strings.HasPrefix(fi.Name(), WhiteoutPrefix) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if seen[entryRel] {
+				return nil
+			}
+			// 被上层遮住的目录整个跳过
+			if visible, ok := LookupLower(layers, entryRel); !ok || visible != file {
+				if fi.IsDir() && !ok {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			seen[entryRel] = true
+			entryName := filepath.Join(name, sub)
+			if entryName == "." {
+				return nil
+			}
+			return writeEntry(tw, file, entryName, fi, inodes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeEntry 写一个tar条目，socket没法打包，直接跳过
+func writeEntry(tw *tar.Writer, path, name string, fi os.FileInfo, inodes map[uint64]string) error {
+	if fi.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("tar header of %s error %v", path, err)
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// 只用数字的uid/gid，容器里的用户在宿主机上不一定存在
+	hdr.Uname, hdr.Gname = "", ""
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := inodes[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[st.Ino] = hdr.Name
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeLink {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("read xattrs of %s error %v", path, err)
+		}
+		setXattrHeader(hdr, xattrs)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+/*
+	Untar 把tar流解到dest目录下，压缩格式自动识别
+	条目的路径都按dest为根处理，带 .. 的路径、指向外面的符号链接和硬链接都不会让文件写到dest外面
+	文件属主、权限、修改时间、扩展属性和设备文件按tar里记录的恢复
+*/
+func Untar(r io.Reader, dest string) error {
+	return untar(r, dest, "")
+}
+
+// CopyPath 一边打包一边解包，把srcPath复制成destDir/destName，cp和build的COPY共用
+func CopyPath(srcPath, destDir, destName string) error {
+	if fi, err := os.Stat(destDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist", destDir)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(TarPath(srcPath, destName, writer))
+	}()
+	err := Untar(reader, destDir)
+	reader.CloseWithError(err)
+	return err
+}
+
+// untar format不为空时按layer处理whiteout
+func untar(r io.Reader, dest, format string) error {
+	rc, err := DecompressStream(r)
+	if err != nil {
+		return fmt.Errorf("decompress stream error %v", err)
+	}
+	defer rc.Close()
+	dest = filepath.Clean(dest)
+	tr := tar.NewReader(rc)
+	// 目录的修改时间要等里面的文件都解出来以后再设置
+	type dirTime struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirTime
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar error %v", err)
+		}
+		path, err := entryPath(dest, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("extract %s error %v", hdr.Name, err)
+		}
+		if path == dest {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if format != "" {
+			handled, err := applyWhiteout(path, format)
+			if err != nil {
+				return err
+			}
+			if handled {
+				continue
+			}
+		}
+		if err := extractEntry(tr, hdr, dest, path); err != nil {
+			return fmt.Errorf("extract %s error %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path: path, hdr: hdr})
+		}
+	}
+	for _, dir := range dirs {
+		os.Chtimes(dir.path, accessTime(dir.hdr), dir.hdr.ModTime)
+	}
+	return nil
+}
+
+/*
+	entryPath 确定tar条目在dest下的位置
+	上级目录按容器的视角解析符号链接，前面的条目放了指向 /etc 的链接，后面的条目也只会写到dest/etc
+	最后一个分量不解析，已经存在的符号链接会被条目本身替换掉，而不是写到链接指向的地方
+*/
+func entryPath(dest, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return dest, nil
+	}
+	parent, err := SecureJoin(dest, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest, path string) error {
+	mode := hdr.FileInfo().Mode()
+	// 已经存在的非目录项先删掉，和tar命令的行为一致
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		if err := lchown(path, hdr); err != nil {
+			return err
+		}
+		return applyXattrs(path, hdr)
+	case tar.TypeLink:
+		// 硬链接的目标也按dest解析，不能链接到宿主机上的文件
+		target, err := SecureJoin(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err != nil || fi.IsDir() {
+			return fmt.Errorf("invalid hardlink target %s", hdr.Linkname)
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode.Perm())
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devMode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			devMode |= syscall.S_IFBLK
+		default:
+			devMode |= syscall.S_IFIFO
+		}
+		dev := int(mkdev(hdr.Devmajor, hdr.Devminor))
+		if err := syscall.Mknod(path, devMode, dev); err != nil {
+			return err
+		}
+	default:
+		// pax全局头之类的条目不需要落盘
+		return nil
+	}
+	if err := lchown(path, hdr); err != nil {
+		return err
+	}
+	// chown会清掉setuid位和security.capability，所以权限和扩展属性要在它之后设置
+	if err := os.Chmod(path, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := applyXattrs(path, hdr); err != nil {
+		return err
+	}
+	return os.Chtimes(path, accessTime(hdr), hdr.ModTime)
+}
+
+// lchown 不会跟随符号链接，非root用户解包时chown失败可以忽略
+func lchown(path string, hdr *tar.Header) error {
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	return nil
+}
+
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// mkdev 按glibc的makedev组合设备号
+func mkdev(major, minor int64) uint64 {
+	return uint64(major&0xfff)<<8 | uint64(minor&0xff) | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
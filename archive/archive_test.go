@@ -0,0 +1,159 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarUntarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hosts"), []byte("127.0.0.1 localhost\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("etc/hosts", filepath.Join(src, "hosts"))
+	os.Link(filepath.Join(src, "run.sh"), filepath.Join(src, "start.sh"))
+
+	var buf bytes.Buffer
+	if err := Tar(src, &buf); err != nil {
+		t.Fatalf("tar error %v", err)
+	}
+	dest := t.TempDir()
+	if err := Untar(&buf, dest); err != nil {
+		t.Fatalf("untar error %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dest, "etc", "hosts"))
+	if err != nil || string(content) != "127.0.0.1 localhost\n" {
+		t.Errorf("etc/hosts = %q, %v", content, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "run.sh")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("run.sh mode should be kept, got %v %v", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "hosts")); err != nil || link != "etc/hosts" {
+		t.Errorf("hosts symlink = %q, %v", link, err)
+	}
+	a, _ := os.Stat(filepath.Join(dest, "run.sh"))
+	b, _ := os.Stat(filepath.Join(dest, "start.sh"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Errorf("start.sh should be a hard link of run.sh")
+	}
+}
+
+func TestUntarGzipStaysInDest(t *testing.T) {
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644)
+	var plain bytes.Buffer
+	if err := Tar(src, &plain); err != nil {
+		t.Fatalf("tar error %v", err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(plain.Bytes())
+	zw.Close()
+
+	dest := t.TempDir()
+	if err := Untar(&compressed, dest); err != nil {
+		t.Fatalf("untar gzip error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file")); err != nil {
+		t.Errorf("file should be extracted from gzip stream, %v", err)
+	}
+	if got, err := entryPath(dest, "../../etc/passwd"); err != nil || got != filepath.Join(dest, "etc/passwd") {
+		t.Errorf("entryPath should not escape dest, got %s, %v", got, err)
+	}
+}
+
+// 恶意的tar包先放一个指向外面的符号链接，再通过它写文件
+func TestUntarSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777})
+	tw.WriteHeader(&tar.Header{Name: "evil/pwned", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../../../../etc/passwd"})
+	tw.Close()
+
+	dest := t.TempDir()
+	Untar(&buf, dest)
+	if _, err := os.Stat(filepath.Join(outside, "pwned")); err == nil {
+		t.Fatalf("untar wrote through a symlink outside dest")
+	}
+	if _, err := os.Stat(filepath.Join(dest, outside, "pwned")); err != nil {
+		t.Errorf("file should be written inside dest, %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "link")); err == nil && os.SameFile(fi, mustStat(t, "/etc/passwd")) {
+		t.Errorf("hardlink should not point outside dest")
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Skipf("stat %s error %v", path, err)
+	}
+	return fi
+}
+
+func TestCompressionAndXattrs(t *testing.T) {
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644)
+	xattrs := unix.Setxattr(filepath.Join(src, "file"), "user.origin", []byte("test"), 0) == nil
+	os.Symlink("file", filepath.Join(src, "link"))
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd} {
+		var buf bytes.Buffer
+		w, err := CompressStream(&buf, c)
+		if err != nil {
+			t.Fatalf("compress %s error %v", c, err)
+		}
+		if err := Tar(src, w); err != nil {
+			t.Fatalf("tar error %v", err)
+		}
+		w.Close()
+		if got := DetectCompression(buf.Bytes()); got != c {
+			t.Errorf("detect compression = %s, want %s", got, c)
+		}
+		dest := t.TempDir()
+		if err := Untar(&buf, dest); err != nil {
+			t.Fatalf("untar %s error %v", c, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(dest, "file")); err != nil || string(content) != "data" {
+			t.Errorf("%s: file = %q, %v", c, content, err)
+		}
+		if xattrs {
+			if value, err := lgetxattr(filepath.Join(dest, "file"), "user.origin"); err != nil || value != "test" {
+				t.Errorf("%s: xattr = %q, %v", c, value, err)
+			}
+		}
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.Symlink("/etc", filepath.Join(root, "abs"))
+	os.Symlink("../../../..", filepath.Join(root, "etc", "up"))
+	os.Symlink("loop", filepath.Join(root, "loop"))
+
+	cases := map[string]string{
+		"/etc/passwd":       filepath.Join(root, "etc", "passwd"),
+		"abs/passwd":        filepath.Join(root, "etc", "passwd"),
+		"../../etc/shadow":  filepath.Join(root, "etc", "shadow"),
+		"etc/up/etc/passwd": filepath.Join(root, "etc", "passwd"),
+		"missing/dir/file":  filepath.Join(root, "missing", "dir", "file"),
+	}
+	for path, want := range cases {
+		got, err := SecureJoin(root, path)
+		if err != nil || got != want {
+			t.Errorf("SecureJoin(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if _, err := SecureJoin(root, "loop/file"); err == nil {
+		t.Errorf("symlink loop should be an error")
+	}
+}
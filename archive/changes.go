@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeKind 容器里文件的变化类型
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	default:
+		return "C"
+	}
+}
+
+// Change 一条变化，Path是容器里的绝对路径
+type Change struct {
+	Kind ChangeKind
+	Path string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
+
+/*
+	Changes 比较可写层和下面的只读层，得到容器相对镜像的变化
+	1. 可写层里的 .wh.<name> 和overlay的0/0字符设备表示删除
+	2. 可写层里有、只读层里也有的是修改，只读层里没有的是新增
+	3. 不透明目录遮住了只读层里的同名目录，只读层里原有但可写层里没有的算删除
+*/
+func Changes(upperDir string, lowerDirs []string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(upperDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := "/" + filepath.ToSlash(rel)
+		base := filepath.Base(rel)
+		switch {
+		case strings.HasPrefix(base, WhiteoutMetaPrefix):
+			// aufs的元数据，.wh..wh.plnk这样的目录整个跳过
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			deleted := filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, WhiteoutPrefix))
+			changes = append(changes, Change{Kind: ChangeDelete, Path: deleted})
+			return nil
+		case IsOverlayWhiteout(fi):
+			changes = append(changes, Change{Kind: ChangeDelete, Path: name})
+			return nil
+		}
+		kind := ChangeAdd
+		if existsInLayers(lowerDirs, rel) {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Kind: kind, Path: name})
+		if fi.IsDir() && kind == ChangeModify && isOpaque(path) {
+			changes = append(changes, opaqueDeletions(path, lowerDirs, rel, name)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+/*
+	RootfsChanges 比较完整的rootfs和只读层，用于没有单独可写层的vfs驱动，规则和TarDiff一样
+	1. rootfs里有、只读层里看不到的是新增，都有但类型、权限、属主、大小或者修改时间不同的是修改
+	2. 只读层里能看到、rootfs里没有的是删除，删除的目录里面的内容不再一一列出
+*/
+func RootfsChanges(rootfs string, lowerDirs []string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		lowerPath, ok := LookupLower(lowerDirs, rel)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: ChangeAdd, Path: "/" + filepath.ToSlash(rel)})
+		case !sameFile(path, fi, lowerPath):
+			changes = append(changes, Change{Kind: ChangeModify, Path: "/" + filepath.ToSlash(rel)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, lower := range lowerDirs {
+		err := filepath.Walk(lower, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(lower, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			if strings.HasPrefix(fi.Name(), WhiteoutPrefix) || seen[rel] {
+				return nil
+			}
+			seen[rel] = true
+			if _, ok := LookupLower(lowerDirs, rel); !ok {
+				return nil
+			}
+			if _, err := os.Lstat(filepath.Join(rootfs, rel)); !os.IsNotExist(err) {
+				return nil
+			}
+			changes = append(changes, Change{Kind: ChangeDelete, Path: "/" + filepath.ToSlash(rel)})
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func isOpaque(dir string) bool {
+	if _, err := os.Lstat(filepath.Join(dir, WhiteoutOpaqueDir)); err == nil {
+		return true
+	}
+	return IsOverlayOpaque(dir)
+}
+
+// opaqueDeletions 不透明目录遮住了只读层里同名目录的内容，可写层里没有的都算删除
+func opaqueDeletions(upperPath string, lowerDirs []string, rel, name string) []Change {
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, lower := range lowerDirs {
+		entries, err := os.ReadDir(filepath.Join(lower, rel))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if seen[entry.Name()] {
+				continue
+			}
+			seen[entry.Name()] = true
+			if _, err := os.Lstat(filepath.Join(upperPath, entry.Name())); os.IsNotExist(err) {
+				changes = append(changes, Change{Kind: ChangeDelete, Path: filepath.Join(name, entry.Name())})
+			}
+		}
+	}
+	return changes
+}
+
+// existsInLayers 按联合挂载的规则判断只读层里能不能看到rel
+func existsInLayers(layers []string, rel string) bool {
+	_, ok := LookupLower(layers, rel)
+	return ok
+}
@@ -0,0 +1,48 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangesAufs(t *testing.T) {
+	lower := t.TempDir()
+	upper := t.TempDir()
+	os.MkdirAll(filepath.Join(lower, "etc"), 0755)
+	os.MkdirAll(filepath.Join(lower, "var", "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "hosts"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "passwd"), []byte("root"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "var", "cache", "a"), nil, 0644)
+
+	os.MkdirAll(filepath.Join(upper, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "etc", "hosts"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(upper, "etc", WhiteoutPrefix+"passwd"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(upper, "report.txt"), nil, 0644)
+	os.MkdirAll(filepath.Join(upper, "var", "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "var", "cache", WhiteoutOpaqueDir), nil, 0644)
+	os.MkdirAll(filepath.Join(upper, WhiteoutMetaPrefix+"plnk"), 0755)
+
+	changes, err := Changes(upper, []string{lower})
+	if err != nil {
+		t.Fatalf("changes error %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"C /etc",
+		"C /etc/hosts",
+		"D /etc/passwd",
+		"A /report.txt",
+		"C /var",
+		"C /var/cache",
+		"D /var/cache/a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// Compression tar流的压缩格式
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	default:
+		return "uncompressed"
+	}
+}
+
+// DetectCompression 按开头的魔数判断压缩格式
+func DetectCompression(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd
+	default:
+		return Uncompressed
+	}
+}
+
+/*
+	DecompressStream 自动识别不压缩、gzip和zstd，返回解压后的流
+	之前commit出来的镜像是tar -czf打包的，仓库里的layer还可能是zstd压缩的
+*/
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch DetectCompression(head) {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Zstd:
+		decoder, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// CompressStream 按指定的格式压缩写到w的内容，Close时写完压缩流的结尾，不会关闭w
+func CompressStream(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression %d", c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/*
+	TarDiff 没有可写层的情况下(vfs驱动)，比较完整的rootfs和它的只读层，把差异打包成OCI格式的layer
+	lowerDirs从上到下排列，是aufs格式(.wh.文件)的只读层
+	1. rootfs里新增或者元数据变了的文件打包进去，大小和修改时间都没变的文件认为没变
+	2. 只读层里能看到、rootfs里已经没有的文件写成 .wh. 文件
+*/
+func TarDiff(rootfs string, lowerDirs []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	inodes := make(map[uint64]string)
+	err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if lowerPath, ok := LookupLower(lowerDirs, rel); ok && sameFile(path, fi, lowerPath) {
+			return nil
+		}
+		return writeEntry(tw, path, rel, fi, inodes)
+	})
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, lower := range lowerDirs {
+		err := filepath.Walk(lower, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(lower, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			if strings.HasPrefix(fi.Name(), WhiteoutPrefix) || seen[rel] {
+				return nil
+			}
+			seen[rel] = true
+			if _, ok := LookupLower(lowerDirs, rel); !ok {
+				return nil
+			}
+			if _, err := os.Lstat(filepath.Join(rootfs, rel)); !os.IsNotExist(err) {
+				return nil
+			}
+			if err := tw.WriteHeader(whiteoutHeader(filepath.Join(filepath.Dir(rel), WhiteoutPrefix+fi.Name()), fi)); err != nil {
+				return err
+			}
+			// 目录删掉了，里面的内容不用再一个个标记
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+/*
+	LookupLower 在只读层里查找rel，返回最上面一层里的路径，layers从最上层开始排列
+	上层的 .wh. 文件、overlay的0/0字符设备、不透明目录，或者把上级目录换成了文件，都会把下层的同名文件遮住
+*/
+func LookupLower(lowerDirs []string, rel string) (string, bool) {
+	rel = filepath.Clean("/" + rel)[1:]
+	for _, layer := range lowerDirs {
+		path := filepath.Join(layer, rel)
+		if fi, err := os.Lstat(path); err == nil {
+			if IsOverlayWhiteout(fi) {
+				return "", false
+			}
+			return path, true
+		}
+		if hidesLower(layer, rel) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// hidesLower 判断layer里有没有删除rel或者它的某个上级目录
+func hidesLower(layer, rel string) bool {
+	for p := rel; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+		if _, err := os.Lstat(filepath.Join(layer, filepath.Dir(p), WhiteoutPrefix+filepath.Base(p))); err == nil {
+			return true
+		}
+		if p == rel {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(layer, p)); err == nil && (!fi.IsDir() || isOpaque(filepath.Join(layer, p))) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFile 比较类型、权限、属主，普通文件再比较大小和修改时间，符号链接比较指向
+func sameFile(path string, fi os.FileInfo, lowerPath string) bool {
+	lfi, err := os.Lstat(lowerPath)
+	if err != nil || fi.Mode() != lfi.Mode() {
+		return false
+	}
+	st, ok1 := fi.Sys().(*syscall.Stat_t)
+	lst, ok2 := lfi.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 || st.Uid != lst.Uid || st.Gid != lst.Gid {
+		return false
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return fi.Size() == lfi.Size() && fi.ModTime().Equal(lfi.ModTime())
+	case fi.Mode()&os.ModeSymlink != 0:
+		a, _ := os.Readlink(path)
+		b, _ := os.Readlink(lowerPath)
+		return a == b
+	case fi.Mode()&os.ModeDevice != 0:
+		return st.Rdev == lst.Rdev
+	}
+	// 目录里的内容单独比较
+	return true
+}
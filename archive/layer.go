@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/*
+	镜像的layer统一用OCI的格式保存：删除的文件<name>表示成同目录下的空文件 .wh.<name>，
+	不透明目录(下层的同名目录整个被替换)在目录里放一个 .wh..wh..opq
+	解包到磁盘上给联合文件系统用时，再转换成具体文件系统的表示方法
+*/
+const (
+	WhiteoutPrefix     = ".wh."
+	WhiteoutMetaPrefix = WhiteoutPrefix + WhiteoutPrefix
+	WhiteoutOpaqueDir  = WhiteoutMetaPrefix + ".opq"
+
+	// aufs的表示方法和OCI一样，原样保留 .wh. 文件
+	WhiteoutAufs = "aufs"
+	// overlay用0/0的字符设备表示删除，用xattr标记不透明目录
+	WhiteoutOverlay = "overlay"
+
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// IsOverlayWhiteout overlay用设备号为0/0的字符设备表示删除
+func IsOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// IsOverlayOpaque 判断目录是否带有overlay的不透明标记
+func IsOverlayOpaque(path string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// whiteoutHeader 表示删除的空文件
+func whiteoutHeader(name string, fi os.FileInfo) *tar.Header {
+	return &tar.Header{
+		Name:     filepath.ToSlash(name),
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		ModTime:  fi.ModTime(),
+	}
+}
+
+/*
+	TarLayer 把容器的可写层打包成OCI格式的layer
+	aufs的 .wh. 文件原样保留，.wh..wh. 开头的aufs元数据跳过
+	overlay的0/0字符设备和不透明目录的xattr转换成 .wh. 文件
+*/
+func TarLayer(upperDir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	inodes := make(map[uint64]string)
+	err := filepath.Walk(upperDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		base := fi.Name()
+		switch {
+		case base == WhiteoutOpaqueDir:
+			return tw.WriteHeader(whiteoutHeader(rel, fi))
+		case strings.HasPrefix(base, WhiteoutMetaPrefix):
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			return tw.WriteHeader(whiteoutHeader(rel, fi))
+		case IsOverlayWhiteout(fi):
+			return tw.WriteHeader(whiteoutHeader(filepath.Join(filepath.Dir(rel), WhiteoutPrefix+base), fi))
+		}
+		if err := writeEntry(tw, path, rel, fi, inodes); err != nil {
+			return err
+		}
+		if fi.IsDir() && IsOverlayOpaque(path) {
+			return tw.WriteHeader(whiteoutHeader(filepath.Join(rel, WhiteoutOpaqueDir), fi))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// UntarLayer 把OCI格式的layer解到dest，whiteout按format转换成对应文件系统的表示方法
+func UntarLayer(r io.Reader, dest, format string) error {
+	switch format {
+	case WhiteoutAufs, WhiteoutOverlay:
+	default:
+		return fmt.Errorf("unknown whiteout format %s", format)
+	}
+	return untar(r, dest, format)
+}
+
+// applyWhiteout 把 .wh. 条目转换成overlay的表示方法，aufs的返回false按普通文件解出来
+func applyWhiteout(path, format string) (bool, error) {
+	base := filepath.Base(path)
+	if format != WhiteoutOverlay || !strings.HasPrefix(base, WhiteoutPrefix) {
+		return false, nil
+	}
+	dir := filepath.Dir(path)
+	if base == WhiteoutOpaqueDir {
+		if err := unix.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return true, fmt.Errorf("set opaque xattr on %s error %v", dir, err)
+		}
+		return true, nil
+	}
+	if strings.HasPrefix(base, WhiteoutMetaPrefix) {
+		return true, nil
+	}
+	target := filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+	os.RemoveAll(target)
+	return true, syscall.Mknod(target, syscall.S_IFCHR, 0)
+}
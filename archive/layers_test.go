@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testLayers 一个可写层叠在两层只读层上，可写层删掉了etc/passwd和var/cache，opt是不透明目录
+func testLayers(t *testing.T) []string {
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "etc"), 0755)
+	os.MkdirAll(filepath.Join(base, "var", "cache"), 0755)
+	os.MkdirAll(filepath.Join(base, "opt", "old"), 0755)
+	os.MkdirAll(filepath.Join(base, "srv"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "etc", "passwd"), []byte("root"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "etc", "hosts"), []byte("base hosts"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "var", "cache", "index"), []byte("index"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "opt", "old", "bin"), []byte("old"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "srv", "data"), []byte("data"), 0644)
+
+	lower := t.TempDir()
+	os.MkdirAll(filepath.Join(lower, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "hosts"), []byte("hosts"), 0644)
+	// /srv换成了指向/etc的符号链接
+	os.Symlink("/etc", filepath.Join(lower, "srv"))
+
+	upper := t.TempDir()
+	os.MkdirAll(filepath.Join(upper, "etc"), 0755)
+	os.MkdirAll(filepath.Join(upper, "var"), 0755)
+	os.MkdirAll(filepath.Join(upper, "opt"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "etc", WhiteoutPrefix+"passwd"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "etc", "resolv.conf"), []byte("nameserver"), 0644)
+	ioutil.WriteFile(filepath.Join(upper, "var", WhiteoutPrefix+"cache"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "opt", WhiteoutOpaqueDir), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "opt", "new"), []byte("new"), 0644)
+	return []string{upper, lower, base}
+}
+
+func TestLookupLower(t *testing.T) {
+	layers := testLayers(t)
+	visible := map[string]string{
+		"etc/hosts":       filepath.Join(layers[1], "etc", "hosts"),
+		"etc/resolv.conf": filepath.Join(layers[0], "etc", "resolv.conf"),
+		"/opt/new":        filepath.Join(layers[0], "opt", "new"),
+		"srv":             filepath.Join(layers[1], "srv"),
+		"":                layers[0],
+	}
+	for rel, want := range visible {
+		if got, ok := LookupLower(layers, rel); !ok || got != want {
+			t.Errorf("LookupLower(%q) = %q %v, want %q", rel, got, ok, want)
+		}
+	}
+	// 删掉的文件、删掉的目录里的文件、不透明目录遮住的文件、换成符号链接的目录里的文件都看不到
+	for _, rel := range []string{"etc/passwd", "var/cache", "var/cache/index", "opt/old", "opt/old/bin", "srv/data", "missing"} {
+		if got, ok := LookupLower(layers, rel); ok {
+			t.Errorf("LookupLower(%q) = %q, should be hidden", rel, got)
+		}
+	}
+}
+
+func TestLookupLowerOverlayWhiteout(t *testing.T) {
+	lower := t.TempDir()
+	ioutil.WriteFile(filepath.Join(lower, "deleted"), []byte("deleted"), 0644)
+	os.MkdirAll(filepath.Join(lower, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "dir", "file"), []byte("file"), 0644)
+	upper := t.TempDir()
+	for _, name := range []string{"deleted", "dir"} {
+		if err := syscall.Mknod(filepath.Join(upper, name), syscall.S_IFCHR, 0); err != nil {
+			t.Skipf("mknod whiteout needs root, %v", err)
+		}
+	}
+	for _, rel := range []string{"deleted", "dir", "dir/file"} {
+		if _, ok := LookupLower([]string{upper, lower}, rel); ok {
+			t.Errorf("%s should be hidden by the overlay whiteout", rel)
+		}
+	}
+}
+
+func TestResolveInLayers(t *testing.T) {
+	layers := testLayers(t)
+	// 符号链接在只读层里，按容器的根解析
+	if got, err := ResolveInLayers(layers, "/srv/resolv.conf"); err != nil || got != "/etc/resolv.conf" {
+		t.Errorf("ResolveInLayers = %q, %v", got, err)
+	}
+	if got, err := ResolveInLayers(layers, "../var/cache/index"); err != nil || got != "/var/cache/index" {
+		t.Errorf("ResolveInLayers = %q, %v", got, err)
+	}
+}
+
+// tarEntries 打包后的条目名和普通文件的内容
+func tarEntries(t *testing.T, layers []string, rel, name string) map[string]string {
+	var buf bytes.Buffer
+	if err := TarLayers(layers, rel, name, &buf); err != nil {
+		t.Fatalf("tar layers %s error %v", rel, err)
+	}
+	entries := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("read tar error %v", err)
+		}
+		if _, ok := entries[hdr.Name]; ok {
+			t.Errorf("duplicate entry %s", hdr.Name)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		entries[hdr.Name] = string(content)
+	}
+}
+
+func TestTarLayers(t *testing.T) {
+	layers := testLayers(t)
+	entries := tarEntries(t, layers, "/etc", "etc")
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "etc/ etc/hosts etc/resolv.conf" {
+		t.Errorf("entries = %v", names)
+	}
+	if entries["etc/hosts"] != "hosts" {
+		t.Errorf("hosts should come from the upper layer, got %q", entries["etc/hosts"])
+	}
+
+	entries = tarEntries(t, layers, "opt", "opt")
+	if _, ok := entries["opt/old/"]; ok || entries["opt/new"] != "new" || len(entries) != 2 {
+		t.Errorf("opaque directory entries = %v", entries)
+	}
+
+	if err := TarLayers(layers, "etc/passwd", "passwd", ioutil.Discard); !os.IsNotExist(err) {
+		t.Errorf("deleted file should not exist, got %v", err)
+	}
+	if err := TarLayers(layers, "var/cache/index", "index", ioutil.Discard); !os.IsNotExist(err) {
+		t.Errorf("file in a deleted directory should not exist, got %v", err)
+	}
+}
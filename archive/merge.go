@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// layerMask 一层layer对它下面各层的遮挡：同名条目、whiteout和不透明目录
+type layerMask struct {
+	entries   map[string]bool // 路径 -> 是否目录
+	whiteouts map[string]bool
+	opaques   map[string]bool
+}
+
+// hides 判断下层的p会不会被这一层遮住
+func (m *layerMask) hides(p string) bool {
+	if _, ok := m.entries[p]; ok || m.whiteouts[p] {
+		return true
+	}
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if m.whiteouts[dir] || m.opaques[dir] {
+			return true
+		}
+		// 上层把目录换成了文件，下层目录里的东西都看不到了
+		if isDir, ok := m.entries[dir]; ok && !isDir {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	MergeLayers 把多层OCI格式的layer合并成一层写到w，layers是layer tar文件的路径，从最下层开始排列
+	合并出来的一层解到空目录里，和原来的layers依次叠加的效果一样：
+	被上层覆盖或删除的条目不再输出，whiteout和不透明目录标记也不需要了
+	第一遍读出每层的条目算出遮挡关系，第二遍从最下层开始输出没被遮住的条目，硬链接的目标总在链接之前
+*/
+func MergeLayers(layers []string, w io.Writer) error {
+	masks := make([]*layerMask, len(layers))
+	for i, layer := range layers {
+		mask, err := readMask(layer)
+		if err != nil {
+			return err
+		}
+		masks[i] = mask
+	}
+	tw := tar.NewWriter(w)
+	for i, layer := range layers {
+		if err := copyVisible(tw, layer, masks[i+1:]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// entryName tar条目名统一成以 / 开头的干净路径，./a/ 和 a 是同一个条目
+func entryName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func readMask(layer string) (*layerMask, error) {
+	f, err := os.Open(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mask := &layerMask{entries: make(map[string]bool), whiteouts: make(map[string]bool), opaques: make(map[string]bool)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return mask, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read layer %s error %v", layer, err)
+		}
+		name := entryName(hdr.Name)
+		base := path.Base(name)
+		switch {
+		case base == WhiteoutOpaqueDir:
+			mask.opaques[path.Dir(name)] = true
+		case strings.HasPrefix(base, WhiteoutMetaPrefix):
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			mask.whiteouts[path.Join(path.Dir(name), strings.TrimPrefix(base, WhiteoutPrefix))] = true
+		default:
+			mask.entries[name] = hdr.Typeflag == tar.TypeDir
+		}
+	}
+}
+
+// copyVisible 输出layer里没有被上面各层遮住的条目
+func copyVisible(tw *tar.Writer, layer string, upper []*layerMask) error {
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read layer %s error %v", layer, err)
+		}
+		name := entryName(hdr.Name)
+		if strings.HasPrefix(path.Base(name), WhiteoutPrefix) {
+			continue
+		}
+		hidden := false
+		for _, mask := range upper {
+			if mask.hides(name) {
+				hidden = true
+				break
+			}
+		}
+		if hidden {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
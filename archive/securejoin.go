@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 和内核一样，最多跟随255次符号链接，防止链接成环
+const maxSymlinks = 255
+
+/*
+	SecureJoin 把容器里的路径解析成宿主机上root下的真实路径
+	路径里的符号链接按容器视角解析：绝对链接相对root，..最多回到root，
+	所以无论容器里放了什么链接，结果都不会跑到root外面
+	不存在的路径分量原样拼上去，方便用来确定要创建的文件的位置
+*/
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	resolved, err := resolvePath(unsafePath, func(rel string) (string, bool) {
+		return filepath.Join(root, rel), true
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+/*
+	ResolveInLayers 和SecureJoin一样解析路径里的符号链接，但容器的文件系统没有挂载，是由layers叠加起来的
+	layers从最上层开始排列，每个分量按LookupLower查找，上层删掉的文件和链接看不到
+	返回的是解析以后相对容器根目录的路径，由LookupLower再找到它在哪一层
+*/
+func ResolveInLayers(layers []string, unsafePath string) (string, error) {
+	return resolvePath(unsafePath, func(rel string) (string, bool) {
+		return LookupLower(layers, rel)
+	})
+}
+
+// resolvePath 逐个分量解析符号链接，返回以 / 开头的容器内路径，lookup给出容器内路径在宿主机上的位置
+func resolvePath(unsafePath string, lookup func(rel string) (string, bool)) (string, error) {
+	resolved := "/"
+	remaining := filepath.Clean("/" + unsafePath)
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i+1:]
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		hostPath, ok := lookup(next)
+		if !ok {
+			resolved = next
+			continue
+		}
+		fi, err := os.Lstat(hostPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		dest, err := os.Readlink(hostPath)
+		if err != nil {
+			return "", err
+		}
+		// 绝对链接从root重新开始，相对链接相对链接所在的目录
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		remaining = dest + "/" + remaining
+	}
+	return resolved, nil
+}
@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// pax扩展头里记录xattr的前缀，和GNU tar、docker一致
+const paxXattrPrefix = "SCHILY.xattr."
+
+// overlay自己用的xattr，不能打进layer里
+const overlayXattrPrefix = "trusted.overlay."
+
+// readXattrs 读取文件的扩展属性，文件系统不支持时返回空
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP || err == unix.ENODATA {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		key := string(name)
+		if key == "" || strings.HasPrefix(key, overlayXattrPrefix) {
+			continue
+		}
+		value, err := lgetxattr(path, key)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[key] = value
+	}
+	return xattrs, nil
+}
+
+func lgetxattr(path, key string) (string, error) {
+	size, err := unix.Lgetxattr(path, key, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, key, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+// setXattrHeader 把扩展属性写进pax扩展头
+func setXattrHeader(hdr *tar.Header, xattrs map[string]string) {
+	if len(xattrs) == 0 {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	for key, value := range xattrs {
+		hdr.PAXRecords[paxXattrPrefix+key] = value
+	}
+	hdr.Format = tar.FormatPAX
+}
+
+/*
+	applyXattrs 恢复tar里记录的扩展属性
+	security.capability会被chown清掉，所以要在chown之后调用
+	不是root时trusted.*设置不了，文件系统不支持xattr时也跳过
+*/
+func applyXattrs(path string, hdr *tar.Header) error {
+	for record, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(record, paxXattrPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(record, paxXattrPrefix)
+		if strings.HasPrefix(key, overlayXattrPrefix) {
+			continue
+		}
+		err := unix.Lsetxattr(path, key, []byte(value), 0)
+		if err == nil || err == unix.ENOTSUP || (err == syscall.EPERM && os.Geteuid() != 0) {
+			continue
+		}
+		return err
+	}
+	return nil
+}
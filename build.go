@@ -0,0 +1,370 @@
+package main
+
+import (
+	"cocin_dokcer/archive"
+	"cocin_dokcer/build"
+	"cocin_dokcer/container"
+	"cocin_dokcer/events"
+	"cocin_dokcer/image"
+	"cocin_dokcer/storage"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 构建时临时容器的镜像名，ps里能看出它是build的一步
+const buildImageName = "<build>"
+
+// builder 执行Containerfile，每一步都在当前镜像上生成新的镜像配置，RUN、COPY、ADD还会多一层layer
+type builder struct {
+	eng     *engine
+	images  *image.Store
+	driver  storage.Driver
+	context string
+	noCache bool
+
+	img       *image.Image // 当前镜像
+	id        string       // 当前镜像没有改动过时是它的ID
+	key       string       // 当前这一步的缓存key，由基础镜像和之前的每一步算出来
+	cmdSet    bool         // 这个阶段里写过CMD，ENTRYPOINT不再清掉它
+	stageName string
+	stages    map[string]*builder
+}
+
+/*
+	buildImage 实现build命令
+	1. 每一步的缓存key由上一步的key、指令原文和输入文件的摘要算出来，命中缓存时直接用缓存的镜像配置
+	2. RUN在临时容器里执行命令，和commit一样把可写层的变化做成layer
+	3. COPY和ADD不用启动容器，直接把构建上下文里的文件打成layer
+	4. ENV、WORKDIR这些只修改镜像配置
+*/
+func (eng *engine) buildImage(contextDir, file string, tags []string, noCache bool) error {
+	contextDir, err := filepath.Abs(contextDir)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(contextDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("build context %s is not a directory", contextDir)
+	}
+	if file == "" {
+		file = filepath.Join(contextDir, "Containerfile")
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			file = filepath.Join(contextDir, "Dockerfile")
+		}
+	}
+	for i, tag := range tags {
+		if tags[i], err = image.NormalizeName(tag); err != nil {
+			return err
+		}
+	}
+	instructions, err := build.ParseFile(file)
+	if err != nil {
+		return fmt.Errorf("parse %s error %v", file, err)
+	}
+	driver, err := eng.newStorageDriver()
+	if err != nil {
+		return err
+	}
+	b := &builder{
+		eng:     eng,
+		images:  eng.newImageStore(),
+		driver:  driver,
+		context: contextDir,
+		noCache: noCache,
+		stages:  make(map[string]*builder),
+	}
+	for i, ins := range instructions {
+		fmt.Printf("Step %d/%d : %s\n", i+1, len(instructions), ins.Original)
+		if err := b.dispatch(ins); err != nil {
+			return fmt.Errorf("line %d: %v", ins.Line, err)
+		}
+	}
+	id := b.id
+	if id == "" {
+		if id, err = b.images.CreateImage(b.img); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Successfully built %s\n", shortImageID(id))
+	for _, tag := range tags {
+		if err := b.images.SetName(tag, id); err != nil {
+			return err
+		}
+		fmt.Printf("Successfully tagged %s\n", tag)
+	}
+	return nil
+}
+
+func (b *builder) dispatch(ins build.Instruction) error {
+	for flag := range ins.Flags {
+		if !(flag == "chown" && (ins.Command == "COPY" || ins.Command == "ADD")) {
+			return fmt.Errorf("%s does not support --%s", ins.Command, flag)
+		}
+	}
+	switch ins.Command {
+	case "FROM":
+		return b.from(ins)
+	case "RUN":
+		return b.step(ins, "", func(img *image.Image) error {
+			diffID, err := b.runStep(img, build.ShellCommand(ins))
+			if err != nil {
+				return err
+			}
+			img.AddLayer(diffID, image.History{CreatedBy: ins.Original})
+			return nil
+		})
+	case "COPY", "ADD":
+		return b.copy(ins)
+	}
+	return b.step(ins, "", func(img *image.Image) error {
+		if err := build.Configure(ins, &img.Config, &b.cmdSet); err != nil {
+			return err
+		}
+		img.AddEmptyLayer(image.History{CreatedBy: ins.Original})
+		return nil
+	})
+}
+
+// from 开始一个新的阶段，基础镜像可以是前面的阶段、scratch或者镜像存储里的镜像
+func (b *builder) from(ins build.Instruction) error {
+	args := ins.Args
+	if len(args) != 1 && !(len(args) == 3 && strings.EqualFold(args[1], "AS")) {
+		return fmt.Errorf("FROM requires an image and an optional AS name")
+	}
+	if b.stageName != "" {
+		saved := *b
+		b.stages[b.stageName] = &saved
+	}
+	b.stageName, b.cmdSet = "", false
+	if len(args) == 3 {
+		b.stageName = args[2]
+	}
+	if stage, ok := b.stages[args[0]]; ok {
+		b.img, b.id, b.key = stage.img.Child(), stage.id, stage.key
+		return nil
+	}
+	if args[0] == "scratch" {
+		b.img, b.id, b.key = image.NewImage(), "", image.Digest([]byte("scratch"))
+		return nil
+	}
+	id, img, err := b.eng.resolveImage(b.images, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf(" ---> %s\n", shortImageID(id))
+	b.img, b.id, b.key = img, id, id
+	return nil
+}
+
+// step 执行一步，input是这一步用到的文件的摘要，和指令一起决定缓存key
+func (b *builder) step(ins build.Instruction, input string, apply func(img *image.Image) error) error {
+	img, key, cached, err := build.Step(b.images, b.noCache, b.img, b.key, ins, input, apply)
+	if err != nil {
+		return err
+	}
+	if cached {
+		fmt.Println(" ---> Using cache")
+	}
+	b.img, b.id, b.key = img, "", key
+	return nil
+}
+
+/*
+	runStep 在img上启动一个临时容器执行命令，成功以后把可写层的变化做成layer
+	临时容器和run启动的容器一样记录状态，构建被打断时由状态修复流程清理
+*/
+func (b *builder) runStep(img *image.Image, cmdArray []string) (string, error) {
+	id, err := container.GenerateContainerID()
+	if err != nil {
+		return "", err
+	}
+	containerName := "build-" + container.ShortID(id)
+	parent, writePipe, containerInfo, err := b.eng.launchContainer(b.driver, launchSpec{
+		ID:        id,
+		Name:      containerName,
+		Image:     img,
+		ImageName: buildImageName,
+		Command:   cmdArray,
+		Env:       img.Config.Env,
+		TTY:       true,
+		// 构建过程不从终端读输入
+		NoStdin: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	journal := b.eng.newJournal()
+	initConfig, err := b.eng.imageInitConfig(cmdArray, img.Config, containerName)
+	if err != nil {
+		writePipe.Close()
+		b.eng.abortContainer(parent, containerInfo)
+		return "", err
+	}
+	sendInitCommand(initConfig, writePipe)
+	journal.Log(events.TypeContainer, "start", id, containerAttributes(containerInfo))
+	parent.Wait()
+	exitCode := parent.ProcessState.ExitCode()
+	b.eng.recordContainerExit(containerInfo, strconv.Itoa(exitCode))
+	defer b.eng.destroyContainer(containerInfo)
+	if exitCode != 0 {
+		return "", fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(cmdArray, " "), exitCode)
+	}
+	return diffLayer(b.images, b.driver, containerName, containerInfo.LowerDirs)
+}
+
+/*
+	copy 实现COPY和ADD，把构建上下文里的文件做成一层layer
+	1. 来源只能在构建上下文里，路径里的符号链接也按上下文解析，支持通配符
+	2. 来源是目录时复制目录下的内容；有多个来源或者目标以 / 结尾时目标是目录
+	3. ADD还支持下载URL和解压本地的tar、tar.gz包
+	4. 复制进去的文件属主默认是root，可以用 --chown=uid:gid 指定
+*/
+func (b *builder) copy(ins build.Instruction) error {
+	var args []string
+	for _, arg := range ins.Args {
+		args = append(args, build.Expand(arg, b.img.Config.Env))
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s requires at least one source and a destination", ins.Command)
+	}
+	uid, gid, err := build.ParseChown(ins.Flags["chown"])
+	if err != nil {
+		return err
+	}
+	tmpRoot := filepath.Join(b.images.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(tmpRoot, "build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	var sources []build.CopySource
+	for _, src := range args[:len(args)-1] {
+		found, err := b.copySources(ins.Command == "ADD", src, tmpDir)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, found...)
+	}
+	dest := build.ContainerPath(b.img.Config.WorkingDir, args[len(args)-1])
+	destIsDir := strings.HasSuffix(args[len(args)-1], "/") || len(sources) > 1
+	input, err := build.SourcesDigest(sources)
+	if err != nil {
+		return err
+	}
+	return b.step(ins, input, func(img *image.Image) error {
+		// FROM scratch之后的第一层下面没有别的layer
+		var lowerDirs []string
+		if len(img.RootFS.DiffIDs) > 0 {
+			if lowerDirs, err = b.images.LowerDirs(img, b.driver.WhiteoutFormat()); err != nil {
+				return err
+			}
+		}
+		staging := filepath.Join(tmpDir, "staging")
+		if err := build.StageCopy(staging, lowerDirs, sources, dest, destIsDir, uid, gid); err != nil {
+			return err
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(archive.Tar(staging, writer))
+		}()
+		diffID, err := b.images.PutLayer(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		img.AddLayer(diffID, image.History{CreatedBy: ins.Original})
+		return nil
+	})
+}
+
+// copySources 在构建上下文里找到src对应的文件，ADD的URL下载到tmpDir
+func (b *builder) copySources(add bool, src, tmpDir string) ([]build.CopySource, error) {
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		if !add {
+			return nil, fmt.Errorf("COPY does not support URLs, use ADD")
+		}
+		downloaded, err := downloadURL(src, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		return []build.CopySource{downloaded}, nil
+	}
+	pattern, err := archive.SecureJoin(b.context, src)
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{pattern}
+	if strings.ContainsAny(filepath.Base(src), "*?[") {
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return nil, err
+		}
+	}
+	var sources []build.CopySource
+	for _, match := range matches {
+		fi, err := os.Lstat(match)
+		if err != nil {
+			return nil, fmt.Errorf("%s not found in build context", src)
+		}
+		sources = append(sources, build.CopySource{
+			Path:    match,
+			Name:    filepath.Base(match),
+			Extract: add && fi.Mode().IsRegular() && build.IsTarArchive(match),
+		})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source files were specified by %s", src)
+	}
+	return sources, nil
+}
+
+// downloadURL ADD的URL下载成一个权限是0600的文件，文件名取URL路径的最后一段
+func downloadURL(rawURL, tmpDir string) (build.CopySource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return build.CopySource{}, err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return build.CopySource{}, fmt.Errorf("cannot determine a file name from %s", rawURL)
+	}
+	dir, err := ioutil.TempDir(tmpDir, "download-")
+	if err != nil {
+		return build.CopySource{}, err
+	}
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return build.CopySource{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return build.CopySource{}, fmt.Errorf("download %s error %s", rawURL, resp.Status)
+	}
+	target := filepath.Join(dir, name)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return build.CopySource{}, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return build.CopySource{}, fmt.Errorf("download %s error %v", rawURL, err)
+	}
+	// 文件时间固定下来，内容不变时缓存才能命中
+	if err := f.Close(); err != nil {
+		return build.CopySource{}, err
+	}
+	if err := os.Chtimes(target, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		return build.CopySource{}, err
+	}
+	return build.CopySource{Path: target, Name: name, FromURL: true}, nil
+}
@@ -0,0 +1,31 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheKey 一步的缓存key，由上一步的key、指令原文和这一步用到的文件的摘要算出来
+func CacheKey(parentKey string, ins Instruction, input string) string {
+	return image.Digest([]byte(parentKey + "\n" + ins.Original + "\n" + input))
+}
+
+/*
+	Step 在parent上执行一步，返回这一步生成的镜像配置和它的缓存key，cached表示命中了缓存
+	命中缓存时不调用apply；没命中时在parent的子镜像上调用apply，成功以后写入缓存
+	noCache只是不读缓存，结果照样写进去，后面的构建还能用
+*/
+func Step(images *image.Store, noCache bool, parent *image.Image, parentKey string, ins Instruction, input string, apply func(img *image.Image) error) (*image.Image, string, bool, error) {
+	key := CacheKey(parentKey, ins, input)
+	if cached, ok := images.CachedImage(key); ok && !noCache {
+		return cached, key, true, nil
+	}
+	img := parent.Child()
+	if err := apply(img); err != nil {
+		return nil, "", false, err
+	}
+	if err := images.PutCache(key, img); err != nil {
+		log.Warnf("Save build cache error %v", err)
+	}
+	return img, key, false, nil
+}
@@ -0,0 +1,45 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	"testing"
+)
+
+func TestStepCache(t *testing.T) {
+	images := image.New(t.TempDir())
+	base := image.NewImage()
+	ins, _ := ParseChange("ENV A=1")
+	runs := 0
+	apply := func(img *image.Image) error {
+		runs++
+		return Configure(ins, &img.Config, new(bool))
+	}
+
+	img, key, cached, err := Step(images, false, base, "base", ins, "", apply)
+	if err != nil || cached || runs != 1 {
+		t.Fatalf("first step should miss the cache, cached=%v runs=%d err=%v", cached, runs, err)
+	}
+	if len(img.Config.Env) != 1 || key != CacheKey("base", ins, "") {
+		t.Errorf("unexpected step result %v %s", img.Config.Env, key)
+	}
+
+	again, againKey, cached, err := Step(images, false, base, "base", ins, "", apply)
+	if err != nil || !cached || runs != 1 || againKey != key || len(again.Config.Env) != 1 {
+		t.Errorf("same step should hit the cache, cached=%v runs=%d err=%v", cached, runs, err)
+	}
+	// 上一步、输入文件和指令任何一个变了都不能命中
+	if _, other, cached, _ := Step(images, false, base, "other", ins, "", apply); cached || other == key {
+		t.Errorf("different parent should miss the cache")
+	}
+	if _, _, cached, _ := Step(images, false, base, "base", ins, "sha256:abc", apply); cached {
+		t.Errorf("different input should miss the cache")
+	}
+	other, _ := ParseChange("ENV A=2")
+	if _, _, cached, _ := Step(images, false, base, "base", other, "", apply); cached {
+		t.Errorf("different instruction should miss the cache")
+	}
+	runs = 0
+	if _, _, cached, _ := Step(images, true, base, "base", ins, "", apply); cached || runs != 1 {
+		t.Errorf("--no-cache should always run the step")
+	}
+}
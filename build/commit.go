@@ -0,0 +1,38 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	"fmt"
+)
+
+/*
+	CommitImage 以parent为父镜像生成commit出来的新镜像的配置，返回的镜像还没有加上新的layer
+	changes是commit --change给出的指令，写法和Containerfile一样，只接受修改镜像配置的指令
+	在打包可写层之前调用，写错了不用白白打包一次
+*/
+func CommitImage(parent *image.Image, changes []string) (*image.Image, error) {
+	img := parent.Child()
+	cmdSet := false
+	for _, change := range changes {
+		ins, err := ParseChange(change)
+		if err != nil {
+			return nil, err
+		}
+		if err := Configure(ins, &img.Config, &cmdSet); err != nil {
+			return nil, fmt.Errorf("apply change %q error %v", ins.Original, err)
+		}
+	}
+	return img, nil
+}
+
+// AddCommitLayer 把容器可写层打包出来的layer叠到新镜像上，author不为空时作为新镜像的作者，和message一起记在这一层的历史里
+func AddCommitLayer(img *image.Image, diffID, containerName, author, message string) {
+	if author != "" {
+		img.Author = author
+	}
+	img.AddLayer(diffID, image.History{
+		CreatedBy: fmt.Sprintf("commit %s", containerName),
+		Author:    author,
+		Comment:   message,
+	})
+}
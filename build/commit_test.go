@@ -0,0 +1,78 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	"reflect"
+	"testing"
+)
+
+func TestCommitImage(t *testing.T) {
+	parent := image.NewImage()
+	parent.Author = "base"
+	parent.Config.Env = []string{"PATH=/bin"}
+	parent.Config.Entrypoint = []string{"/entry"}
+	parent.Config.Cmd = []string{"serve"}
+	parent.AddLayer("sha256:base", image.History{CreatedBy: "import"})
+
+	img, err := CommitImage(parent, []string{"ENV MODE=prod", `ENTRYPOINT ["/app"]`, "EXPOSE 8080", "workdir /srv"})
+	if err != nil {
+		t.Fatalf("commit image error %v", err)
+	}
+	if !reflect.DeepEqual(img.Config.Env, []string{"PATH=/bin", "MODE=prod"}) {
+		t.Errorf("env = %q", img.Config.Env)
+	}
+	// 只改了ENTRYPOINT，继承来的CMD要清掉
+	if !reflect.DeepEqual(img.Config.Entrypoint, []string{"/app"}) || len(img.Config.Cmd) != 0 {
+		t.Errorf("entrypoint = %q, cmd = %q", img.Config.Entrypoint, img.Config.Cmd)
+	}
+	if _, ok := img.Config.ExposedPorts["8080/tcp"]; !ok || img.Config.WorkingDir != "/srv" {
+		t.Errorf("exposed ports = %v, working dir = %s", img.Config.ExposedPorts, img.Config.WorkingDir)
+	}
+	// 父镜像不受影响
+	if !reflect.DeepEqual(parent.Config.Env, []string{"PATH=/bin"}) || !reflect.DeepEqual(parent.Config.Cmd, []string{"serve"}) {
+		t.Errorf("parent config changed: %+v", parent.Config)
+	}
+
+	AddCommitLayer(img, "sha256:diff", "web", "alice", "fix config")
+	if img.Author != "alice" {
+		t.Errorf("author = %s", img.Author)
+	}
+	if !reflect.DeepEqual(img.RootFS.DiffIDs, []string{"sha256:base", "sha256:diff"}) {
+		t.Errorf("diff ids = %q", img.RootFS.DiffIDs)
+	}
+	history := img.History[len(img.History)-1]
+	if history.CreatedBy != "commit web" || history.Author != "alice" || history.Comment != "fix config" || history.EmptyLayer {
+		t.Errorf("history = %+v", history)
+	}
+	if len(parent.History) != 1 || len(parent.RootFS.DiffIDs) != 1 {
+		t.Errorf("parent layers changed: %+v", parent.RootFS)
+	}
+}
+
+func TestAddCommitLayerKeepsAuthor(t *testing.T) {
+	img := image.NewImage()
+	img.Author = "base"
+	AddCommitLayer(img, "sha256:diff", "web", "", "")
+	if img.Author != "base" {
+		t.Errorf("empty author should keep the parent author, got %s", img.Author)
+	}
+	if history := img.History[0]; history.Author != "" || history.Comment != "" {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestCommitImageErrors(t *testing.T) {
+	for _, changes := range [][]string{
+		{"RUN echo hi"},
+		{"COPY a /a"},
+		{"FROM busybox"},
+		{"BOGUS x"},
+		{"ENV"},
+		{"EXPOSE 80/icmp"},
+		{"ENV A=1", "WORKDIR a b"},
+	} {
+		if _, err := CommitImage(image.NewImage(), changes); err == nil {
+			t.Errorf("CommitImage(%q) should fail", changes)
+		}
+	}
+}
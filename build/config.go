@@ -0,0 +1,112 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ShellCommand json数组的写法原样执行，否则交给 /bin/sh -c
+func ShellCommand(ins Instruction) []string {
+	if ins.JSON {
+		return ins.Args
+	}
+	return []string{"/bin/sh", "-c", ins.Args[0]}
+}
+
+// Configure 只修改镜像配置的指令，参数里的 $VAR 按当前的环境变量替换
+// cmdSet记录这个阶段有没有设置过CMD，ENTRYPOINT要用它判断是否清掉继承来的CMD
+func Configure(ins Instruction, config *image.Config, cmdSet *bool) error {
+	expand := func(s string) string {
+		return Expand(s, config.Env)
+	}
+	switch ins.Command {
+	case "ENV":
+		pairs, err := KeyValues(ins.Args)
+		if err != nil {
+			return err
+		}
+		for _, kv := range pairs {
+			config.Env = setEnv(config.Env, kv[0], expand(kv[1]))
+		}
+	case "LABEL":
+		pairs, err := KeyValues(ins.Args)
+		if err != nil {
+			return err
+		}
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		for _, kv := range pairs {
+			config.Labels[kv[0]] = expand(kv[1])
+		}
+	case "WORKDIR":
+		if len(ins.Args) != 1 {
+			return fmt.Errorf("WORKDIR requires exactly one path")
+		}
+		config.WorkingDir = ContainerPath(config.WorkingDir, expand(ins.Args[0]))
+	case "USER":
+		if len(ins.Args) != 1 {
+			return fmt.Errorf("USER requires exactly one user")
+		}
+		config.User = expand(ins.Args[0])
+	case "EXPOSE":
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[string]struct{})
+		}
+		for _, arg := range ins.Args {
+			port, err := exposedPort(expand(arg))
+			if err != nil {
+				return err
+			}
+			config.ExposedPorts[port] = struct{}{}
+		}
+	case "CMD":
+		config.Cmd = ShellCommand(ins)
+		*cmdSet = true
+	case "ENTRYPOINT":
+		config.Entrypoint = ShellCommand(ins)
+		// 和docker一样，基础镜像的CMD是给原来的ENTRYPOINT用的，换了ENTRYPOINT就不要了
+		if !*cmdSet {
+			config.Cmd = nil
+		}
+	}
+	return nil
+}
+
+// setEnv 设置环境变量，已有的同名变量被替换
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// ContainerPath 相对路径相对当前的工作目录
+func ContainerPath(workingDir, p string) string {
+	if !path.IsAbs(p) {
+		if workingDir == "" {
+			workingDir = "/"
+		}
+		p = path.Join(workingDir, p)
+	}
+	return path.Clean(p)
+}
+
+// exposedPort 80 和 80/udp 写成 80/tcp 80/udp
+func exposedPort(arg string) (string, error) {
+	parts := strings.SplitN(arg, "/", 2)
+	proto := "tcp"
+	if len(parts) == 2 {
+		proto = strings.ToLower(parts[1])
+	}
+	if port, err := strconv.Atoi(parts[0]); err != nil || port <= 0 || port > 65535 || (proto != "tcp" && proto != "udp" && proto != "sctp") {
+		return "", fmt.Errorf("invalid port %q", arg)
+	}
+	return parts[0] + "/" + proto, nil
+}
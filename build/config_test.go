@@ -0,0 +1,94 @@
+package build
+
+import (
+	"cocin_dokcer/image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configureAll 依次执行每行一条的配置指令，返回最终的镜像配置
+func configureAll(t *testing.T, config image.Config, lines string) image.Config {
+	cmdSet := false
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		ins, err := ParseChange(line)
+		if err != nil {
+			t.Fatalf("parse %q error %v", line, err)
+		}
+		if err := Configure(ins, &config, &cmdSet); err != nil {
+			t.Fatalf("configure %s error %v", ins.Original, err)
+		}
+	}
+	return config
+}
+
+func TestConfigure(t *testing.T) {
+	config := configureAll(t, image.Config{Env: []string{"PATH=/bin", "HOME=/root"}}, `
+ENV HOME=/home/app APP=web
+WORKDIR /srv
+WORKDIR $APP
+USER ${APP}:staff
+LABEL version=1 owner=$APP
+EXPOSE 80 53/UDP
+`)
+	if !reflect.DeepEqual(config.Env, []string{"PATH=/bin", "HOME=/home/app", "APP=web"}) {
+		t.Errorf("env = %q", config.Env)
+	}
+	if config.WorkingDir != "/srv/web" {
+		t.Errorf("working dir = %s", config.WorkingDir)
+	}
+	if config.User != "web:staff" {
+		t.Errorf("user = %s", config.User)
+	}
+	if config.Labels["version"] != "1" || config.Labels["owner"] != "web" {
+		t.Errorf("labels = %v", config.Labels)
+	}
+	if _, ok := config.ExposedPorts["80/tcp"]; !ok || len(config.ExposedPorts) != 2 {
+		t.Errorf("exposed ports = %v", config.ExposedPorts)
+	}
+	if _, ok := config.ExposedPorts["53/udp"]; !ok {
+		t.Errorf("exposed ports = %v", config.ExposedPorts)
+	}
+}
+
+func TestConfigureEntrypointResetsCmd(t *testing.T) {
+	base := image.Config{Entrypoint: []string{"/docker-entrypoint.sh"}, Cmd: []string{"nginx"}}
+	// 换了ENTRYPOINT，基础镜像的CMD不要了
+	config := configureAll(t, base, `ENTRYPOINT ["/app"]`)
+	if !reflect.DeepEqual(config.Entrypoint, []string{"/app"}) || config.Cmd != nil {
+		t.Errorf("entrypoint = %q cmd = %q", config.Entrypoint, config.Cmd)
+	}
+	// 同一个阶段里先写的CMD保留
+	config = configureAll(t, base, "CMD echo hi\n"+`ENTRYPOINT ["/app"]`)
+	if !reflect.DeepEqual(config.Cmd, []string{"/bin/sh", "-c", "echo hi"}) {
+		t.Errorf("cmd = %q", config.Cmd)
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	for _, change := range []string{"WORKDIR /a /b", "USER a b", "EXPOSE 0", "EXPOSE 80/http", "EXPOSE 70000"} {
+		ins, err := ParseChange(change)
+		if err != nil {
+			t.Fatalf("parse %q error %v", change, err)
+		}
+		cmdSet := false
+		if err := Configure(ins, &image.Config{}, &cmdSet); err == nil {
+			t.Errorf("%q should fail", change)
+		}
+	}
+}
+
+func TestContainerPath(t *testing.T) {
+	tests := [][3]string{
+		{"", "app", "/app"},
+		{"/srv", "app", "/srv/app"},
+		{"/srv", "/etc/", "/etc"},
+		{"/srv", "../etc", "/etc"},
+		{"/srv", ".", "/srv"},
+	}
+	for _, test := range tests {
+		if got := ContainerPath(test[0], test[1]); got != test[2] {
+			t.Errorf("ContainerPath(%q, %q) = %s, want %s", test[0], test[1], got, test[2])
+		}
+	}
+}
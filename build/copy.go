@@ -0,0 +1,201 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"cocin_dokcer/archive"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CopySource COPY和ADD的一个来源，URL下载下来以后也是本地文件
+type CopySource struct {
+	Path    string
+	Name    string // 复制到目标目录下时的文件名
+	Extract bool   // ADD的本地压缩包解压到目标目录
+	FromURL bool
+}
+
+// IsTarArchive 判断文件是不是tar包，gzip压缩的也算
+func IsTarArchive(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	rc, err := archive.DecompressStream(bufio.NewReader(f))
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	_, err = tar.NewReader(rc).Next()
+	return err == nil
+}
+
+// SourcesDigest 来源文件的摘要，文件内容、权限和修改时间变了缓存就失效
+func SourcesDigest(sources []CopySource) (string, error) {
+	hash := sha256.New()
+	for _, src := range sources {
+		fmt.Fprintf(hash, "%s %v\n", src.Name, src.Extract)
+		if err := archive.TarPath(src.Path, src.Name, hash); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// StageCopy 在staging下按容器里的路径摆好要复制的文件，staging就是新layer的内容
+func StageCopy(staging string, lowerDirs []string, sources []CopySource, dest string, destIsDir bool, uid, gid int) error {
+	destDir, destName := dest, ""
+	// 和docker一样，目标不以 / 结尾、但镜像里已经是目录时，文件复制到这个目录下面，不能把目录换成文件
+	if !destIsDir && len(sources) == 1 && !sources[0].Extract && !lowerIsDir(lowerDirs, dest) {
+		if fi, err := os.Stat(sources[0].Path); err == nil && !fi.IsDir() {
+			destDir, destName = path.Dir(dest), path.Base(dest)
+		}
+	}
+	target := filepath.Join(staging, destDir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	// 目标的上级目录在镜像里已经有了的话，保持原来的权限和属主，不能被新layer改掉
+	if err := mirrorParents(staging, destDir, lowerDirs); err != nil {
+		return err
+	}
+	var copied []string
+	for _, src := range sources {
+		fi, err := os.Lstat(src.Path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case src.Extract:
+			if err := extractArchive(src.Path, target); err != nil {
+				return err
+			}
+			copied = append(copied, target)
+		case fi.IsDir():
+			entries, err := ioutil.ReadDir(src.Path)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := archive.CopyPath(filepath.Join(src.Path, entry.Name()), target, entry.Name()); err != nil {
+					return err
+				}
+				copied = append(copied, filepath.Join(target, entry.Name()))
+			}
+		default:
+			name := src.Name
+			if destName != "" {
+				name = destName
+			}
+			if err := archive.CopyPath(src.Path, target, name); err != nil {
+				return err
+			}
+			copied = append(copied, filepath.Join(target, name))
+		}
+	}
+	// 新建的目标目录本身也属于复制进来的文件
+	if _, exists := archive.LookupLower(lowerDirs, strings.TrimPrefix(destDir, "/")); !exists && destName == "" && destDir != "/" {
+		copied = append(copied, target)
+	}
+	for _, p := range copied {
+		if err := chownTree(p, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lowerIsDir 判断dest在镜像里是不是一个目录，指向目录的符号链接不算
+func lowerIsDir(lowerDirs []string, dest string) bool {
+	lower, ok := archive.LookupLower(lowerDirs, strings.TrimPrefix(dest, "/"))
+	if !ok {
+		return false
+	}
+	fi, err := os.Lstat(lower)
+	return err == nil && fi.IsDir()
+}
+
+// mirrorParents 把镜像里已有目录的权限、属主和时间复制到staging里对应的目录上
+func mirrorParents(staging, dir string, lowerDirs []string) error {
+	rel := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		rel = path.Join(rel, part)
+		lower, ok := archive.LookupLower(lowerDirs, rel)
+		if !ok {
+			return nil
+		}
+		fi, err := os.Stat(lower)
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		staged := filepath.Join(staging, rel)
+		if err := os.Chmod(staged, fi.Mode()&os.ModePerm|fi.Mode()&(os.ModeSticky|os.ModeSetgid|os.ModeSetuid)); err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(staged, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+		if err := os.Chtimes(staged, fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractArchive(file, dest string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, err := archive.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return archive.Untar(rc, dest)
+}
+
+// chownTree 改掉复制进来的文件的属主，符号链接改它本身
+func chownTree(root string, uid, gid int) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// ParseChown 解析 --chown=uid[:gid]，构建时容器不在运行，只支持数字
+func ParseChown(chown string) (int, int, error) {
+	if chown == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(chown, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("--chown only supports numeric ids, got %q", chown)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("--chown only supports numeric ids, got %q", chown)
+		}
+	}
+	return uid, gid, nil
+}
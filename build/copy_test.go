@@ -0,0 +1,99 @@
+package build
+
+import (
+	"cocin_dokcer/archive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stage 把sources按dest的规则复制到一个新的staging目录里
+func stage(t *testing.T, lowerDirs []string, sources []CopySource, dest string, destIsDir bool) string {
+	staging := filepath.Join(t.TempDir(), "staging")
+	if err := StageCopy(staging, lowerDirs, sources, dest, destIsDir, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatalf("stage copy to %s error %v", dest, err)
+	}
+	return staging
+}
+
+func assertFile(t *testing.T, path, content string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err != nil || string(got) != content {
+		t.Errorf("%s = %q, %v, want %q", path, got, err, content)
+	}
+}
+
+func TestStageCopyDestination(t *testing.T) {
+	context := t.TempDir()
+	ioutil.WriteFile(filepath.Join(context, "app.conf"), []byte("conf"), 0644)
+	ioutil.WriteFile(filepath.Join(context, "run.sh"), []byte("run"), 0755)
+	os.MkdirAll(filepath.Join(context, "src", "lib"), 0755)
+	ioutil.WriteFile(filepath.Join(context, "src", "main.go"), []byte("main"), 0644)
+	ioutil.WriteFile(filepath.Join(context, "src", "lib", "lib.go"), []byte("lib"), 0644)
+	conf := CopySource{Path: filepath.Join(context, "app.conf"), Name: "app.conf"}
+	run := CopySource{Path: filepath.Join(context, "run.sh"), Name: "run.sh"}
+	src := CopySource{Path: filepath.Join(context, "src"), Name: "src"}
+
+	// 镜像里/etc是目录，/opt在上层被删掉了
+	lower := t.TempDir()
+	os.Mkdir(filepath.Join(lower, "etc"), 0700)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "hosts"), []byte("hosts"), 0644)
+	base := t.TempDir()
+	os.Mkdir(filepath.Join(base, "opt"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, archive.WhiteoutPrefix+"opt"), nil, 0600)
+	lowerDirs := []string{lower, base}
+
+	// 目标不存在、不以 / 结尾时复制成目标本身
+	staging := stage(t, lowerDirs, []CopySource{conf}, "/srv/web.conf", false)
+	assertFile(t, filepath.Join(staging, "srv", "web.conf"), "conf")
+
+	// 目标在镜像里是目录时复制到目录下面，目录的权限保持不变
+	staging = stage(t, lowerDirs, []CopySource{conf}, "/etc", false)
+	assertFile(t, filepath.Join(staging, "etc", "app.conf"), "conf")
+	if fi, err := os.Stat(filepath.Join(staging, "etc")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("existing directory should keep its mode, got %v %v", fi, err)
+	}
+
+	// 被删掉的目录不算已经存在
+	staging = stage(t, lowerDirs, []CopySource{conf}, "/opt", false)
+	assertFile(t, filepath.Join(staging, "opt"), "conf")
+
+	// 以 / 结尾时目标是目录
+	staging = stage(t, lowerDirs, []CopySource{conf}, "/srv/", true)
+	assertFile(t, filepath.Join(staging, "srv", "app.conf"), "conf")
+
+	// 多个来源时目标是目录
+	staging = stage(t, lowerDirs, []CopySource{conf, run}, "/srv", true)
+	assertFile(t, filepath.Join(staging, "srv", "app.conf"), "conf")
+	assertFile(t, filepath.Join(staging, "srv", "run.sh"), "run")
+
+	// 来源是目录时复制目录下的内容
+	staging = stage(t, lowerDirs, []CopySource{src}, "/app", false)
+	assertFile(t, filepath.Join(staging, "app", "main.go"), "main")
+	assertFile(t, filepath.Join(staging, "app", "lib", "lib.go"), "lib")
+	if _, err := os.Stat(filepath.Join(staging, "app", "src")); !os.IsNotExist(err) {
+		t.Errorf("directory itself should not be copied, %v", err)
+	}
+}
+
+func TestParseChown(t *testing.T) {
+	tests := []struct {
+		chown    string
+		uid, gid int
+		ok       bool
+	}{
+		{"", 0, 0, true},
+		{"1000", 1000, 1000, true},
+		{"1000:50", 1000, 50, true},
+		{"app", 0, 0, false},
+		{"1000:staff", 0, 0, false},
+	}
+	for _, test := range tests {
+		uid, gid, err := ParseChown(test.chown)
+		if (err == nil) != test.ok || uid != test.uid || gid != test.gid {
+			t.Errorf("ParseChown(%q) = %d %d %v", test.chown, uid, gid, err)
+		}
+	}
+}
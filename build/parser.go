@@ -0,0 +1,238 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Instruction Containerfile里的一条指令
+type Instruction struct {
+	Line     int
+	Command  string            // 大写的指令名
+	Flags    map[string]string // --from=xxx 这样的选项
+	Args     []string
+	JSON     bool   // 参数是 ["a", "b"] 的写法
+	Original string // 原始的一行，用来显示和计算缓存
+}
+
+func (ins Instruction) String() string {
+	return ins.Original
+}
+
+// 支持的指令，其他的报错
+var supported = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "WORKDIR": true,
+	"CMD": true, "ENTRYPOINT": true, "EXPOSE": true, "LABEL": true, "USER": true,
+}
+
+/*
+	Parse 解析Containerfile
+	1. # 开头的是注释，空行忽略，行尾的 \ 表示下一行接着写
+	2. RUN、CMD、ENTRYPOINT的参数可以是json数组，否则整行交给shell执行
+	3. COPY和ADD也可以写成json数组，方便写带空格的路径
+	4. 第一条指令必须是FROM
+*/
+func Parse(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo, start := 0, 0
+	var logical strings.Builder
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if logical.Len() == 0 {
+			start = lineNo
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+		} else if strings.HasPrefix(trimmed, "#") {
+			// 续行中间的注释也忽略
+			continue
+		}
+		if strings.HasSuffix(trimmed, "\\") {
+			logical.WriteString(strings.TrimSuffix(trimmed, "\\"))
+			logical.WriteString(" ")
+			continue
+		}
+		logical.WriteString(trimmed)
+		ins, err := parseLine(logical.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, ins)
+		logical.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if logical.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unexpected end of file after \\", start)
+	}
+	if len(instructions) == 0 || instructions[0].Command != "FROM" {
+		return nil, fmt.Errorf("the first instruction must be FROM")
+	}
+	return instructions, nil
+}
+
+// ParseFile 解析文件
+func ParseFile(path string) ([]Instruction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// 只修改镜像配置的指令，commit --change 只接受这些
+var configOnly = map[string]bool{
+	"ENV": true, "WORKDIR": true, "CMD": true, "ENTRYPOINT": true, "EXPOSE": true, "LABEL": true, "USER": true,
+}
+
+// ParseChange 解析commit --change 给出的一条指令，比如 CMD ["sh"] 或者 ENV A=1
+func ParseChange(change string) (Instruction, error) {
+	ins, err := parseLine(change, 1)
+	if err != nil {
+		return ins, fmt.Errorf("invalid change %q: %v", change, err)
+	}
+	if !configOnly[ins.Command] {
+		return ins, fmt.Errorf("%s is not supported by --change", ins.Command)
+	}
+	return ins, nil
+}
+
+func parseLine(line string, lineNo int) (Instruction, error) {
+	ins := Instruction{Line: lineNo, Original: strings.TrimSpace(line), Flags: make(map[string]string)}
+	fields := strings.SplitN(ins.Original, " ", 2)
+	ins.Command = strings.ToUpper(fields[0])
+	if !supported[ins.Command] {
+		return ins, fmt.Errorf("line %d: unknown instruction %s", lineNo, fields[0])
+	}
+	rest := ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+	// 选项写在指令名后面，参数前面
+	for strings.HasPrefix(rest, "--") {
+		parts := strings.SplitN(rest, " ", 2)
+		kv := strings.SplitN(strings.TrimPrefix(parts[0], "--"), "=", 2)
+		if len(kv) != 2 {
+			return ins, fmt.Errorf("line %d: flag %s needs a value", lineNo, parts[0])
+		}
+		ins.Flags[kv[0]] = kv[1]
+		rest = ""
+		if len(parts) == 2 {
+			rest = strings.TrimSpace(parts[1])
+		}
+	}
+	if rest == "" {
+		return ins, fmt.Errorf("line %d: %s requires arguments", lineNo, ins.Command)
+	}
+	switch ins.Command {
+	case "RUN", "CMD", "ENTRYPOINT", "COPY", "ADD":
+		if strings.HasPrefix(rest, "[") {
+			var args []string
+			if err := json.Unmarshal([]byte(rest), &args); err == nil {
+				ins.Args, ins.JSON = args, true
+				break
+			}
+		}
+		if ins.Command == "COPY" || ins.Command == "ADD" {
+			words, err := SplitWords(rest)
+			if err != nil {
+				return ins, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			ins.Args = words
+		} else {
+			ins.Args = []string{rest}
+		}
+	case "ENV", "LABEL", "EXPOSE", "FROM", "WORKDIR", "USER":
+		words, err := SplitWords(rest)
+		if err != nil {
+			return ins, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		ins.Args = words
+	}
+	return ins, nil
+}
+
+// SplitWords 按空白切分，单引号和双引号里的空白不切分，引号本身去掉，\ 转义下一个字符
+func SplitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// KeyValues 解析ENV和LABEL的参数，支持 k=v k2=v2 和 旧的 k v 两种写法
+func KeyValues(args []string) ([][2]string, error) {
+	var pairs [][2]string
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s has no value", args[0])
+		}
+		return [][2]string{{args[0], strings.Join(args[1:], " ")}}, nil
+	}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid key=value %q", arg)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// Expand 替换参数里的 $VAR 和 ${VAR}，env里是 k=v 形式的环境变量
+func Expand(s string, env []string) string {
+	values := make(map[string]string)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return os.Expand(s, func(key string) string {
+		return values[key]
+	})
+}
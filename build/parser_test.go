@@ -0,0 +1,75 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	file := `# comment
+FROM busybox AS base
+ENV A=1 B="two words"
+RUN echo hello \
+    # continued
+    && echo world
+COPY --chown=0:0 ["a b", "/dst/"]
+CMD ["sh", "-c", "echo $A"]
+entrypoint /bin/sh
+`
+	instructions, err := Parse(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("parse error %v", err)
+	}
+	if len(instructions) != 6 {
+		t.Fatalf("got %d instructions", len(instructions))
+	}
+	if got := instructions[0].Args; !reflect.DeepEqual(got, []string{"busybox", "AS", "base"}) {
+		t.Errorf("FROM args = %q", got)
+	}
+	pairs, err := KeyValues(instructions[1].Args)
+	if err != nil || len(pairs) != 2 || pairs[1] != [2]string{"B", "two words"} {
+		t.Errorf("ENV pairs = %q, %v", pairs, err)
+	}
+	if got := instructions[2].Args; len(got) != 1 || got[0] != "echo hello  && echo world" || instructions[2].Line != 4 {
+		t.Errorf("RUN = %q line %d", got, instructions[2].Line)
+	}
+	if ins := instructions[3]; !ins.JSON || ins.Flags["chown"] != "0:0" || !reflect.DeepEqual(ins.Args, []string{"a b", "/dst/"}) {
+		t.Errorf("COPY = %+v", ins)
+	}
+	if ins := instructions[5]; ins.Command != "ENTRYPOINT" || ins.JSON {
+		t.Errorf("ENTRYPOINT = %+v", ins)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, file := range []string{
+		"RUN echo no from",
+		"FROM a\nVOLUME /data",
+		"FROM a\nRUN echo \\",
+		"FROM a\nENV A=\"unterminated",
+	} {
+		if _, err := Parse(strings.NewReader(file)); err == nil {
+			t.Errorf("Parse(%q) should fail", file)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	env := []string{"HOME=/root", "APP=web"}
+	if got := Expand("$HOME/${APP}/$MISSING", env); got != "/root/web/" {
+		t.Errorf("Expand = %q", got)
+	}
+}
+
+func TestParseChange(t *testing.T) {
+	ins, err := ParseChange(`cmd ["nginx", "-g", "daemon off;"]`)
+	if err != nil || ins.Command != "CMD" || !ins.JSON || len(ins.Args) != 3 {
+		t.Errorf("ParseChange = %+v, %v", ins, err)
+	}
+	for _, change := range []string{"", "RUN echo hi", "FROM busybox", "ENV"} {
+		if _, err := ParseChange(change); err == nil {
+			t.Errorf("ParseChange(%q) should fail", change)
+		}
+	}
+}
@@ -1,19 +1,116 @@
 package main
 
 import (
+	"cocin_dokcer/Cgroups"
+	"cocin_dokcer/build"
 	"cocin_dokcer/container"
+	"cocin_dokcer/events"
+	"cocin_dokcer/image"
+	"cocin_dokcer/storage"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"os/exec"
+	"io"
 )
 
-// 制作{imageName}.tar的镜像
-func commitContainer(containerName, imageName string) {
-	mntURL := fmt.Sprintf(container.MntUrl, containerName)
-	mntURL += "/"
-	imageTar := container.RootUrl + "/" + imageName + ".tar"
-	// -c 是压缩， -x 是解压 -v 是输出详细过程
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
-		log.Errorf("Tar folder %s error %v", mntURL, err)
+// commitOptions commit命令的选项
+type commitOptions struct {
+	Author  string   // 新镜像的作者
+	Message string   // 记在新一层历史里的说明
+	Changes []string // 和Containerfile写法一样的配置修改，比如 CMD ["sh"]、ENV A=1
+	Pause   bool     // 打包可写层的时候暂停容器
+}
+
+/*
+	commitContainer 把容器的修改做成一层新的layer，叠在容器原来的镜像上生成新镜像，返回新镜像的ID
+	只打包可写层里的内容，删除的文件以 .wh. 文件的形式记在layer里，不用再打包整个rootfs
+	新镜像的配置继承父镜像，再按--change修改
+	运行中的容器默认通过freezer cgroup冻结，打包完再恢复，避免打包出写了一半的文件
+*/
+func (eng *engine) commitContainer(containerName, imageName string, options commitOptions) (string, error) {
+	if _, err := image.NormalizeName(imageName); err != nil {
+		return "", err
+	}
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
+	if err != nil {
+		return "", err
+	}
+	if err := containerInfo.CheckCommit(); err != nil {
+		return "", err
+	}
+	driver, err := eng.containerStorageDriver(containerInfo)
+	if err != nil {
+		return "", fmt.Errorf("get storage driver of container %s error %v", containerName, err)
+	}
+	images := eng.newImageStore()
+	parentID := containerInfo.ImageID
+	if parentID == "" {
+		// 早期的容器没有记录镜像ID，按镜像名找，必要时导入以前的扁平镜像
+		if parentID, _, err = eng.resolveImage(images, containerInfo.ImageName); err != nil {
+			return "", fmt.Errorf("get image of container %s error %v", containerName, err)
+		}
+	}
+	parent, err := images.GetImage(parentID)
+	if err != nil {
+		return "", fmt.Errorf("get image %s error %v", parentID, err)
+	}
+	img, err := build.CommitImage(parent, options.Changes)
+	if err != nil {
+		return "", err
+	}
+
+	if options.Pause && container.IsProcessAlive(containerInfo.Pid, containerInfo.StartTime) {
+		thaw, err := eng.pauseContainer(containerInfo)
+		if err != nil {
+			return "", err
+		}
+		defer thaw()
 	}
+	diffID, err := diffLayer(images, driver, containerName, eng.containerLowerDirs(containerInfo))
+	if err != nil {
+		return "", fmt.Errorf("create layer of container %s error %v", containerName, err)
+	}
+	build.AddCommitLayer(img, diffID, containerName, options.Author, options.Message)
+	id, err := images.CreateImage(img)
+	if err != nil {
+		return "", fmt.Errorf("create image error %v", err)
+	}
+	if err := images.SetName(imageName, id); err != nil {
+		return "", fmt.Errorf("name image %s error %v", imageName, err)
+	}
+	attributes := containerAttributes(containerInfo)
+	attributes["imageId"] = id
+	eng.newJournal().Log(events.TypeContainer, "commit", containerInfo.Id, attributes)
+	return id, nil
+}
+
+// pauseContainer 冻结容器的所有进程，返回恢复它的函数
+func (eng *engine) pauseContainer(info *container.ContainerInfo) (func(), error) {
+	if info.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup to pause, commit with --pause=false", info.Name)
+	}
+	manager := Cgroups.NewCgroupManager(info.CgroupPath)
+	if err := manager.Freeze(); err != nil {
+		manager.Thaw()
+		return nil, fmt.Errorf("pause container %s error %v, commit with --pause=false to skip it", info.Name, err)
+	}
+	journal := eng.newJournal()
+	journal.Log(events.TypeContainer, "pause", info.Id, containerAttributes(info))
+	return func() {
+		if err := manager.Thaw(); err != nil {
+			log.Errorf("Unpause container %s error %v", info.Name, err)
+			return
+		}
+		journal.Log(events.TypeContainer, "unpause", info.Id, containerAttributes(info))
+	}, nil
+}
+
+// diffLayer 把容器可写层的变化一边打包一边存成layer，返回layer的摘要
+func diffLayer(images *image.Store, driver storage.Driver, containerName string, lowerDirs []string) (string, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(driver.Diff(containerName, lowerDirs, writer))
+	}()
+	diffID, err := images.PutLayer(reader)
+	reader.Close()
+	return diffID, err
 }
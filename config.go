@@ -0,0 +1,42 @@
+package main
+
+import (
+	"cocin_dokcer/config"
+	"cocin_dokcer/container"
+	"github.com/urfave/cli"
+)
+
+// engineKey engine在cli.App.Metadata里的键
+const engineKey = "engine"
+
+/*
+	engine 一次命令执行用到的全局配置，由app.Before加载配置以后创建，放在cli.App.Metadata里
+	各个命令从cli.Context取出engine，再通过它拿到状态存储、镜像存储和存储驱动，不再使用包级变量
+*/
+type engine struct {
+	config config.Config
+}
+
+// loadEngine 读取配置文件和环境变量，再用命令行上显式给出的全局参数覆盖
+func loadEngine(context *cli.Context) (*engine, error) {
+	flags := config.Config{
+		Root:          context.GlobalString("root"),
+		ExecRoot:      context.GlobalString("exec-root"),
+		StorageDriver: context.GlobalString("storage-driver"),
+	}
+	cfg, err := config.Load(context.GlobalString("config"), context.GlobalIsSet("config"), flags)
+	if err != nil {
+		return nil, err
+	}
+	return &engine{config: cfg}, nil
+}
+
+// engineFrom 取出app.Before创建的engine
+func engineFrom(context *cli.Context) *engine {
+	return context.App.Metadata[engineKey].(*engine)
+}
+
+// containerPaths 当前配置下容器相关文件的目录
+func (eng *engine) containerPaths() container.Paths {
+	return eng.config.Paths()
+}
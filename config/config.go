@@ -0,0 +1,90 @@
+package config
+
+import (
+	"cocin_dokcer/container"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultFile 没有用--config指定时读取的配置文件，不存在就全部用默认值
+const DefaultFile = "/etc/cocin_docker/config.json"
+
+// 环境变量，优先级在配置文件和命令行参数之间
+const (
+	EnvRoot          = "COCIN_ROOT"
+	EnvExecRoot      = "COCIN_EXEC_ROOT"
+	EnvStorageDriver = "COCIN_STORAGE_DRIVER"
+)
+
+/*
+	Config 全局配置，优先级从高到低：命令行的全局参数、环境变量、配置文件、默认值
+	配置文件是json格式，例如：
+	{
+	    "root": "/data/cocin_docker",
+	    "exec-root": "/run/cocin_docker",
+	    "storage-driver": "overlay"
+	}
+*/
+type Config struct {
+	Root          string `json:"root,omitempty"`           // 镜像、可写层和挂载点的根目录
+	ExecRoot      string `json:"exec-root,omitempty"`      // 容器状态、网络和事件的根目录
+	StorageDriver string `json:"storage-driver,omitempty"` // 新建容器使用的存储驱动，为空时自动选择
+}
+
+/*
+	Load 读取配置文件path，再依次用环境变量和flags里不为空的字段覆盖
+	required为false时配置文件可以不存在(没有显式指定--config的情况)
+	子进程的工作目录会变，返回的路径一律是绝对路径
+*/
+func Load(path string, required bool, flags Config) (Config, error) {
+	config := Config{Root: container.DefaultRoot, ExecRoot: container.DefaultExecRoot}
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(content, &config); err != nil {
+			return Config{}, fmt.Errorf("parse config file %s error %v", path, err)
+		}
+	case os.IsNotExist(err) && !required:
+		// 默认的配置文件可以不存在
+	default:
+		return Config{}, fmt.Errorf("read config file %s error %v", path, err)
+	}
+	config.override(Config{
+		Root:          os.Getenv(EnvRoot),
+		ExecRoot:      os.Getenv(EnvExecRoot),
+		StorageDriver: os.Getenv(EnvStorageDriver),
+	})
+	config.override(flags)
+	for _, dir := range []*string{&config.Root, &config.ExecRoot} {
+		if *dir == "" {
+			return Config{}, fmt.Errorf("root and exec-root must not be empty")
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return Config{}, err
+		}
+		*dir = abs
+	}
+	return config, nil
+}
+
+// override 用o里不为空的字段覆盖c
+func (c *Config) override(o Config) {
+	if o.Root != "" {
+		c.Root = o.Root
+	}
+	if o.ExecRoot != "" {
+		c.ExecRoot = o.ExecRoot
+	}
+	if o.StorageDriver != "" {
+		c.StorageDriver = o.StorageDriver
+	}
+}
+
+// Paths 这份配置下容器相关文件的目录
+func (c Config) Paths() container.Paths {
+	return container.Paths{Root: c.Root, ExecRoot: c.ExecRoot}
+}
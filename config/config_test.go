@@ -0,0 +1,90 @@
+package config
+
+import (
+	"cocin_dokcer/container"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := Load(filepath.Join(t.TempDir(), "missing.json"), false, Config{})
+	if err != nil {
+		t.Fatalf("load without config file error %v", err)
+	}
+	want := Config{Root: container.DefaultRoot, ExecRoot: container.DefaultExecRoot}
+	if config != want {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadMissingRequiredFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json"), true, Config{}); err == nil {
+		t.Errorf("explicit config file that does not exist should fail")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"root": "/file/root", "exec-root": "/file/exec", "storage-driver": "aufs"}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := Load(path, true, Config{})
+	if err != nil {
+		t.Fatalf("load config file error %v", err)
+	}
+	if want := (Config{Root: "/file/root", ExecRoot: "/file/exec", StorageDriver: "aufs"}); config != want {
+		t.Errorf("file only: got %+v, want %+v", config, want)
+	}
+
+	t.Setenv(EnvRoot, "/env/root")
+	t.Setenv(EnvStorageDriver, "vfs")
+	config, err = Load(path, true, Config{})
+	if err != nil {
+		t.Fatalf("load with env error %v", err)
+	}
+	if want := (Config{Root: "/env/root", ExecRoot: "/file/exec", StorageDriver: "vfs"}); config != want {
+		t.Errorf("env over file: got %+v, want %+v", config, want)
+	}
+
+	config, err = Load(path, true, Config{Root: "/flag/root", ExecRoot: "/flag/exec"})
+	if err != nil {
+		t.Fatalf("load with flags error %v", err)
+	}
+	if want := (Config{Root: "/flag/root", ExecRoot: "/flag/exec", StorageDriver: "vfs"}); config != want {
+		t.Errorf("flags over env and file: got %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"root": "data"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(path, true, Config{ExecRoot: "state"})
+	if err != nil {
+		t.Fatalf("load relative paths error %v", err)
+	}
+	if !filepath.IsAbs(config.Root) || !filepath.IsAbs(config.ExecRoot) {
+		t.Errorf("paths should be absolute, got %+v", config)
+	}
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"root": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, true, Config{}); err == nil {
+		t.Errorf("invalid json should fail")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"root": ""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, true, Config{}); err == nil {
+		t.Errorf("empty root in config file should fail")
+	}
+}
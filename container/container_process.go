@@ -1,51 +1,126 @@
 package container
 
 import (
+	"bufio"
+	"cocin_dokcer/storage"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var (
-	RUNNING             string = "running"
-	STOP                string = "stopped"
-	Exit                string = "exited"
-	DefaultInfoLocation string = "/var/run/cocin_docker/%s/"
-	ConfigName          string = "config.json"
-	ContainerLogFile    string = "container.log"
-
-	RootUrl       string = "/root"
-	MntUrl        string = "/root/mnt/%s"
-	WriteLayerUrl string = "/root/writeLayer/%s"
+	CREATED          string = "created"
+	RUNNING          string = "running"
+	STOP             string = "stopped"
+	Exit             string = "exited"
+	ConfigName       string = "config.json"
+	ContainerLogFile string = "container.log"
 )
 
 type ContainerInfo struct {
-	Pid         string   `json:"pid"`         //容器的init进程在宿主机上的 PID
-	Id          string   `json:"id"`          //容器Id
-	Name        string   `json:"name"`        //容器名
-	Command     string   `json:"command"`     //容器内init运行命令
-	CreatedTime string   `json:"createTime"`  //创建时间
-	Status      string   `json:"status"`      //容器的状态
-	Volume      string   `json:"volume"`      //容器的数据卷
-	PortMapping []string `json:"portmapping"` //端口映射
+	Pid           string   `json:"pid"`                     //容器的init进程在宿主机上的 PID
+	Id            string   `json:"id"`                      //容器Id
+	Name          string   `json:"name"`                    //容器名
+	Command       string   `json:"command"`                 //容器内init运行命令
+	CreatedTime   string   `json:"createTime"`              //创建时间
+	Status        string   `json:"status"`                  //容器的状态
+	Volume        string   `json:"volume"`                  //容器的数据卷
+	PortMapping   []string `json:"portmapping"`             //端口映射
+	StartTime     uint64   `json:"startTime"`               //init进程的启动时间(/proc/pid/stat第22列)，用来识别PID是否被复用
+	ImageName     string   `json:"image"`                   //容器使用的镜像
+	CgroupPath    string   `json:"cgroupPath"`              //容器的cgroup相对路径
+	Network       string   `json:"network"`                 //容器连接的网络
+	IPAddress     string   `json:"ip"`                      //容器在网络中分到的IP
+	Hooks         *Hooks   `json:"hooks,omitempty"`         //OCI生命周期hook
+	Bundle        string   `json:"bundle,omitempty"`        //通过OCI bundle创建的容器的bundle目录，rootfs归bundle所有
+	StorageDriver string   `json:"storageDriver,omitempty"` //容器可写层使用的存储驱动，为空是早期的aufs容器
+	ImageID       string   `json:"imageId,omitempty"`       //容器使用的镜像ID，镜像名之后可能指向别的镜像
+	LowerDirs     []string `json:"lowerDirs,omitempty"`     //联合挂载的只读层，从最上层开始排列
+	StorageSize   int64    `json:"storageSize,omitempty"`   //可写层的大小限制，0表示不限制
+	Rootfs        string   `json:"rootfs,omitempty"`        //用--rootfs启动的容器作为只读层的宿主机目录，没有镜像
+}
+
+// HasWriteLayer 容器是否有存储驱动管理的可写层，bundle启动的容器直接使用bundle里的rootfs
+func (c *ContainerInfo) HasWriteLayer() bool {
+	return c.Bundle == "" && (c.ImageName != "" || c.Rootfs != "")
+}
+
+// CheckCommit 检查容器能不能commit，只读层是宿主机目录的容器没有父镜像可以叠上去，要保存整个rootfs用export再import
+func (c *ContainerInfo) CheckCommit() error {
+	if !c.HasWriteLayer() {
+		return fmt.Errorf("container %s has no write layer to commit", c.Name)
+	}
+	if c.Rootfs != "" {
+		return fmt.Errorf("container %s runs on host directory %s and has no image to commit onto, use export instead", c.Name, c.Rootfs)
+	}
+	return nil
+}
+
+/*
+	RuntimeStatus 根据记录的状态和进程是否存活得出OCI定义的状态，OCI的start、kill、delete按它检查状态转换
+	created  create之后init进程阻塞在start fifo上，只有这个状态可以start
+	running  start之后用户进程在运行，可以kill
+	stopped  进程已经退出，不管记录的是什么状态，只有这个状态可以delete
+*/
+func (c *ContainerInfo) RuntimeStatus() string {
+	if !IsProcessAlive(c.Pid, c.StartTime) {
+		return StateStopped
+	}
+	switch c.Status {
+	case CREATED:
+		return StateCreated
+	case RUNNING:
+		return StateRunning
+	}
+	return StateStopped
+}
+
+// OCIState 生成传给hook的OCI状态，不是从bundle创建的容器用状态目录作为bundle
+func (c *ContainerInfo) OCIState(paths Paths, status string) *State {
+	pid, _ := strconv.Atoi(c.Pid)
+	bundle := c.Bundle
+	if bundle == "" {
+		bundle = paths.StateDir(c.Name)
+	}
+	return &State{
+		OCIVersion: OCIVersion,
+		ID:         c.Id,
+		Status:     status,
+		Pid:        pid,
+		Bundle:     bundle,
+		Annotations: map[string]string{
+			"name":  c.Name,
+			"image": c.ImageName,
+		},
+	}
 }
 
 /*
-	NewWorkSpace 函数是用来创建容器文件系统的，包括下面三个函数
-	CreateReadOnlyLayer 函数是用来新建busybox文件夹，将busybox.tar解压到busybox目录下，作为容器的只读层
-	CreateWriteLayer 函数创建了一个名为writeLayer的文件夹，作为容器唯一的可写层
-	CreateMountPoint 函数中，首先创建了mnt文件夹，作为挂载点，然后把writeLayer目录和busybox目录mount到mnt目录下
+	NewWorkSpace 函数是用来创建容器文件系统的
+	driver.CreateWriteLayer 为容器创建可写层，目录结构由存储驱动决定
+	CreateMountPoint 函数中，首先创建了mnt文件夹，作为挂载点，然后由存储驱动把可写层和镜像的各个layer联合挂载到mnt目录下
 
-	最后，在NewParentProcess 函数中将容器使用的宿主机目录改成/root/mnt
+	最后，在NewParentProcess 函数中将容器使用的宿主机目录改成{Root}/mnt
 
 	更新，为每个容器创建文件系统
+	更新，aufs不在主线内核里，联合挂载交给存储驱动，默认用overlay
+	更新，镜像由多个layer组成，只读层由调用方从镜像存储里准备好，lowerDirs从最上层开始排列
+	更新，storageSize大于0时限制可写层的大小，写满以后容器里得到ENOSPC
 */
 
-func NewWorkSpace(volume, imageName, containerName string) {
-	CreateReadOnlyLayer(imageName)
-	CreateWriteLayer(containerName)
-	CreateMountPoint(containerName, imageName)
+func NewWorkSpace(paths Paths, driver storage.Driver, volume string, lowerDirs []string, containerName string, storageSize int64) error {
+	// 可写层已经存在说明有别的容器在用这个名字，不能复用它的可写层
+	if err := driver.CreateWriteLayer(containerName, storageSize); err != nil {
+		return err
+	}
+	if err := CreateMountPoint(paths, driver, containerName, lowerDirs); err != nil {
+		driver.RemoveWriteLayer(containerName)
+		return err
+	}
 	// 判断volume是否为空，如果是，就表示用户没有挂载卷，结束。否则解析
 	if volume != "" {
 		// 解析出volume的位置和需要挂载的地方 注意目前只能挂载一个
@@ -53,58 +128,24 @@ func NewWorkSpace(volume, imageName, containerName string) {
 		length := len(volumeURLs)
 		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
 			// 把volume挂载到相应的位置上
-			MountVolume(volumeURLs, containerName)
-			log.Info("%q", volumeURLs)
+			MountVolume(paths, volumeURLs, containerName)
+			log.Infof("%q", volumeURLs)
 		} else {
 			log.Infof("Volume parameter input is not correct.")
 		}
 	}
-}
-
-// CreateReadOnlyLayer 将busybox.tar解压到busybox目录下，作为容器的只读层
-func CreateReadOnlyLayer(imageName string) error {
-	unTarFolderUrl := RootUrl + "/" + imageName + "/"
-	imageUrl := RootUrl + "/" + imageName + ".tar"
-	exist, err := PathExists(unTarFolderUrl)
-	if err != nil {
-		log.Infof("Fail to judge whether dir %s exists. %v", unTarFolderUrl, err)
-		return err
-	}
-	if exist == false {
-		if err := os.Mkdir(unTarFolderUrl, 0622); err != nil {
-			log.Errorf("Mkdir dir %s error. %v", unTarFolderUrl, err)
-			return err
-		}
-		if _, err := exec.Command("tar", "-xvf", imageUrl, "-C", unTarFolderUrl).CombinedOutput(); err != nil {
-			log.Errorf("unTar dir %s error %v", unTarFolderUrl, err)
-			return err
-		}
-	}
 	return nil
 }
 
-// CreateWriteLayer 创建名为writeLayer的文件夹作为容器唯一的可写层
-func CreateWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
-	if err := os.Mkdir(writeURL, 0777); err != nil {
-		log.Errorf("Mkdir dir %s error. %v", writeURL, err)
-	}
-}
-
-// CreateMountPoint 创建了mnt文件夹，作为挂载点，然后把writeLayer目录和busybox目录mount到mnt目录下
-func CreateMountPoint(containerName, imageName string) error {
+// CreateMountPoint 创建了mnt文件夹，作为挂载点，然后由存储驱动把可写层和只读层挂载到mnt目录下
+func CreateMountPoint(paths Paths, driver storage.Driver, containerName string, lowerDirs []string) error {
 	// 创建mnt文件夹作为挂载点
-	mntUrl := fmt.Sprintf(MntUrl, containerName)
+	mntUrl := paths.MntDir(containerName)
 	if err := os.MkdirAll(mntUrl, 0777); err != nil {
 		log.Errorf("Mkdir dir %s error. %v", mntUrl, err)
 		return err
 	}
-	// 把writeLayer目录和busybox目录mount到mnt目录下
-	tmpWriteLayer := fmt.Sprintf(WriteLayerUrl, containerName)
-	tmpImageLocation := RootUrl + "/" + imageName
-	dirs := "dirs=" + tmpWriteLayer + ":" + tmpImageLocation
-	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntUrl).CombinedOutput()
-	if err != nil {
+	if err := driver.Mount(containerName, lowerDirs, mntUrl); err != nil {
 		log.Errorf("Run command for createing mount point failed %v", err)
 		return err
 	}
@@ -123,35 +164,56 @@ func PathExists(path string) (bool, error) {
 	return false, err
 }
 
+// IsMounted 通过/proc/self/mountinfo判断path是否是一个挂载点
+func IsMounted(path string) (bool, error) {
+	path = filepath.Clean(path)
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
 /*
 	Docker会在删除容器的时候，把容器对应的Write Layer 和 Container-init Layer删除，而保留镜像所有内容。
 	在这，我们先在容器退出的时候删除Write Layer。
 	DeleteWorkSpace函数
 	首先，在DeleteMountPoint函数中umount mnt目录
 	然后 删除mnt目录
-	最后，在DeleteWriteLayer函数中删除writeLayer文件夹。
+	最后，由存储驱动删除可写层。
 
 	更新：
 	1. 只有在volume不为空，并且使用volumeURLExtract函数解析volume字符串返回的字符数组长度为2，
 	   数据均不为空的时候。执行DeleteMountPointWithVolume函数来处理。
 	2. 其余情况下仍然使用前面的DeleteMountPoint函数。
 */
-func DeleteWorkSpace(volume, containerName string) {
+func DeleteWorkSpace(paths Paths, driver storage.Driver, volume, containerName string) {
 	if volume != "" {
 		volumeURLs := volumeUrlExtract(volume)
 		if len(volumeURLs) == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			DeleteMountPointWithVolume(volumeURLs, containerName)
+			DeleteMountPointWithVolume(paths, volumeURLs, containerName)
 		} else {
-			DeleteMountPoint(containerName)
+			DeleteMountPoint(paths, containerName)
 		}
 	} else {
-		DeleteMountPoint(containerName)
+		DeleteMountPoint(paths, containerName)
+	}
+	if err := driver.RemoveWriteLayer(containerName); err != nil {
+		log.Errorf("Remove write layer of container %s error %v", containerName, err)
 	}
-	DeleteWriteLayer(containerName)
 }
 
-func DeleteMountPoint(containerName string) error {
-	mntURL := fmt.Sprintf(MntUrl, containerName)
+func DeleteMountPoint(paths Paths, containerName string) error {
+	mntURL := paths.MntDir(containerName)
 	_, err := exec.Command("umount", "-A", mntURL).CombinedOutput()
 	if err != nil {
 		log.Errorf("Unmount %s error %v", mntURL, err)
@@ -163,10 +225,3 @@ func DeleteMountPoint(containerName string) error {
 	}
 	return nil
 }
-
-func DeleteWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
-	if err := os.RemoveAll(writeURL); err != nil {
-		log.Errorf("Remove writeLayer dir %s error %v", writeURL, err)
-	}
-}
@@ -0,0 +1,77 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func TestRuntimeStatus(t *testing.T) {
+	alive := strconv.Itoa(os.Getpid())
+	startTime, _ := ProcessStartTime(os.Getpid())
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run process error %v", err)
+	}
+	dead := strconv.Itoa(cmd.Process.Pid)
+
+	tests := []struct {
+		status    string
+		pid       string
+		startTime uint64
+		want      string
+	}{
+		{CREATED, alive, startTime, StateCreated},
+		{RUNNING, alive, startTime, StateRunning},
+		// 进程退出了，或者PID被别的进程复用了
+		{CREATED, dead, startTime, StateStopped},
+		{RUNNING, dead, startTime, StateStopped},
+		{RUNNING, alive, startTime + 1, StateStopped},
+		{RUNNING, "", 0, StateStopped},
+		{STOP, alive, startTime, StateStopped},
+		{Exit, "", 0, StateStopped},
+	}
+	for _, test := range tests {
+		info := &ContainerInfo{Status: test.status, Pid: test.pid, StartTime: test.startTime}
+		if got := info.RuntimeStatus(); got != test.want {
+			t.Errorf("status %s pid %q start %d = %s, want %s", test.status, test.pid, test.startTime, got, test.want)
+		}
+	}
+}
+
+func TestHasWriteLayer(t *testing.T) {
+	tests := []struct {
+		info ContainerInfo
+		want bool
+	}{
+		{ContainerInfo{ImageName: "busybox"}, true},
+		{ContainerInfo{Rootfs: "/srv/rootfs"}, true},
+		{ContainerInfo{Bundle: "/bundle"}, false},
+		{ContainerInfo{Bundle: "/bundle", Rootfs: "/srv/rootfs"}, false},
+		{ContainerInfo{}, false},
+	}
+	for _, test := range tests {
+		if got := test.info.HasWriteLayer(); got != test.want {
+			t.Errorf("%+v HasWriteLayer = %v, want %v", test.info, got, test.want)
+		}
+	}
+}
+
+func TestCheckCommit(t *testing.T) {
+	tests := []struct {
+		info ContainerInfo
+		ok   bool
+	}{
+		{ContainerInfo{Name: "web", ImageName: "busybox"}, true},
+		// --rootfs的容器有可写层，但没有父镜像，只能export
+		{ContainerInfo{Name: "web", Rootfs: "/srv/rootfs"}, false},
+		{ContainerInfo{Name: "web", Bundle: "/bundle"}, false},
+		{ContainerInfo{Name: "web"}, false},
+	}
+	for _, test := range tests {
+		if err := test.info.CheckCommit(); (err == nil) != test.ok {
+			t.Errorf("%+v CheckCommit = %v, want ok %v", test.info, err, test.ok)
+		}
+	}
+}
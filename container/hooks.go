@@ -0,0 +1,127 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// OCIVersion 实现的OCI runtime-spec版本
+const OCIVersion = "1.0.2"
+
+// OCI 定义的容器状态
+const (
+	StateCreating = "creating"
+	StateCreated  = "created"
+	StateRunning  = "running"
+	StateStopped  = "stopped"
+)
+
+// Hook OCI runtime-spec 中的hook定义，Args[0]相当于argv[0]，Timeout单位是秒
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+// Hooks 按OCI定义的生命周期点分组的hook
+// prestart和createRuntime在容器的namespace创建好、用户命令还没执行时调用
+// poststart在用户命令启动后调用，poststop在容器被删除后调用
+type Hooks struct {
+	Prestart      []Hook `json:"prestart,omitempty"`
+	CreateRuntime []Hook `json:"createRuntime,omitempty"`
+	Poststart     []Hook `json:"poststart,omitempty"`
+	Poststop      []Hook `json:"poststop,omitempty"`
+}
+
+// State OCI 定义的容器状态，hook通过标准输入拿到它
+type State struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadHooks 从json文件中读取hook配置，文件内容就是Hooks结构
+func LoadHooks(path string) (*Hooks, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read hooks file %s error %v", path, err)
+	}
+	var hooks Hooks
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return nil, fmt.Errorf("parse hooks file %s error %v", path, err)
+	}
+	for _, group := range [][]Hook{hooks.Prestart, hooks.CreateRuntime, hooks.Poststart, hooks.Poststop} {
+		for _, h := range group {
+			if h.Path == "" {
+				return nil, fmt.Errorf("hook in %s has no path", path)
+			}
+			if h.Timeout != nil && *h.Timeout <= 0 {
+				return nil, fmt.Errorf("hook %s timeout must be positive", h.Path)
+			}
+		}
+	}
+	return &hooks, nil
+}
+
+// Run 执行hook，容器状态的json写到hook的标准输入
+func (h *Hook) Run(state *State) error {
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	args := h.Args
+	if len(args) == 0 {
+		args = []string{h.Path}
+	}
+	var stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   h.Path,
+		Args:   args,
+		Env:    h.Env,
+		Stdin:  bytes.NewReader(stateJson),
+		Stderr: &stderr,
+		// 单独一个进程组，超时的时候连同hook派生出来的子进程一起杀掉
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start hook %s error %v", h.Path, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var timeout <-chan time.Time
+	if h.Timeout != nil {
+		timeout = time.After(time.Duration(*h.Timeout) * time.Second)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("hook %s error %v: %s", h.Path, err, stderr.String())
+		}
+		return nil
+	case <-timeout:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("hook %s timed out after %ds", h.Path, *h.Timeout)
+	}
+}
+
+// RunHooks 按顺序执行一组hook，遇到第一个失败就返回
+func RunHooks(hooks []Hook, state *State) error {
+	for i := range hooks {
+		if err := hooks[i].Run(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package container
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHookReceivesState(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "state.json")
+	hook := Hook{Path: "/bin/sh", Args: []string{"sh", "-c", "cat > " + out}}
+	if err := hook.Run(&State{OCIVersion: OCIVersion, ID: "abc", Status: StateCreated}); err != nil {
+		t.Fatalf("run hook error %v", err)
+	}
+	content, _ := ioutil.ReadFile(out)
+	if !strings.Contains(string(content), `"id":"abc"`) || !strings.Contains(string(content), `"status":"created"`) {
+		t.Errorf("hook should receive state on stdin, got %s", content)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	timeout := 1
+	hooks := []Hook{{Path: "/bin/sh", Args: []string{"sh", "-c", "sleep 5"}, Timeout: &timeout}}
+	if err := RunHooks(hooks, &State{}); err == nil {
+		t.Fatalf("hook exceeding its timeout should fail")
+	}
+}
@@ -0,0 +1,71 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+const (
+	containerIDBytes = 32 // 32字节随机数，编码成64位十六进制
+	shortIDLength    = 12 // 展示用的短ID长度
+)
+
+// 容器名只允许字母数字开头，后面可以跟 _ . -，避免拼出 ../ 之类的路径
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// GenerateContainerID 使用crypto/rand生成64位十六进制的容器ID
+// 之前基于时间做种子的math/rand只有10位数字，并发启动时很容易撞车
+func GenerateContainerID() (string, error) {
+	b := make([]byte, containerIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate container id error %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ShortID 返回用于展示的短ID
+func ShortID(id string) string {
+	if len(id) > shortIDLength {
+		return id[:shortIDLength]
+	}
+	return id
+}
+
+// ValidateName 检查容器名是否合法，容器名会被拼进状态目录和可写层的路径中
+func ValidateName(containerName string) error {
+	if !validContainerName.MatchString(containerName) || containerName == "network" {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", containerName)
+	}
+	return nil
+}
+
+/*
+	ReserveName 占用容器名
+	容器的状态目录就是以容器名命名的，这里用os.Mkdir创建它：目录已存在时Mkdir会失败，
+	这个检查和创建是内核保证的原子操作，两个同时启动的同名容器只有一个能成功
+*/
+func ReserveName(paths Paths, containerName string) error {
+	if err := ValidateName(containerName); err != nil {
+		return err
+	}
+	dirURL := paths.StateDir(containerName)
+	// 先保证父目录 {ExecRoot} 存在
+	if err := os.MkdirAll(paths.ExecRoot, 0622); err != nil {
+		return fmt.Errorf("mkdir %s error %v", paths.ExecRoot, err)
+	}
+	if err := os.Mkdir(dirURL, 0622); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("container name %s is already in use", containerName)
+		}
+		return fmt.Errorf("mkdir %s error %v", dirURL, err)
+	}
+	return nil
+}
+
+// ReleaseName 启动失败时释放之前占用的容器名
+func ReleaseName(paths Paths, containerName string) {
+	os.RemoveAll(paths.StateDir(containerName))
+}
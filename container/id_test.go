@@ -0,0 +1,84 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestGenerateContainerID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := GenerateContainerID()
+		if err != nil {
+			t.Fatalf("generate container id error %v", err)
+		}
+		if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(id) {
+			t.Fatalf("container id %q should be 64 hex digits", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate container id %s", id)
+		}
+		seen[id] = true
+	}
+	if ShortID("0123456789abcdef") != "0123456789ab" || ShortID("abc") != "abc" {
+		t.Errorf("unexpected short id")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"web", "web-1", "a.b_c", "0abc"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("name %q should be valid, %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "..", "../web", "a/b", "-web", ".web", "web name", "network"} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("name %q should be invalid", name)
+		}
+	}
+}
+
+func TestReserveName(t *testing.T) {
+	paths := Paths{Root: t.TempDir(), ExecRoot: filepath.Join(t.TempDir(), "run")}
+	if err := ReserveName(paths, "../escape"); err == nil {
+		t.Fatalf("invalid name should not be reserved")
+	}
+	if err := ReserveName(paths, "web"); err != nil {
+		t.Fatalf("reserve name error %v", err)
+	}
+	if err := ReserveName(paths, "web"); err == nil {
+		t.Errorf("reserving a name in use should fail")
+	}
+	ReleaseName(paths, "web")
+	if _, err := os.Stat(paths.StateDir("web")); !os.IsNotExist(err) {
+		t.Errorf("state dir should be removed, %v", err)
+	}
+	if err := ReserveName(paths, "web"); err != nil {
+		t.Errorf("released name should be reusable, %v", err)
+	}
+}
+
+func TestReserveNameConcurrently(t *testing.T) {
+	paths := Paths{Root: t.TempDir(), ExecRoot: t.TempDir()}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ReserveName(paths, "web") == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 1 {
+		t.Errorf("exactly one reservation should succeed, got %d", reserved)
+	}
+}
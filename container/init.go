@@ -1,20 +1,19 @@
 package container
 
 import (
+	"cocin_dokcer/storage"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
 /*
  这里是父进程，就是当前进程执行的内容
 */ // NewParentProcess
-func NewParentProcess(tty bool, volume, containerName, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
+func NewParentProcess(paths Paths, driver storage.Driver, tty bool, volume, containerName string, lowerDirs []string, envSlice []string, storageSize int64) (*exec.Cmd, *os.File) {
 	readPipe, writePipe, err := NewPipe()
 	if err != nil {
 		log.Errorf("New pipe error %v", err)
@@ -34,12 +33,12 @@ func NewParentProcess(tty bool, volume, containerName, imageName string, envSlic
 		cmd.Stderr = os.Stderr
 	} else {
 		// 生成容器对应目录container.log
-		dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
+		dirURL := paths.StateDir(containerName)
 		if err := os.MkdirAll(dirURL, 0622); err != nil {
 			log.Errorf("NewParentProcess mkdir %s error %v", dirURL, err)
 			return nil, nil
 		}
-		stdLogFilePath := dirURL + ContainerLogFile
+		stdLogFilePath := paths.LogFile(containerName)
 		stdLogFile, err := os.Create(stdLogFilePath)
 		if err != nil {
 			log.Errorf("NewParentProcess create file %s error %v", stdLogFilePath, err)
@@ -48,14 +47,37 @@ func NewParentProcess(tty bool, volume, containerName, imageName string, envSlic
 		// 重定向
 		cmd.Stdout = stdLogFile
 	}
-	NewWorkSpace(volume, imageName, containerName)
-	cmd.Dir = fmt.Sprintf(MntUrl, containerName)
+	if err := NewWorkSpace(paths, driver, volume, lowerDirs, containerName, storageSize); err != nil {
+		log.Errorf("New workspace error %v", err)
+		return nil, nil
+	}
+	cmd.Dir = paths.MntDir(containerName)
 	// 在这传入管道文件读取端的句柄，传给子进程
 	// cmd.ExtraFiles 外带这个文件句柄去创建子进程
 	cmd.ExtraFiles = []*os.File{readPipe}
 	return cmd, writePipe
 }
 
+// NewBundleProcess 为OCI bundle创建init进程，rootfs直接使用bundle里的目录，不创建可写层
+// create之后容器在后台运行，标准输出重定向到状态目录下的日志文件
+func NewBundleProcess(paths Paths, rootfs string, cloneflags uintptr, containerName string) (*exec.Cmd, *os.File, error) {
+	readPipe, writePipe, err := NewPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("new pipe error %v", err)
+	}
+	cmd := exec.Command("/proc/self/exe", "init")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: cloneflags}
+	stdLogFile, err := os.Create(paths.LogFile(containerName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("create log file error %v", err)
+	}
+	cmd.Stdout = stdLogFile
+	cmd.Stderr = stdLogFile
+	cmd.Dir = rootfs
+	cmd.ExtraFiles = []*os.File{readPipe}
+	return cmd, writePipe, nil
+}
+
 /*
   利用这个函数进行初始化，init会调用它。在容器内部执行的。也就是是，代码执行到这容器所在的进程其实已经创建出来了，就是parent。
   这是本容器执行的第一个进程。
@@ -65,11 +87,49 @@ func NewParentProcess(tty bool, volume, containerName, imageName string, envSlic
   MS_NODEV：默认设定
 */ //RunContainerInitProcess
 func RunContainerInitProcess() error {
-	cmdArray := readUserCommand()
+	config, err := readInitConfig()
+	if err != nil {
+		return err
+	}
+	cmdArray := config.Args
 	if cmdArray == nil || len(cmdArray) == 0 {
 		return fmt.Errorf("Run container get user command error, cmdArray is nil")
 	}
-	setUpMount()
+	// OCI bundle启动时，要在pivot_root之前拿到start fifo的句柄
+	startFd := -1
+	if config.StartFifo != "" {
+		if startFd, err = openStartFifo(config.StartFifo); err != nil {
+			return err
+		}
+	}
+	// 配置了挂载列表时按列表准备rootfs，否则沿用默认的proc和/dev挂载
+	if len(config.Mounts) > 0 {
+		if err := setUpRootfs(config); err != nil {
+			log.Errorf("Set up rootfs error %v", err)
+			return err
+		}
+	} else {
+		setUpMount()
+	}
+	// 只读rootfs和有没有挂载列表无关，两种方式准备好rootfs之后都要检查
+	if err := remountReadonlyRootfs(config); err != nil {
+		log.Errorf("Set up rootfs error %v", err)
+		return err
+	}
+	if err := setUpProcess(config); err != nil {
+		log.Errorf("Set up process error %v", err)
+		return err
+	}
+	// create之后阻塞在这里，直到start命令到来
+	if startFd >= 0 {
+		if err := waitStart(startFd); err != nil {
+			return err
+		}
+	}
+	if err := switchUser(config); err != nil {
+		log.Errorf("Switch user error %v", err)
+		return err
+	}
 	// 调用exec.LookPath 可以在系统的PATH里面寻找命令的绝对路径 上一版中得写/bin/sh 现在只需要sh即可
 	path, err := exec.LookPath(cmdArray[0])
 	if err != nil {
@@ -95,19 +155,6 @@ func NewPipe() (*os.File, *os.File, error) {
 	return read, write, nil
 }
 
-// readUserCommand 子进程读取管道
-func readUserCommand() []string {
-	// 默认的标准IO占三个，那管道从第四个开始
-	pipe := os.NewFile(uintptr(3), "pipe")
-	msg, err := ioutil.ReadAll(pipe)
-	if err != nil {
-		log.Errorf("init read pipe error %v", err)
-		return nil
-	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
-}
-
 /*
  pivot_root是一个系统调用，主要是去改变当前的root文件系统。piovt_root可以将当前进程的root文件系统移动到put_old文件夹中，
  然后使new_root成为新的root文件系统。pivot_root是把整个系统切换到一个新的root目录，而移除对之前root文件系统的依赖，这样就能umount原先的root文件系统
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"cocin_dokcer/archive"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// InitConfig 父进程通过管道发给容器init进程的配置
+// run命令只会填Args，OCI bundle启动时由spec转换出完整的配置
+type InitConfig struct {
+	Args           []string `json:"args"`
+	Env            []string `json:"env,omitempty"`      // 为空时沿用父进程设置的环境变量
+	Cwd            string   `json:"cwd,omitempty"`      // pivot_root之后切换到的工作目录
+	Hostname       string   `json:"hostname,omitempty"` // 需要UTS namespace
+	Mounts         []Mount  `json:"mounts,omitempty"`   // 不为空时代替默认的proc和/dev挂载
+	ReadonlyRootfs bool     `json:"readonlyRootfs,omitempty"`
+	Rlimits        []Rlimit `json:"rlimits,omitempty"`
+	UID            int      `json:"uid"`
+	GID            int      `json:"gid"`
+	AdditionalGids []int    `json:"additionalGids,omitempty"`
+	StartFifo      string   `json:"startFifo,omitempty"` // 不为空时init准备好环境后阻塞在这个fifo上，等start命令
+}
+
+// Mount 在容器rootfs里执行的一次挂载，Flags和Data已经由mount选项解析好
+type Mount struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Type        string  `json:"type"`
+	Flags       uintptr `json:"flags"`
+	Data        string  `json:"data,omitempty"`
+}
+
+// Rlimit 进程资源限制，Type是RLIMIT_*对应的数值
+type Rlimit struct {
+	Type int    `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// SendInitConfig 把配置写进管道，写完关闭，init进程读到EOF后开始初始化
+func SendInitConfig(config *InitConfig, writePipe *os.File) error {
+	defer writePipe.Close()
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = writePipe.Write(content)
+	return err
+}
+
+// readInitConfig 子进程读取管道
+func readInitConfig() (*InitConfig, error) {
+	// 默认的标准IO占三个，那管道从第四个开始
+	pipe := os.NewFile(uintptr(3), "pipe")
+	defer pipe.Close()
+	msg, err := ioutil.ReadAll(pipe)
+	if err != nil {
+		return nil, fmt.Errorf("init read pipe error %v", err)
+	}
+	var config InitConfig
+	if err := json.Unmarshal(msg, &config); err != nil {
+		return nil, fmt.Errorf("init parse config error %v", err)
+	}
+	return &config, nil
+}
+
+// setUpRootfs 按配置里的挂载列表准备rootfs，然后pivot_root进去
+// 挂载源是宿主机上的路径，所以必须在pivot_root之前完成
+func setUpRootfs(config *InitConfig) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// 先把整个mount namespace设为私有，后面的挂载不会传播回宿主机
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("make / private error %v", err)
+	}
+	for _, m := range config.Mounts {
+		if err := mountInRootfs(root, m); err != nil {
+			return err
+		}
+	}
+	return pivotRoot(root)
+}
+
+// remountReadonlyRootfs root.readonly为true时把根目录重新挂载成只读，要在pivot_root和其他挂载都完成之后执行
+func remountReadonlyRootfs(config *InitConfig) error {
+	if !config.ReadonlyRootfs {
+		return nil
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount rootfs readonly error %v", err)
+	}
+	return nil
+}
+
+// mountInRootfs 把m挂载到rootfs里
+func mountInRootfs(root string, m Mount) error {
+	dest, err := prepareMountPoint(root, m)
+	if err != nil {
+		return err
+	}
+	// 只读bind mount需要先bind再remount才能生效
+	flags := m.Flags
+	if err := syscall.Mount(m.Source, dest, m.Type, flags&^syscall.MS_RDONLY, m.Data); err != nil {
+		return fmt.Errorf("mount %s to %s error %v", m.Source, m.Destination, err)
+	}
+	if flags&syscall.MS_BIND != 0 && flags&syscall.MS_RDONLY != 0 {
+		if err := syscall.Mount("", dest, "", flags|syscall.MS_REMOUNT, ""); err != nil {
+			return fmt.Errorf("remount %s readonly error %v", m.Destination, err)
+		}
+	} else if flags&syscall.MS_RDONLY != 0 {
+		if err := syscall.Mount(m.Source, dest, m.Type, flags|syscall.MS_REMOUNT, m.Data); err != nil {
+			return fmt.Errorf("remount %s readonly error %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+/*
+	prepareMountPoint 在rootfs里准备好m.Destination对应的挂载点，返回它在宿主机上的路径
+	rootfs里的符号链接按rootfs解析，bundle里构造的链接不能把挂载点或者新建的文件放到rootfs外面
+	bind一个文件时挂载点也必须是文件
+*/
+func prepareMountPoint(root string, m Mount) (string, error) {
+	dest, err := archive.SecureJoin(root, m.Destination)
+	if err != nil {
+		return "", fmt.Errorf("resolve mount destination %s error %v", m.Destination, err)
+	}
+	if m.Flags&syscall.MS_BIND != 0 {
+		if fi, err := os.Stat(m.Source); err == nil && !fi.IsDir() {
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return "", err
+			}
+			if f, err := os.OpenFile(dest, os.O_CREATE, 0644); err == nil {
+				f.Close()
+			}
+			return dest, nil
+		}
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// setUpProcess 设置hostname、资源限制、环境变量和工作目录，要在pivot_root之后执行
+func setUpProcess(config *InitConfig) error {
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			return fmt.Errorf("set hostname error %v", err)
+		}
+	}
+	for _, rl := range config.Rlimits {
+		if err := syscall.Setrlimit(rl.Type, &syscall.Rlimit{Cur: rl.Soft, Max: rl.Hard}); err != nil {
+			return fmt.Errorf("set rlimit %d error %v", rl.Type, err)
+		}
+	}
+	if config.Env != nil {
+		os.Clearenv()
+		for _, env := range config.Env {
+			kv := strings.SplitN(env, "=", 2)
+			if len(kv) == 2 {
+				os.Setenv(kv[0], kv[1])
+			}
+		}
+	}
+	if config.Cwd != "" {
+		// 镜像里指定的工作目录不存在时自动创建
+		if err := os.MkdirAll(config.Cwd, 0755); err != nil {
+			return fmt.Errorf("mkdir %s error %v", config.Cwd, err)
+		}
+		if err := os.Chdir(config.Cwd); err != nil {
+			return fmt.Errorf("chdir %s error %v", config.Cwd, err)
+		}
+	}
+	return nil
+}
+
+// switchUser 最后切换用户，切换之后就没有权限做挂载之类的事情了
+func switchUser(config *InitConfig) error {
+	if config.UID != 0 || config.GID != 0 || len(config.AdditionalGids) > 0 {
+		if err := syscall.Setgroups(config.AdditionalGids); err != nil {
+			return fmt.Errorf("setgroups error %v", err)
+		}
+		if err := syscall.Setgid(config.GID); err != nil {
+			return fmt.Errorf("setgid %d error %v", config.GID, err)
+		}
+		if err := syscall.Setuid(config.UID); err != nil {
+			return fmt.Errorf("setuid %d error %v", config.UID, err)
+		}
+	}
+	return nil
+}
+
+// openStartFifo 在pivot_root之前用O_PATH打开start fifo，只拿到句柄，不会阻塞
+func openStartFifo(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open start fifo %s error %v", path, err)
+	}
+	return fd, nil
+}
+
+// waitStart 通过/proc/self/fd重新以写方式打开fifo，会一直阻塞到start命令以读方式打开它
+func waitStart(fd int) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fd), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("wait for start error %v", err)
+	}
+	defer f.Close()
+	unix.Close(fd)
+	if _, err := f.Write([]byte("0")); err != nil {
+		return fmt.Errorf("write start fifo error %v", err)
+	}
+	log.Infof("container started")
+	return nil
+}
@@ -0,0 +1,52 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPrepareMountPointStaysInRootfs(t *testing.T) {
+	root := t.TempDir()
+	host := t.TempDir()
+	// bundle里构造的指向宿主机的链接，绝对链接和相对链接都有
+	if err := os.Symlink(host, filepath.Join(root, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../../../../.."+host, filepath.Join(root, "rel")); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		m    Mount
+		want string
+		dir  bool
+	}{
+		{Mount{Destination: "/abs/etc"}, filepath.Join(root, host, "etc"), true},
+		{Mount{Destination: "rel/proc"}, filepath.Join(root, host, "proc"), true},
+		{Mount{Destination: "/../../abs/hosts", Source: source, Flags: syscall.MS_BIND}, filepath.Join(root, host, "hosts"), false},
+	}
+	for _, test := range tests {
+		dest, err := prepareMountPoint(root, test.m)
+		if err != nil {
+			t.Fatalf("prepare %s error %v", test.m.Destination, err)
+		}
+		if dest != test.want {
+			t.Errorf("prepare %s = %s, want %s", test.m.Destination, dest, test.want)
+		}
+		fi, err := os.Stat(dest)
+		if err != nil || fi.IsDir() != test.dir {
+			t.Errorf("mount point %s should exist (dir %v), got %v %v", dest, test.dir, fi, err)
+		}
+	}
+	entries, _ := ioutil.ReadDir(host)
+	if len(entries) != 0 {
+		t.Errorf("nothing should be created outside the rootfs, got %d entries in %s", len(entries), host)
+	}
+}
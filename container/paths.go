@@ -0,0 +1,93 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Paths 宿主机上存放容器相关文件的目录，由全局参数--root、--exec-root或者配置文件决定
+	{Root}/image/            镜像存储
+	{Root}/writeLayer/       容器的可写层
+	{Root}/mnt/{容器名}/      容器rootfs的挂载点
+	{Root}/{镜像名}.tar       以前的扁平镜像
+	{ExecRoot}/{容器名}/      容器状态和日志，网络、IPAM和事件也在这下面
+	不同的Root和ExecRoot互不影响，可以在一台机器上同时跑多套互相隔离的实例
+*/
+type Paths struct {
+	Root     string
+	ExecRoot string
+}
+
+// 默认的存储根目录和状态根目录
+const (
+	DefaultRoot     = "/root"
+	DefaultExecRoot = "/var/run/cocin_docker"
+)
+
+// DefaultPaths 没有配置时使用的目录
+func DefaultPaths() Paths {
+	return Paths{Root: DefaultRoot, ExecRoot: DefaultExecRoot}
+}
+
+// ImageRoot 镜像存储的根目录
+func (p Paths) ImageRoot() string {
+	return filepath.Join(p.Root, "image")
+}
+
+// WriteLayerRoot 存储驱动存放所有容器可写层的目录
+func (p Paths) WriteLayerRoot() string {
+	return filepath.Join(p.Root, "writeLayer")
+}
+
+// MntRoot 所有容器挂载点的父目录
+func (p Paths) MntRoot() string {
+	return filepath.Join(p.Root, "mnt")
+}
+
+// MntDir 容器rootfs的挂载点
+func (p Paths) MntDir(containerName string) string {
+	return filepath.Join(p.MntRoot(), containerName)
+}
+
+// StateDir 容器的状态目录
+func (p Paths) StateDir(containerName string) string {
+	return filepath.Join(p.ExecRoot, containerName)
+}
+
+// LogFile 后台运行的容器的标准输出
+func (p Paths) LogFile(containerName string) string {
+	return filepath.Join(p.StateDir(containerName), ContainerLogFile)
+}
+
+/*
+	HostRootfs 检查--rootfs指定的宿主机目录，返回解析过符号链接的绝对路径
+	目录只会作为只读层挂载，容器的修改都写在自己的可写层里
+	目录不能包含存储根目录，否则可写层和挂载点都在只读层里面，vfs复制只读层时还会复制到自己里面
+*/
+func (p Paths) HostRootfs(rootfs string) (string, error) {
+	abs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", fmt.Errorf("rootfs %s error %v", rootfs, err)
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("rootfs %s is not a directory", rootfs)
+	}
+	root := p.Root
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	if rel, err := filepath.Rel(abs, root); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("rootfs %s must not contain the storage root %s", rootfs, p.Root)
+	}
+	return abs, nil
+}
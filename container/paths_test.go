@@ -0,0 +1,63 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostRootfs(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "data", "root")
+	rootfs := filepath.Join(dir, "data", "rootfs")
+	for _, d := range []string{root, rootfs} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(rootfs, link); err != nil {
+		t.Fatal(err)
+	}
+	// 存储根目录本身是符号链接时按解析后的路径比较
+	rootLink := filepath.Join(dir, "rootlink")
+	if err := os.Symlink(root, rootLink); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		root   string
+		rootfs string
+		want   string // 为空表示应该失败
+	}{
+		{"sibling of root", root, rootfs, rootfs},
+		{"symlinked dir", root, link, rootfs},
+		{"not a directory", root, file, ""},
+		{"missing", root, filepath.Join(dir, "missing"), ""},
+		{"host root", root, "/", ""},
+		{"parent of root", root, filepath.Join(dir, "data"), ""},
+		{"root itself", root, root, ""},
+		{"parent of symlinked root", rootLink, filepath.Join(dir, "data"), ""},
+	}
+	for _, test := range tests {
+		got, err := Paths{Root: test.root}.HostRootfs(test.rootfs)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: HostRootfs(%s) = %s, want error", test.name, test.rootfs, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: HostRootfs(%s) = %s, %v, want %s", test.name, test.rootfs, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcessStartTime 读取进程的启动时间，单位是系统启动后的时钟周期数
+// 同一个PID被复用后启动时间一定不同，用它可以识别记录下来的PID是否还是原来那个进程
+func ProcessStartTime(pid int) (uint64, error) {
+	_, startTime, err := processStat(pid)
+	return startTime, err
+}
+
+func processStat(pid int) (string, uint64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, err
+	}
+	state, startTime, err := parseStat(string(content))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid stat of pid %d", pid)
+	}
+	return state, startTime, nil
+}
+
+// parseStat 从/proc/pid/stat的内容里取出进程状态(第3列)和启动时间(第22列)
+func parseStat(stat string) (string, uint64, error) {
+	// 第二列是用括号括起来的进程名，里面可能有空格，所以从最后一个 ) 之后开始切分
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return "", 0, fmt.Errorf("missing process name")
+	}
+	// ) 之后从第3列state开始，starttime是第22列
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 20 {
+		return "", 0, fmt.Errorf("too few fields")
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return fields[0], startTime, nil
+}
+
+// IsProcessAlive 判断容器记录的init进程是否还活着，已经退出、只是还没被回收的僵尸进程不算
+// startTime为0是旧版本记录的容器，只能退化为判断PID是否存在
+func IsProcessAlive(pid string, startTime uint64) bool {
+	pidInt, err := strconv.Atoi(strings.TrimSpace(pid))
+	if err != nil || pidInt <= 0 {
+		return false
+	}
+	state, current, err := processStat(pidInt)
+	if err != nil || state == "Z" || state == "X" {
+		return false
+	}
+	return startTime == 0 || current == startTime
+}
+
+// WaitProcessExit 等待进程退出，超时还活着返回false
+func WaitProcessExit(pid string, startTime uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for IsProcessAlive(pid, startTime) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
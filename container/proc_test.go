@@ -0,0 +1,84 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		stat      string
+		state     string
+		startTime uint64
+		ok        bool
+	}{
+		{"1 (init) S 0 1 1 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 7 0 0", "S", 7, true},
+		// 进程名里可以有空格和括号
+		{"42 (a) b (c)) Z 1 42 42 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 123456 0 0", "Z", 123456, true},
+		{"42 init S 0 1", "", 0, false},
+		{"42 (init) S 0 1 1", "", 0, false},
+		{"42 (init) S 0 1 1 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 x 0 0", "", 0, false},
+	}
+	for _, test := range tests {
+		state, startTime, err := parseStat(test.stat)
+		if (err == nil) != test.ok || state != test.state || startTime != test.startTime {
+			t.Errorf("parseStat(%q) = %q %d %v", test.stat, state, startTime, err)
+		}
+	}
+}
+
+func TestIsProcessAlive(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	startTime, err := ProcessStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("read start time error %v", err)
+	}
+	if !IsProcessAlive(pid, startTime) || !IsProcessAlive(pid, 0) || !IsProcessAlive(" "+pid+"\n", startTime) {
+		t.Errorf("current process should be alive")
+	}
+	// PID被复用以后启动时间对不上
+	if IsProcessAlive(pid, startTime+1) {
+		t.Errorf("process with a different start time should not be alive")
+	}
+	for _, pid := range []string{"", "abc", "0", "-1"} {
+		if IsProcessAlive(pid, 0) {
+			t.Errorf("pid %q should not be alive", pid)
+		}
+	}
+}
+
+func TestZombieIsNotAlive(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process error %v", err)
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	startTime, _ := ProcessStartTime(cmd.Process.Pid)
+	// 没有Wait之前子进程退出后是僵尸进程，/proc/pid/stat还在
+	if !WaitProcessExit(pid, startTime, 5*time.Second) {
+		t.Fatalf("exited process should not be alive before it is reaped")
+	}
+	if _, err := os.Stat("/proc/" + pid); err != nil {
+		t.Errorf("zombie should still be in /proc, %v", err)
+	}
+	cmd.Wait()
+	if IsProcessAlive(pid, startTime) {
+		t.Errorf("reaped process should not be alive")
+	}
+}
+
+func TestWaitProcessExitTimeout(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "sleep 5")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process error %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	startTime, _ := ProcessStartTime(cmd.Process.Pid)
+	if WaitProcessExit(strconv.Itoa(cmd.Process.Pid), startTime, 200*time.Millisecond) {
+		t.Errorf("running process should time out")
+	}
+}
@@ -0,0 +1,85 @@
+package container
+
+import (
+	"bufio"
+	"cocin_dokcer/archive"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	LookupUser 把镜像里USER的写法解析成uid和gid
+	user可以是 name、uid、name:group、uid:gid，名字按容器rootfs里的/etc/passwd和/etc/group查找
+	只写了用户时，gid用passwd里这个用户的主组
+*/
+func LookupUser(rootfs, user string) (int, int, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+	uid, gid := -1, -1
+	if n, err := strconv.Atoi(parts[0]); err == nil {
+		uid = n
+	}
+	// passwd每行是 name:x:uid:gid:...
+	err := scanIDFile(rootfs, "/etc/passwd", func(fields []string) bool {
+		if len(fields) < 4 || (fields[0] != parts[0] && fields[2] != parts[0]) {
+			return false
+		}
+		uid, _ = strconv.Atoi(fields[2])
+		gid, _ = strconv.Atoi(fields[3])
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid < 0 {
+		return 0, 0, fmt.Errorf("unable to find user %s in /etc/passwd", parts[0])
+	}
+	if len(parts) == 2 {
+		gid = -1
+		if n, err := strconv.Atoi(parts[1]); err == nil {
+			gid = n
+		} else if err := scanIDFile(rootfs, "/etc/group", func(fields []string) bool {
+			if len(fields) < 3 || fields[0] != parts[1] {
+				return false
+			}
+			gid, _ = strconv.Atoi(fields[2])
+			return true
+		}); err != nil {
+			return 0, 0, err
+		}
+		if gid < 0 {
+			return 0, 0, fmt.Errorf("unable to find group %s in /etc/group", parts[1])
+		}
+	}
+	if gid < 0 {
+		gid = 0
+	}
+	return uid, gid, nil
+}
+
+// scanIDFile 逐行扫描容器里的passwd或group文件，match返回true时停止，文件不存在不算错
+func scanIDFile(rootfs, name string, match func(fields []string) bool) error {
+	path, err := archive.SecureJoin(rootfs, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if match(strings.Split(scanner.Text(), ":")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,67 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	rootfs := t.TempDir()
+	os.Mkdir(filepath.Join(rootfs, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(
+		"root:x:0:0:root:/root:/bin/sh\n"+
+			"nginx:x:101:102:nginx:/var/cache/nginx:/sbin/nologin\n"+
+			"broken\n"+
+			"app:x:1000:1000::/home/app:/bin/sh\n"), 0644)
+	ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(
+		"root:x:0:\n"+
+			"staff:x:50:app\n"+
+			"nginx:x:102:\n"), 0644)
+
+	tests := []struct {
+		user     string
+		uid, gid int
+	}{
+		{"", 0, 0},
+		{"root", 0, 0},
+		{"nginx", 101, 102},
+		{"app:staff", 1000, 50},
+		{"app:7", 1000, 7},
+		{"1000", 1000, 1000},
+		// passwd里没有的数字uid也可以用，主组是0
+		{"2000", 2000, 0},
+		{"2000:2000", 2000, 2000},
+		{"nginx:root", 101, 0},
+	}
+	for _, test := range tests {
+		uid, gid, err := LookupUser(rootfs, test.user)
+		if err != nil || uid != test.uid || gid != test.gid {
+			t.Errorf("LookupUser(%q) = %d %d %v, want %d %d", test.user, uid, gid, err, test.uid, test.gid)
+		}
+	}
+	for _, user := range []string{"nobody", "app:wheel", "broken"} {
+		if _, _, err := LookupUser(rootfs, user); err == nil {
+			t.Errorf("LookupUser(%q) should fail", user)
+		}
+	}
+}
+
+func TestLookupUserWithoutPasswd(t *testing.T) {
+	rootfs := t.TempDir()
+	if uid, gid, err := LookupUser(rootfs, "1000:1000"); err != nil || uid != 1000 || gid != 1000 {
+		t.Errorf("numeric user should not need /etc/passwd, got %d %d %v", uid, gid, err)
+	}
+	if _, _, err := LookupUser(rootfs, "app"); err == nil {
+		t.Errorf("user name without /etc/passwd should fail")
+	}
+	// /etc/passwd是指向rootfs外面的符号链接时也只在rootfs里查
+	os.Mkdir(filepath.Join(rootfs, "etc"), 0755)
+	outside := filepath.Join(t.TempDir(), "passwd")
+	ioutil.WriteFile(outside, []byte("app:x:1000:1000::/:/bin/sh\n"), 0644)
+	os.Symlink(outside, filepath.Join(rootfs, "etc", "passwd"))
+	if _, _, err := LookupUser(rootfs, "app"); err == nil {
+		t.Errorf("passwd outside the rootfs should not be used")
+	}
+}
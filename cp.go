@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cocin_dokcer/archive"
+	"cocin_dokcer/container"
+	"cocin_dokcer/storage"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cpPath cp命令的一端，Container为空表示宿主机上的路径，Path为"-"表示标准输入输出的tar流
+type cpPath struct {
+	Container string
+	Path      string
+}
+
+// parseCpPath 解析 container:path 的写法，以 / 或 . 开头的一律当作宿主机路径，
+// 这样宿主机上带冒号的文件也能用 ./a:b 来表示
+func parseCpPath(arg string) cpPath {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return cpPath{Path: arg}
+	}
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) == 2 && container.ValidateName(parts[0]) == nil {
+		return cpPath{Container: parts[0], Path: parts[1]}
+	}
+	return cpPath{Path: arg}
+}
+
+/*
+	copyFiles 实现cp命令，在宿主机和容器之间复制文件
+	1. 容器里的路径通过容器的rootfs访问，运行中和已停止的容器都可以
+	2. 容器里的符号链接按容器的根解析，不会跳到宿主机的其他目录
+	3. 内容通过tar流复制，属主、权限和修改时间都会保留
+*/
+func (eng *engine) copyFiles(srcArg, destArg string) error {
+	src, dest := parseCpPath(srcArg), parseCpPath(destArg)
+	switch {
+	case src.Container != "" && dest.Container != "":
+		return fmt.Errorf("copying between containers is not supported")
+	case src.Container == "" && dest.Container == "":
+		return fmt.Errorf("one of source or destination must be a container path")
+	case src.Container != "":
+		return eng.copyFromContainer(src, dest.Path)
+	default:
+		return eng.copyToContainer(src.Path, dest)
+	}
+}
+
+/*
+	containerCopyRoots 返回读写容器文件的根目录
+	联合挂载还在的时候直接用挂载点，否则写入可写层，读取时把可写层和各个只读层按联合挂载的规则叠加起来，
+	可写层里删掉的文件看不到；vfs的可写层本身就是完整的rootfs，不用叠加只读层
+*/
+func (eng *engine) containerCopyRoots(containerInfo *container.ContainerInfo) (readRoots []string, writeRoot string, err error) {
+	rootfs, err := eng.containerRootfs(containerInfo)
+	if err == nil {
+		return []string{rootfs}, rootfs, nil
+	}
+	if !containerInfo.HasWriteLayer() {
+		return nil, "", err
+	}
+	driver, driverErr := eng.containerStorageDriver(containerInfo)
+	if driverErr != nil {
+		return nil, "", driverErr
+	}
+	writeLayer := driver.UpperDir(containerInfo.Name)
+	if exist, _ := container.PathExists(writeLayer); !exist {
+		return nil, "", err
+	}
+	if driver.Name() == storage.Vfs {
+		return []string{writeLayer}, writeLayer, nil
+	}
+	return append([]string{writeLayer}, eng.containerLowerDirs(containerInfo)...), writeLayer, nil
+}
+
+// resolveInContainer 解析容器里的源路径，返回相对容器根目录的路径，最后一个分量如果是符号链接就复制链接本身
+func resolveInContainer(roots []string, path string) (string, error) {
+	clean := filepath.Clean("/" + path)
+	dir, err := archive.ResolveInLayers(roots, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, filepath.Base(clean))
+	if _, ok := archive.LookupLower(roots, resolved); !ok {
+		return "", os.ErrNotExist
+	}
+	return resolved, nil
+}
+
+func (eng *engine) copyFromContainer(src cpPath, hostPath string) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(src.Container)
+	if err != nil {
+		return err
+	}
+	roots, _, err := eng.containerCopyRoots(containerInfo)
+	if err != nil {
+		return err
+	}
+	srcPath, err := resolveInContainer(roots, src.Path)
+	if err != nil {
+		return fmt.Errorf("no such file %s in container %s", src.Path, src.Container)
+	}
+	name := filepath.Base(srcPath)
+	if hostPath == "-" {
+		return archive.TarLayers(roots, srcPath, name, os.Stdout)
+	}
+	destDir, destName := copyTarget(hostPath, name)
+	if fi, err := os.Stat(destDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist", destDir)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive.TarLayers(roots, srcPath, destName, writer))
+	}()
+	err = archive.Untar(reader, destDir)
+	reader.CloseWithError(err)
+	return err
+}
+
+func (eng *engine) copyToContainer(hostPath string, dest cpPath) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(dest.Container)
+	if err != nil {
+		return err
+	}
+	_, root, err := eng.containerCopyRoots(containerInfo)
+	if err != nil {
+		return err
+	}
+	destPath, err := archive.SecureJoin(root, dest.Path)
+	if err != nil {
+		return err
+	}
+	// 标准输入是一个tar流，直接解到目标目录下
+	if hostPath == "-" {
+		if fi, err := os.Stat(destPath); err != nil || !fi.IsDir() {
+			return fmt.Errorf("destination %s must be an existing directory", dest.Path)
+		}
+		return archive.Untar(os.Stdin, destPath)
+	}
+	srcPath := filepath.Clean(hostPath)
+	if _, err := os.Lstat(srcPath); err != nil {
+		return err
+	}
+	destDir, destName := copyTarget(destPath, filepath.Base(srcPath))
+	if destDir != root && !strings.HasPrefix(destDir, root+"/") {
+		return fmt.Errorf("destination %s is outside the container", dest.Path)
+	}
+	return archive.CopyPath(srcPath, destDir, destName)
+}
+
+// copyTarget 和cp命令一样，目标是已存在的目录时复制到它下面，否则复制成目标本身
+func copyTarget(dest, srcName string) (string, string) {
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		return dest, srcName
+	}
+	return filepath.Dir(dest), filepath.Base(dest)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+)
+
+// diffContainer 列出容器相对镜像新增(A)、修改(C)和删除(D)的文件
+func (eng *engine) diffContainer(containerName string) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
+	if err != nil {
+		return err
+	}
+	if !containerInfo.HasWriteLayer() {
+		return fmt.Errorf("container %s has no write layer", containerName)
+	}
+	driver, err := eng.containerStorageDriver(containerInfo)
+	if err != nil {
+		return err
+	}
+	changes, err := driver.Changes(containerName, eng.containerLowerDirs(containerInfo))
+	if err != nil {
+		return fmt.Errorf("diff container %s error %v", containerName, err)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
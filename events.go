@@ -0,0 +1,27 @@
+package main
+
+import (
+	"cocin_dokcer/events"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// streamEvents 把事件日志中符合条件的事件打印到标准输出
+// 没有指定until时会一直跟踪新事件，直到收到Ctrl+C
+func (eng *engine) streamEvents(since, until time.Time, filter events.Filter) error {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		close(stop)
+	}()
+	return eng.newJournal().Stream(since, until, filter, stop, func(ev *events.Event) error {
+		_, err := fmt.Fprintln(os.Stdout, ev.String())
+		return err
+	})
+}
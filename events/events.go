@@ -0,0 +1,158 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 事件的对象类型
+const (
+	TypeContainer = "container"
+	TypeNetwork   = "network"
+)
+
+// JournalFile 事件日志的文件名，放在状态目录下
+const JournalFile = "events.log"
+
+// Actor 触发事件的对象，ID是容器ID或网络名，Attributes放名字、镜像等附加信息
+type Actor struct {
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Event 一条生命周期事件，日志文件里每行一条json
+type Event struct {
+	Time   int64  `json:"time"` // unix纳秒时间戳
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	Actor  Actor  `json:"actor"`
+}
+
+// Journal 以追加方式写入的事件日志
+type Journal struct {
+	Path string
+}
+
+func NewJournal(root string) *Journal {
+	return &Journal{Path: filepath.Join(root, JournalFile)}
+}
+
+// Append 追加一条事件
+// 写入前加flock，多个cocin_docker进程同时写也不会交错出半行
+func (j *Journal) Append(ev *Event) error {
+	if ev.Time == 0 {
+		ev.Time = time.Now().UnixNano()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Log 记录一条事件，失败只打日志，不影响容器的生命周期操作
+func (j *Journal) Log(eventType, action, id string, attributes map[string]string) {
+	ev := &Event{
+		Type:   eventType,
+		Action: action,
+		Actor:  Actor{ID: id, Attributes: attributes},
+	}
+	if err := j.Append(ev); err != nil {
+		log.Warnf("Append %s %s event error %v", eventType, action, err)
+	}
+}
+
+// Stream 把时间在[since, until)范围内并满足过滤条件的事件交给handler
+// until为零值时读完已有事件后继续跟踪文件新写入的内容，直到stop被关闭
+func (j *Journal) Stream(since, until time.Time, filter Filter, stop <-chan struct{}, handler func(*Event) error) error {
+	f, err := os.OpenFile(j.Path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	follow := until.IsZero() || until.After(time.Now())
+	reader := bufio.NewReader(f)
+	var pending string
+	for {
+		line, err := reader.ReadString('\n')
+		pending += line
+		if err == io.EOF {
+			// 半行说明写的一方还没写完，留着等下次读
+			if !follow {
+				return nil
+			}
+			if !until.IsZero() && time.Now().After(until) {
+				return nil
+			}
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(200 * time.Millisecond):
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(pending), &ev); err != nil {
+			log.Warnf("Skip broken event line %q", pending)
+			pending = ""
+			continue
+		}
+		pending = ""
+		t := time.Unix(0, ev.Time)
+		if !since.IsZero() && t.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !t.Before(until) {
+			if follow {
+				continue
+			}
+			return nil
+		}
+		if !filter.Match(&ev) {
+			continue
+		}
+		if err := handler(&ev); err != nil {
+			return err
+		}
+	}
+}
+
+// String 按 时间 类型 动作 ID (属性) 的格式输出
+func (ev *Event) String() string {
+	var attrs []string
+	for k, v := range ev.Actor.Attributes {
+		attrs = append(attrs, k+"="+v)
+	}
+	sort.Strings(attrs)
+	s := fmt.Sprintf("%s %s %s %s", time.Unix(0, ev.Time).Format(time.RFC3339Nano), ev.Type, ev.Action, ev.Actor.ID)
+	if len(attrs) > 0 {
+		s += " (" + strings.Join(attrs, ", ") + ")"
+	}
+	return s
+}
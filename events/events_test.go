@@ -0,0 +1,69 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamFilter(t *testing.T) {
+	j := NewJournal(t.TempDir())
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	j.Append(&Event{Time: base.UnixNano(), Type: TypeContainer, Action: "start", Actor: Actor{ID: "abcdef", Attributes: map[string]string{"name": "web"}}})
+	j.Append(&Event{Time: base.Add(time.Minute).UnixNano(), Type: TypeContainer, Action: "die", Actor: Actor{ID: "abcdef", Attributes: map[string]string{"name": "web"}}})
+	j.Append(&Event{Time: base.Add(2 * time.Minute).UnixNano(), Type: TypeNetwork, Action: "create", Actor: Actor{ID: "br0"}})
+
+	filter, err := ParseFilter([]string{"container=web", "event=die", "event=start"})
+	if err != nil {
+		t.Fatalf("parse filter error %v", err)
+	}
+	var got []string
+	err = j.Stream(base.Add(time.Second), base.Add(time.Hour), filter, nil, func(ev *Event) error {
+		got = append(got, ev.Action)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("stream error %v", err)
+	}
+	if len(got) != 1 || got[0] != "die" {
+		t.Errorf("expect only the die event, got %v", got)
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	die := &Event{Type: TypeContainer, Action: "die", Actor: Actor{ID: "abcdef", Attributes: map[string]string{"name": "web", "exitCode": "137"}}}
+	tests := []struct {
+		args  []string
+		match bool
+	}{
+		{[]string{"label=exitCode"}, true},
+		{[]string{"label=exitCode=137"}, true},
+		{[]string{"label=exitCode=0"}, false},
+		{[]string{"label=exitCode=0", "label=name=web"}, true},
+		{[]string{"label=signal"}, false},
+		{[]string{"label=exitCode", "event=start"}, false},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.args)
+		if err != nil {
+			t.Fatalf("parse filter %v error %v", test.args, err)
+		}
+		if filter.Match(die) != test.match {
+			t.Errorf("filter %v match = %v, want %v", test.args, !test.match, test.match)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	got, err := ParseTime("10m", now)
+	if err != nil || !got.Equal(now.Add(-10*time.Minute)) {
+		t.Errorf("relative time parsed wrong: %v %v", got, err)
+	}
+	got, err = ParseTime("1767225600", now)
+	if err != nil || got.Unix() != 1767225600 {
+		t.Errorf("unix time parsed wrong: %v %v", got, err)
+	}
+	if _, err := ParseTime("yesterday", now); err == nil {
+		t.Errorf("bad time should fail")
+	}
+}
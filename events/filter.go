@@ -0,0 +1,116 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter 事件过滤条件，同一个key的多个值之间是或，不同key之间是与
+// 支持的key：type、event、container、network、image、name，以及按任意属性过滤的label
+// label=key 要求事件有这个属性，label=key=value 还要求属性的值相等
+type Filter map[string][]string
+
+// ParseFilter 解析 --filter key=value 参数
+func ParseFilter(args []string) (Filter, error) {
+	filter := Filter{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("bad filter format %q, should be key=value", arg)
+		}
+		switch kv[0] {
+		case "type", "event", "container", "network", "image", "name", "label":
+		default:
+			return nil, fmt.Errorf("unsupported filter key %q", kv[0])
+		}
+		filter[kv[0]] = append(filter[kv[0]], kv[1])
+	}
+	return filter, nil
+}
+
+// Match 判断事件是否满足过滤条件
+func (f Filter) Match(ev *Event) bool {
+	for key, values := range f {
+		var candidates []string
+		switch key {
+		case "type":
+			candidates = []string{ev.Type}
+		case "event":
+			candidates = []string{ev.Action}
+		case "container":
+			if ev.Type != TypeContainer {
+				return false
+			}
+			candidates = []string{ev.Actor.ID, ev.Actor.Attributes["name"]}
+		case "network":
+			if ev.Type == TypeNetwork {
+				candidates = []string{ev.Actor.ID}
+			} else {
+				candidates = []string{ev.Actor.Attributes["network"]}
+			}
+		case "image":
+			candidates = []string{ev.Actor.Attributes["image"]}
+		case "name":
+			candidates = []string{ev.Actor.Attributes["name"]}
+		case "label":
+			if !matchLabel(values, ev.Actor.Attributes) {
+				return false
+			}
+			continue
+		}
+		if !matchAny(values, candidates) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(values, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if c == "" {
+				continue
+			}
+			// 容器ID允许只写前缀
+			if c == v || (len(v) >= 3 && strings.HasPrefix(c, v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchLabel 属性满足任意一个 key 或 key=value
+func matchLabel(values []string, attributes map[string]string) bool {
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		value, ok := attributes[kv[0]]
+		if ok && (len(kv) == 1 || value == kv[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTime 解析 --since/--until 参数
+// 支持RFC3339时间、unix时间戳(秒)以及 10m、1h30m 这种表示多久之前的相对时间
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, use RFC3339, unix seconds or a duration like 10m", value)
+}
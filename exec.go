@@ -1,14 +1,14 @@
 package main
 
 import (
-	"cocin_dokcer/container"
+	"cocin_dokcer/events"
 	_ "cocin_dokcer/nsenter"
-	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -17,28 +17,22 @@ const ENV_EXEC_PID = "cocin_docker_pid"
 const ENV_EXEC_CMD = "cocin_docker_cmd"
 
 // 根据提供的容器名，获取对应容器的PID 通过之前的后台运行信息来实现
-func getContainerPidByName(containerName string) (string, error) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	contentBytes, err := ioutil.ReadFile(configFilePath)
+func (eng *engine) getContainerPidByName(containerName string) (string, error) {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
 	if err != nil {
 		return "", err
 	}
-	var containerInfo container.ContainerInfo
-	// 将文件反序列化成容器信息对象，然后返回对应的PID
-	if err := json.Unmarshal(contentBytes, &containerInfo); err != nil {
-		return "", err
-	}
 	return containerInfo.Pid, nil
 }
 
-func ExecContainer(containerName string, comArray []string) {
+func (eng *engine) ExecContainer(containerName string, comArray []string) {
 	// 获取宿主机PID
-	pid, err := getContainerPidByName(containerName)
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
 	if err != nil {
-		log.Errorf("Exec container getContainerPidByName %s error %v", containerName, err)
+		log.Errorf("Exec container get container %s info error %v", containerName, err)
 		return
 	}
+	pid := containerInfo.Pid
 	// 把命令以空格为分隔符拼接成字符串，便于传递
 	cmdStr := strings.Join(comArray, " ")
 	log.Infof("container pid %s", pid)
@@ -58,9 +52,17 @@ func ExecContainer(containerName string, comArray []string) {
 	// 宿主机的环境变量和容器的环境变量都放置到exec进程内
 	cmd.Env = append(os.Environ(), containerEnvs...)
 
+	journal := eng.newJournal()
+	attributes := containerAttributes(containerInfo)
+	attributes["execCommand"] = cmdStr
+	journal.Log(events.TypeContainer, "exec_start", containerInfo.Id, attributes)
 	if err := cmd.Run(); err != nil {
 		log.Errorf("Exec container %s error %v", containerName, err)
 	}
+	if cmd.ProcessState != nil {
+		attributes["exitCode"] = strconv.Itoa(cmd.ProcessState.ExitCode())
+	}
+	journal.Log(events.TypeContainer, "exec_die", containerInfo.Id, attributes)
 }
 
 // 根据指定PID获取对应进程的环境变量
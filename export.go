@@ -0,0 +1,81 @@
+package main
+
+import (
+	"cocin_dokcer/archive"
+	"cocin_dokcer/container"
+	"cocin_dokcer/image"
+	"cocin_dokcer/oci"
+	"fmt"
+	"io"
+	"os"
+)
+
+// containerRootfs 返回容器在宿主机上看到的完整rootfs，普通容器是联合挂载点，bundle容器是bundle里的rootfs
+func (eng *engine) containerRootfs(containerInfo *container.ContainerInfo) (string, error) {
+	if containerInfo.Bundle != "" {
+		spec, err := oci.LoadSpec(containerInfo.Bundle)
+		if err != nil {
+			return "", err
+		}
+		return spec.RootfsPath(containerInfo.Bundle), nil
+	}
+	mntURL := eng.containerPaths().MntDir(containerInfo.Name)
+	mounted, err := container.IsMounted(mntURL)
+	if err != nil {
+		return "", err
+	}
+	if !mounted {
+		return "", fmt.Errorf("rootfs of container %s is not mounted", containerInfo.Name)
+	}
+	return mntURL, nil
+}
+
+// exportContainer 把容器合并后的rootfs打成tar，output为空或者"-"时写到标准输出
+func (eng *engine) exportContainer(containerName, output string) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
+	if err != nil {
+		return err
+	}
+	rootfs, err := eng.containerRootfs(containerInfo)
+	if err != nil {
+		return err
+	}
+	if output == "" || output == "-" {
+		return archive.Tar(rootfs, os.Stdout)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("create %s error %v", output, err)
+	}
+	if err := archive.Tar(rootfs, f); err != nil {
+		f.Close()
+		os.Remove(output)
+		return fmt.Errorf("export container %s error %v", containerName, err)
+	}
+	return f.Close()
+}
+
+/*
+	importImage 把一个rootfs的tar包导入成只有一层的镜像，run的时候直接使用
+	input为空或者"-"时从标准输入读，边读边写进镜像存储，不产生临时的解包目录
+*/
+func (eng *engine) importImage(input, imageName string) error {
+	if _, err := image.NormalizeName(imageName); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("open %s error %v", input, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	id, err := eng.newImageStore().ImportRootfs(r, imageName, "import "+input)
+	if err != nil {
+		return fmt.Errorf("import image %s error %v", imageName, err)
+	}
+	fmt.Println(id)
+	return nil
+}
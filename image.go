@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cocin_dokcer/image"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// historyRow image history输出的一行
+type historyRow struct {
+	layer   string
+	history image.History
+	size    int64
+}
+
+/*
+	imageHistory 列出镜像的每一步，最新的在最上面
+	非空的历史记录按顺序和layer一一对应，只改配置的步骤没有layer，大小是0
+	从别处导入的镜像历史记录可能比layer少，多出来的layer显示成<missing>
+*/
+func (eng *engine) imageHistory(nameOrID string, noTrunc bool) error {
+	images := eng.newImageStore()
+	id, err := images.Resolve(nameOrID)
+	if err != nil {
+		return err
+	}
+	img, err := images.GetImage(id)
+	if err != nil {
+		return err
+	}
+	var rows []historyRow
+	layer := 0
+	for _, history := range img.History {
+		row := historyRow{layer: "<none>", history: history}
+		if !history.EmptyLayer && layer < len(img.RootFS.DiffIDs) {
+			row.layer = img.RootFS.DiffIDs[layer]
+			layer++
+		}
+		rows = append(rows, row)
+	}
+	for ; layer < len(img.RootFS.DiffIDs); layer++ {
+		rows = append(rows, historyRow{layer: img.RootFS.DiffIDs[layer], history: image.History{CreatedBy: "<missing>"}})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := rows[i]
+		layerID := row.layer
+		if strings.HasPrefix(layerID, "sha256:") {
+			if size, err := images.LayerSize(layerID); err == nil {
+				row.size = size
+			}
+			if !noTrunc {
+				layerID = shortImageID(layerID)
+			}
+		}
+		created := ""
+		if !row.history.Created.IsZero() {
+			created = row.history.Created.Local().Format("2006-01-02 15:04:05")
+		}
+		createdBy := strings.Join(strings.Fields(row.history.CreatedBy), " ")
+		comment := row.history.Comment
+		if !noTrunc {
+			createdBy = truncate(createdBy, 45)
+			comment = truncate(comment, 45)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			layerID,
+			created,
+			createdBy,
+			humanSize(row.size),
+			comment)
+	}
+	return w.Flush()
+}
+
+// truncate 超过n个字符的内容截断，末尾加省略号
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// imageInspect image inspect输出的一个镜像
+type imageInspect struct {
+	ID       string          `json:"Id"`
+	RepoTags []string        `json:"RepoTags"`
+	Size     int64           `json:"Size"`
+	Config   json.RawMessage `json:"Config"` // 镜像配置原文，ID就是它的摘要
+	Manifest image.Manifest  `json:"Manifest"`
+}
+
+// inspectImages 以json数组输出镜像的完整配置和manifest
+func (eng *engine) inspectImages(refs []string) error {
+	images := eng.newImageStore()
+	names, err := images.Names()
+	if err != nil {
+		return err
+	}
+	var result []imageInspect
+	for _, ref := range refs {
+		id, err := images.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		config, err := images.RawConfig(id)
+		if err != nil {
+			return err
+		}
+		img, err := images.GetImage(id)
+		if err != nil {
+			return err
+		}
+		manifest, err := images.Manifest(id)
+		if err != nil {
+			return err
+		}
+		repoTags := []string{}
+		for name, nameID := range names {
+			if nameID == id {
+				repoTags = append(repoTags, name)
+			}
+		}
+		sort.Strings(repoTags)
+		result = append(result, imageInspect{
+			ID:       id,
+			RepoTags: repoTags,
+			Size:     images.Size(img),
+			Config:   config,
+			Manifest: manifest,
+		})
+	}
+	content, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(content))
+	return nil
+}
+
+// squashImage 把镜像的所有layer合并成一层生成新镜像，tag不为空时给新镜像命名
+func (eng *engine) squashImage(nameOrID, tag string) error {
+	images := eng.newImageStore()
+	id, err := images.Resolve(nameOrID)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		if _, err := image.NormalizeName(tag); err != nil {
+			return err
+		}
+	}
+	squashedID, err := images.Squash(id, "squash "+nameOrID)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		if err := images.SetName(tag, squashedID); err != nil {
+			return err
+		}
+	}
+	fmt.Println(squashedID)
+	return nil
+}
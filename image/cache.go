@@ -0,0 +1,58 @@
+package image
+
+import (
+	"cocin_dokcer/store"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// build的缓存 {Root}/buildcache/<hex>，内容是执行完这一步以后的镜像配置
+// 缓存不占用layer，layer被rmi删掉以后对应的缓存自动失效
+
+func (s *Store) cachePath(key string) (string, error) {
+	hexPart, err := DigestHex(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "buildcache", hexPart), nil
+}
+
+// CachedImage 读取key对应的缓存，缓存不存在或者用到的layer已经被删掉时返回false
+func (s *Store) CachedImage(key string) (*Image, bool) {
+	path, err := s.cachePath(key)
+	if err != nil {
+		return nil, false
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var img Image
+	if err := json.Unmarshal(content, &img); err != nil {
+		return nil, false
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !s.HasLayer(diffID) {
+			return nil, false
+		}
+	}
+	return &img, true
+}
+
+// PutCache 记录key对应的镜像配置
+func (s *Store) PutCache(key string, img *Image) error {
+	path, err := s.cachePath(key)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(path, content, 0644)
+}
@@ -0,0 +1,208 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	镜像存储的垃圾回收，由 system prune 调用
+	镜像、容器的引用和build缓存都用不到的layer就是可以回收的，比如删掉缓存以后build的中间层、squash前后的旧layer
+	刚写进来的layer可能还没来得及被镜像配置引用(commit、pull的过程中)，只回收before之前写入的
+*/
+
+// Layers 存储里所有layer的摘要
+func (s *Store) Layers() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Root, "layers", digestAlgorithm))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var digests []string
+	for _, entry := range entries {
+		if entry.IsDir() && validHex.MatchString(entry.Name()) {
+			digests = append(digests, digestAlgorithm+":"+entry.Name())
+		}
+	}
+	return digests, nil
+}
+
+// cacheEntries build缓存的所有文件
+func (s *Store) cacheEntries() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Root, "buildcache"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// CacheCount build缓存的条数
+func (s *Store) CacheCount() (int, error) {
+	entries, err := s.cacheEntries()
+	return len(entries), err
+}
+
+// ClearCache 删除before之前写入的build缓存，返回删除的条数
+func (s *Store) ClearCache(before time.Time) (int, error) {
+	entries, err := s.cacheEntries()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Root, "buildcache", entry.Name())); err != nil && !os.IsNotExist(err) {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// cachedLayers 还在的build缓存用到的layer
+func (s *Store) cachedLayers() (map[string]bool, error) {
+	entries, err := s.cacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	cached := make(map[string]bool)
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(filepath.Join(s.Root, "buildcache", entry.Name()))
+		if err != nil {
+			continue
+		}
+		var img Image
+		if err := json.Unmarshal(content, &img); err != nil {
+			continue
+		}
+		for _, diffID := range img.RootFS.DiffIDs {
+			cached[diffID] = true
+		}
+	}
+	return cached, nil
+}
+
+// UnusedLayers 没有镜像用到、也没有容器引用的layer，build缓存用到的也算在里面
+func (s *Store) UnusedLayers() ([]string, error) {
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	return s.unusedLayers(countRefs(refs), nil)
+}
+
+// unusedLayers 镜像、容器引用和keep都用不到的layer
+func (s *Store) unusedLayers(counts map[string]int, keep map[string]bool) ([]string, error) {
+	digests, err := s.Layers()
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.usedLayers()
+	if err != nil {
+		return nil, err
+	}
+	var unused []string
+	for _, digest := range digests {
+		if !used[digest] && counts[digest] == 0 && !keep[digest] {
+			unused = append(unused, digest)
+		}
+	}
+	return unused, nil
+}
+
+/*
+	PruneLayers 删除镜像、容器和build缓存都用不到的layer，返回被删除的layer和它们原始tar的总大小
+	和DeleteImage一样持有引用计数的锁，正在启动的容器不会用到被删掉的layer
+*/
+func (s *Store) PruneLayers(before time.Time) ([]string, int64, error) {
+	lock, err := s.lockRefs()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer lock.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, 0, err
+	}
+	cached, err := s.cachedLayers()
+	if err != nil {
+		return nil, 0, err
+	}
+	unused, err := s.unusedLayers(countRefs(refs), cached)
+	if err != nil {
+		return nil, 0, err
+	}
+	var deleted []string
+	var reclaimed int64
+	for _, digest := range unused {
+		blob, _ := s.LayerBlob(digest)
+		fi, err := os.Stat(blob)
+		if err == nil && !fi.ModTime().Before(before) {
+			continue
+		}
+		if err := s.DeleteLayer(digest); err != nil {
+			return deleted, reclaimed, err
+		}
+		if fi != nil {
+			reclaimed += fi.Size()
+		}
+		deleted = append(deleted, digest)
+	}
+	return deleted, reclaimed, nil
+}
+
+// TmpSize 临时目录的大小，PutLayer和解包写到一半的文件都在这里
+func (s *Store) TmpSize() int64 {
+	var size int64
+	filepath.Walk(filepath.Join(s.Root, "tmp"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+/*
+	PruneTmp 删除before之前留下的临时文件，比如写layer写到一半进程被杀掉，返回释放的字节数
+	按修改时间判断，正在写的文件时间一直在更新，不会被删掉；删空了的旧目录也一起删掉
+*/
+func (s *Store) PruneTmp(before time.Time) (int64, error) {
+	tmpRoot := filepath.Join(s.Root, "tmp")
+	var reclaimed int64
+	var dirs []string
+	err := filepath.Walk(tmpRoot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if path != tmpRoot && fi.ModTime().Before(before) {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !fi.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		reclaimed += fi.Size()
+		return nil
+	})
+	// 子目录在父目录后面，倒着删，不空的目录删除失败就留着
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return reclaimed, err
+}
@@ -0,0 +1,75 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneLayers(t *testing.T) {
+	st := New(t.TempDir())
+	putLayer := func(name string) string {
+		dir := t.TempDir()
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		diffID, err := st.PutLayer(tarDir(t, dir))
+		if err != nil {
+			t.Fatalf("put layer error %v", err)
+		}
+		return diffID
+	}
+	id, err := st.ImportRootfs(tarDir(t, t.TempDir()), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	img, _ := st.GetImage(id)
+	imageLayer := img.RootFS.DiffIDs[0]
+
+	// 只被容器引用、只被build缓存用到、谁都不用的layer各一个
+	refLayer := putLayer("ref")
+	ref := NewImage()
+	ref.AddLayer(refLayer, History{})
+	st.AddRef("c1", ref)
+	cacheLayer := putLayer("cache")
+	cached := NewImage()
+	cached.AddLayer(cacheLayer, History{})
+	st.PutCache(Digest([]byte("step")), cached)
+	orphan := putLayer("orphan")
+
+	unused, err := st.UnusedLayers()
+	if err != nil || len(unused) != 2 {
+		t.Errorf("unused layers = %v, %v, want the cache and orphan layers", unused, err)
+	}
+	// 刚写入的layer不删
+	if deleted, _, err := st.PruneLayers(time.Now().Add(-time.Hour)); err != nil || len(deleted) != 0 {
+		t.Errorf("recent layers should be kept, deleted %v, %v", deleted, err)
+	}
+	deleted, reclaimed, err := st.PruneLayers(time.Now().Add(time.Second))
+	if err != nil || len(deleted) != 1 || deleted[0] != orphan || reclaimed == 0 {
+		t.Fatalf("prune layers = %v, %d, %v, want only the orphan layer", deleted, reclaimed, err)
+	}
+
+	if n, err := st.ClearCache(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("clear cache = %d, %v", n, err)
+	}
+	deleted, _, _ = st.PruneLayers(time.Now().Add(time.Second))
+	if len(deleted) != 1 || deleted[0] != cacheLayer {
+		t.Errorf("layer of the cleared cache should be pruned, deleted %v", deleted)
+	}
+	for _, diffID := range []string{imageLayer, refLayer} {
+		if !st.HasLayer(diffID) {
+			t.Errorf("layer %s is in use and should be kept", diffID)
+		}
+	}
+
+	// 写了一半的临时文件
+	os.MkdirAll(filepath.Join(st.Root, "tmp", "downloads"), 0700)
+	ioutil.WriteFile(filepath.Join(st.Root, "tmp", "downloads", "partial"), []byte("partial"), 0600)
+	if size, err := st.PruneTmp(time.Now().Add(time.Second)); err != nil || size != int64(len("partial")) {
+		t.Errorf("prune tmp = %d, %v", size, err)
+	}
+	if _, err := os.Stat(filepath.Join(st.Root, "tmp", "downloads")); !os.IsNotExist(err) {
+		t.Errorf("empty tmp dirs should be removed, %v", err)
+	}
+}
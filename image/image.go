@@ -0,0 +1,137 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 镜像ID和layer都用内容的sha256标识，写成 sha256:<hex>
+const digestAlgorithm = "sha256"
+
+var validHex = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// Digest 计算内容的摘要
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return digestAlgorithm + ":" + hex.EncodeToString(sum[:])
+}
+
+// DigestHex 取出摘要里的十六进制部分，格式不对时返回错误，摘要会被拼进路径里
+func DigestHex(digest string) (string, error) {
+	hexPart := strings.TrimPrefix(digest, digestAlgorithm+":")
+	if !validHex.MatchString(hexPart) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return hexPart, nil
+}
+
+// RootFS 镜像由哪些layer组成，DiffIDs从最底层开始排列
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History 每一层是怎么来的
+type History struct {
+	Created    time.Time `json:"created,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// Config 用这个镜像运行容器时的默认配置
+type Config struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+// Image 镜像的配置，格式和OCI image config一致，镜像ID就是这份json的摘要
+type Image struct {
+	Created      time.Time `json:"created"`
+	Author       string    `json:"author,omitempty"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Config       Config    `json:"config"`
+	RootFS       RootFS    `json:"rootfs"`
+	History      []History `json:"history,omitempty"`
+}
+
+// NewImage 一个没有任何layer的镜像
+func NewImage() *Image {
+	return &Image{
+		Created:      time.Now().UTC(),
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       RootFS{Type: "layers"},
+	}
+}
+
+// AddLayer 在镜像最上面加一层，同时记录这一层的来历
+func (img *Image) AddLayer(diffID string, history History) {
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, diffID)
+	if history.Created.IsZero() {
+		history.Created = time.Now().UTC()
+	}
+	img.Created = history.Created
+	img.History = append(img.History, history)
+}
+
+// AddEmptyLayer 只修改了配置的一步，记录来历但不增加layer
+func (img *Image) AddEmptyLayer(history History) {
+	history.EmptyLayer = true
+	if history.Created.IsZero() {
+		history.Created = time.Now().UTC()
+	}
+	img.Created = history.Created
+	img.History = append(img.History, history)
+}
+
+// Child 以当前镜像为父镜像，复制一份配置用来生成新镜像
+func (img *Image) Child() *Image {
+	child := *img
+	child.RootFS.DiffIDs = append([]string(nil), img.RootFS.DiffIDs...)
+	child.History = append([]History(nil), img.History...)
+	child.Config = img.Config.Copy()
+	return &child
+}
+
+// Copy 深拷贝，子镜像修改配置时不能影响父镜像
+func (c Config) Copy() Config {
+	c.Env = append([]string(nil), c.Env...)
+	c.Entrypoint = append([]string(nil), c.Entrypoint...)
+	c.Cmd = append([]string(nil), c.Cmd...)
+	if c.ExposedPorts != nil {
+		ports := make(map[string]struct{}, len(c.ExposedPorts))
+		for port := range c.ExposedPorts {
+			ports[port] = struct{}{}
+		}
+		c.ExposedPorts = ports
+	}
+	if c.Labels != nil {
+		labels := make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		c.Labels = labels
+	}
+	return c
+}
+
+// Command 容器最终执行的命令：Entrypoint加上参数，没有给参数时用镜像的Cmd
+func (c Config) Command(args []string) []string {
+	if len(args) == 0 {
+		args = c.Cmd
+	}
+	return append(append([]string(nil), c.Entrypoint...), args...)
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestConfigCommand(t *testing.T) {
+	c := Config{Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"echo hi"}}
+	if got := c.Command(nil); !reflect.DeepEqual(got, []string{"/bin/sh", "-c", "echo hi"}) {
+		t.Errorf("default command = %v", got)
+	}
+	if got := c.Command([]string{"ls"}); !reflect.DeepEqual(got, []string{"/bin/sh", "-c", "ls"}) {
+		t.Errorf("command with args = %v", got)
+	}
+	if got := (Config{}).Command(nil); len(got) != 0 {
+		t.Errorf("empty config should give no command, got %v", got)
+	}
+}
+
+func TestDeleteImageKeepsSharedLayers(t *testing.T) {
+	st := New(t.TempDir())
+	base, _ := st.PutLayer(bytes.NewReader([]byte("base")))
+	top, _ := st.PutLayer(bytes.NewReader([]byte("top")))
+
+	parent := NewImage()
+	parent.Config.Env = []string{"PATH=/bin"}
+	parent.AddLayer(base, History{CreatedBy: "base"})
+	parentID, err := st.CreateImage(parent)
+	if err != nil {
+		t.Fatalf("create parent error %v", err)
+	}
+	child := parent.Child()
+	child.Config.Env = append(child.Config.Env, "A=1")
+	child.AddLayer(top, History{CreatedBy: "top"})
+	childID, err := st.CreateImage(child)
+	if err != nil {
+		t.Fatalf("create child error %v", err)
+	}
+	if len(parent.Config.Env) != 1 {
+		t.Errorf("changing the child config should not change the parent")
+	}
+	st.SetName("child", childID)
+
+	deleted, err := st.DeleteImage(childID)
+	if err != nil {
+		t.Fatalf("delete image error %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{top}) {
+		t.Errorf("only the top layer should be deleted, got %v", deleted)
+	}
+	if !st.HasLayer(base) {
+		t.Errorf("base layer is still used by the parent image")
+	}
+	if _, err := st.Resolve("child"); err == nil {
+		t.Errorf("name of a deleted image should be removed")
+	}
+	if ids, _ := st.Images(); !reflect.DeepEqual(ids, []string{parentID}) {
+		t.Errorf("images = %v, want only the parent", ids)
+	}
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"cocin_dokcer/archive"
+	"cocin_dokcer/reference"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImportRootfs 把一个完整rootfs的tar流(可以是gzip压缩的)导入成只有一层的镜像，并命名为name
+func (s *Store) ImportRootfs(r io.Reader, name, createdBy string) (string, error) {
+	rc, err := archive.DecompressStream(r)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	diffID, err := s.PutLayer(rc)
+	if err != nil {
+		return "", err
+	}
+	img := NewImage()
+	img.AddLayer(diffID, History{CreatedBy: createdBy})
+	id, err := s.CreateImage(img)
+	if err != nil {
+		return "", err
+	}
+	if err := s.SetName(name, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/*
+	ImportLegacy 导入以前的扁平镜像：{legacyRoot}/{name}.tar，或者已经解包好的 {legacyRoot}/{name}/
+	run一个镜像存储里还没有的镜像时调用，导入之后原来的文件不动
+	只有没写仓库地址、tag是latest的简单名字才会去找，名字不会被当成任意路径拼进legacyRoot
+*/
+func (s *Store) ImportLegacy(name, legacyRoot string) (string, error) {
+	legacy, ok := LegacyName(name)
+	if !ok {
+		return "", fmt.Errorf("image %s not found", name)
+	}
+	name = legacy
+	tarPath := filepath.Join(legacyRoot, name+".tar")
+	if f, err := os.Open(tarPath); err == nil {
+		defer f.Close()
+		return s.ImportRootfs(f, name, "import "+tarPath)
+	}
+	dir := filepath.Join(legacyRoot, name)
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(archive.Tar(dir, writer))
+		}()
+		defer reader.Close()
+		return s.ImportRootfs(reader, name, "import "+dir)
+	}
+	return "", fmt.Errorf("image %s not found", name)
+}
+
+// LegacyName 以前的扁平镜像在存储根目录下的文件名，只有 busybox、busybox:latest 这样的名字才有
+func LegacyName(name string) (string, bool) {
+	ref, err := reference.Parse(name)
+	if err != nil || ref.Domain != reference.DefaultDomain || ref.Digest != "" {
+		return "", false
+	}
+	ref = ref.WithDefaultTag()
+	familiar := ref.FamiliarName()
+	if ref.Tag != reference.DefaultTag || strings.Contains(familiar, "/") {
+		return "", false
+	}
+	return familiar, true
+}
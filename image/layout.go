@@ -0,0 +1,388 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"cocin_dokcer/archive"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ociLayoutFile      = "oci-layout"
+	ociLayoutVersion   = "1.0.0"
+	indexFile          = "index.json"
+	dockerManifestFile = "manifest.json"
+)
+
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// dockerManifest docker save生成的manifest.json里的一项
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// LoadedImage load导入的一个镜像
+type LoadedImage struct {
+	ID   string
+	Name string
+}
+
+/*
+	Save 把镜像按OCI image layout格式打包写到w
+	oci-layout        layout版本
+	index.json        每个镜像一个manifest，镜像名记在注解里
+	blobs/sha256/...  manifest、镜像配置和layer，layer不压缩
+	多个镜像共用的layer只写一次
+*/
+func (s *Store) Save(refs []string, w io.Writer) error {
+	names, err := s.Names()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	layout, _ := json.Marshal(ociLayout{ImageLayoutVersion: ociLayoutVersion})
+	if err := writeTarFile(tw, ociLayoutFile, layout); err != nil {
+		return err
+	}
+	for _, dir := range []string{"blobs/", "blobs/" + digestAlgorithm + "/"} {
+		hdr := &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	written := make(map[string]bool)
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeIndex}
+	for _, ref := range refs {
+		id, err := s.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		config, err := s.RawConfig(id)
+		if err != nil {
+			return err
+		}
+		var img Image
+		if err := json.Unmarshal(config, &img); err != nil {
+			return err
+		}
+		manifest := Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeManifest,
+			Config:        Descriptor{MediaType: MediaTypeConfig, Digest: id, Size: int64(len(config))},
+		}
+		if err := writeBlob(tw, written, id, config); err != nil {
+			return err
+		}
+		for _, diffID := range img.RootFS.DiffIDs {
+			size, err := s.writeLayerBlob(tw, written, diffID)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeLayer, Digest: diffID, Size: size})
+		}
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		digest := Digest(content)
+		if err := writeBlob(tw, written, digest, content); err != nil {
+			return err
+		}
+		desc := Descriptor{
+			MediaType: MediaTypeManifest,
+			Digest:    digest,
+			Size:      int64(len(content)),
+			Platform:  &Platform{Architecture: img.Architecture, OS: img.OS},
+		}
+		// 用镜像名保存的记下名字，用ID保存的导入后没有名字
+		if name, err := NormalizeName(ref); err == nil && names[name] == id {
+			desc.Annotations = map[string]string{AnnotationRefName: name}
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, indexFile, content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+func blobName(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func writeBlob(tw *tar.Writer, written map[string]bool, digest string, content []byte) error {
+	if written[digest] {
+		return nil
+	}
+	written[digest] = true
+	return writeTarFile(tw, blobName(digest), content)
+}
+
+func (s *Store) writeLayerBlob(tw *tar.Writer, written map[string]bool, diffID string) (int64, error) {
+	blob, err := s.LayerBlob(diffID)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return 0, fmt.Errorf("layer %s not found", diffID)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if written[diffID] {
+		return fi.Size(), nil
+	}
+	written[diffID] = true
+	hdr := &tar.Header{Name: blobName(diffID), Typeflag: tar.TypeReg, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(tw, f)
+	return fi.Size(), err
+}
+
+/*
+	Load 导入Save生成的OCI image layout，或者docker save生成的tar包
+	所有blob都会校验摘要，layer解压后的摘要还要和镜像配置里的diff_ids一致
+*/
+func (s *Store) Load(r io.Reader) ([]LoadedImage, error) {
+	tmpRoot := filepath.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(tmpRoot, "load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := archive.Untar(r, dir); err != nil {
+		return nil, fmt.Errorf("unpack archive error %v", err)
+	}
+	// 新版docker save两种格式都有，manifest.json里的镜像名更完整，优先用它
+	if _, err := os.Stat(filepath.Join(dir, dockerManifestFile)); err == nil {
+		return s.loadDockerArchive(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ociLayoutFile)); err == nil {
+		return s.loadOCILayout(dir)
+	}
+	return nil, fmt.Errorf("archive is neither an OCI image layout nor a docker save archive")
+}
+
+func (s *Store) loadOCILayout(dir string) ([]LoadedImage, error) {
+	var layout ociLayout
+	if err := readJSONFile(filepath.Join(dir, ociLayoutFile), &layout); err != nil {
+		return nil, err
+	}
+	if layout.ImageLayoutVersion != ociLayoutVersion {
+		return nil, fmt.Errorf("unsupported image layout version %s", layout.ImageLayoutVersion)
+	}
+	var index Index
+	if err := readJSONFile(filepath.Join(dir, indexFile), &index); err != nil {
+		return nil, err
+	}
+	var loaded []LoadedImage
+	for _, desc := range index.Manifests {
+		id, err := s.loadManifest(dir, desc)
+		if err != nil {
+			return loaded, err
+		}
+		name := desc.Annotations[AnnotationRefName]
+		if name != "" {
+			if err := s.SetName(name, id); err != nil {
+				return loaded, err
+			}
+		}
+		loaded = append(loaded, LoadedImage{ID: id, Name: name})
+	}
+	return loaded, nil
+}
+
+// loadManifest 导入一个manifest指向的镜像，manifest列表里选本机平台的那个
+func (s *Store) loadManifest(dir string, desc Descriptor) (string, error) {
+	content, err := readBlob(dir, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if IsIndex(desc.MediaType) {
+		var index Index
+		if err := json.Unmarshal(content, &index); err != nil {
+			return "", err
+		}
+		for _, m := range index.Manifests {
+			if MatchesHost(m.Platform) {
+				return s.loadManifest(dir, m)
+			}
+		}
+		return "", fmt.Errorf("no image for this platform in %s", desc.Digest)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("parse manifest %s error %v", desc.Digest, err)
+	}
+	config, err := readBlob(dir, manifest.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	var blobs []string
+	for _, layer := range manifest.Layers {
+		hexPart, err := DigestHex(layer.Digest)
+		if err != nil {
+			return "", err
+		}
+		blobs = append(blobs, filepath.Join(dir, "blobs", digestAlgorithm, hexPart))
+	}
+	return s.importImage(config, blobs, manifestDigests(manifest))
+}
+
+func manifestDigests(manifest Manifest) []string {
+	var digests []string
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests
+}
+
+func (s *Store) loadDockerArchive(dir string) ([]LoadedImage, error) {
+	var manifests []dockerManifest
+	if err := readJSONFile(filepath.Join(dir, dockerManifestFile), &manifests); err != nil {
+		return nil, err
+	}
+	var loaded []LoadedImage
+	for _, m := range manifests {
+		configPath := filepath.Join(dir, filepath.Clean("/"+m.Config))
+		config, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return loaded, err
+		}
+		// 配置文件名就是它的摘要：<hex>.json 或者 blobs/sha256/<hex>
+		want := digestAlgorithm + ":" + strings.TrimSuffix(filepath.Base(m.Config), ".json")
+		if got := Digest(config); got != want {
+			return loaded, fmt.Errorf("config %s digest mismatch, got %s", m.Config, got)
+		}
+		var blobs []string
+		for _, layer := range m.Layers {
+			blobs = append(blobs, filepath.Join(dir, filepath.Clean("/"+layer)))
+		}
+		// docker save的layer文件名不一定是摘要，只能校验解压后的diff_id
+		id, err := s.importImage(config, blobs, make([]string, len(blobs)))
+		if err != nil {
+			return loaded, err
+		}
+		if len(m.RepoTags) == 0 {
+			loaded = append(loaded, LoadedImage{ID: id})
+		}
+		for _, tag := range m.RepoTags {
+			if err := s.SetName(tag, id); err != nil {
+				return loaded, err
+			}
+			loaded = append(loaded, LoadedImage{ID: id, Name: tag})
+		}
+	}
+	return loaded, nil
+}
+
+// importImage 导入镜像的所有layer，校验以后保存镜像配置
+// digests是layer文件本身的摘要，为空的不校验；解压后的摘要必须等于配置里的diff_ids
+func (s *Store) importImage(config []byte, blobs, digests []string) (string, error) {
+	var img Image
+	if err := json.Unmarshal(config, &img); err != nil {
+		return "", fmt.Errorf("parse image config error %v", err)
+	}
+	if len(img.RootFS.DiffIDs) != len(blobs) {
+		return "", fmt.Errorf("image has %d layers but config lists %d diff ids", len(blobs), len(img.RootFS.DiffIDs))
+	}
+	for i, blob := range blobs {
+		if err := s.ImportLayer(blob, digests[i], img.RootFS.DiffIDs[i]); err != nil {
+			return "", err
+		}
+	}
+	return s.PutImageConfig(config)
+}
+
+// ImportLayer 导入一个可能压缩过的layer文件
+// digest是文件本身的摘要，为空时不校验；解压后的摘要必须等于diffID
+func (s *Store) ImportLayer(blob, digest, diffID string) error {
+	f, err := os.Open(blob)
+	if err != nil {
+		return fmt.Errorf("layer %s not found", diffID)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	tee := io.TeeReader(f, hash)
+	rc, err := archive.DecompressStream(tee)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	got, err := s.PutLayer(rc)
+	if err != nil {
+		return err
+	}
+	// gzip可能没有读到文件末尾，剩下的也要算进摘要
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+	if digest != "" && digestAlgorithm+":"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		return fmt.Errorf("layer %s digest mismatch", digest)
+	}
+	if got != diffID {
+		return fmt.Errorf("layer diff id mismatch, expected %s got %s", diffID, got)
+	}
+	return nil
+}
+
+// readBlob 读取layout里的blob并校验摘要
+func readBlob(dir, digest string) ([]byte, error) {
+	hexPart, err := DigestHex(digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "blobs", digestAlgorithm, hexPart))
+	if err != nil {
+		return nil, fmt.Errorf("blob %s not found", digest)
+	}
+	if got := Digest(content); got != digest {
+		return nil, fmt.Errorf("blob %s digest mismatch, got %s", digest, got)
+	}
+	return content, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(bytes.NewReader(content)).Decode(v); err != nil {
+		return fmt.Errorf("parse %s error %v", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	src := New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	id, err := src.ImportRootfs(tarDir(t, rootfs), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	var buf bytes.Buffer
+	if err := src.Save([]string{"base", id}, &buf); err != nil {
+		t.Fatalf("save error %v", err)
+	}
+
+	dst := New(t.TempDir())
+	loaded, err := dst.Load(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("load = %v, %v", loaded, err)
+	}
+	if loaded[0].ID != id || loaded[0].Name != "base:latest" || loaded[1].Name != "" {
+		t.Errorf("loaded %v, want %s named base", loaded, id)
+	}
+	if got, err := dst.Resolve("base"); err != nil || got != id {
+		t.Errorf("resolve base = %s, %v", got, err)
+	}
+}
+
+func TestLoadRejectsCorruptBlob(t *testing.T) {
+	src := New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	if _, err := src.ImportRootfs(tarDir(t, rootfs), "base", "test"); err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	var buf bytes.Buffer
+	if err := src.Save([]string{"base"}, &buf); err != nil {
+		t.Fatalf("save error %v", err)
+	}
+	// 把layer里的内容改掉，摘要就对不上了
+	corrupt := bytes.Replace(buf.Bytes(), []byte("hello"), []byte("HELLO"), -1)
+	if _, err := New(t.TempDir()).Load(bytes.NewReader(corrupt)); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("load corrupt archive error = %v", err)
+	}
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	layer := tarDir(t, rootfs).Bytes()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(layer)
+	zw.Close()
+
+	img := NewImage()
+	img.AddLayer(Digest(layer), History{CreatedBy: "test"})
+	config, _ := json.Marshal(img)
+	id := Digest(config)
+	hexPart, _ := DigestHex(id)
+	manifest, _ := json.Marshal([]dockerManifest{{
+		Config:   hexPart + ".json",
+		RepoTags: []string{"busybox:latest"},
+		Layers:   []string{"abc/layer.tar"},
+	}})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		"manifest.json":   manifest,
+		hexPart + ".json": config,
+		"abc/layer.tar":   gz.Bytes(),
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+
+	st := New(t.TempDir())
+	loaded, err := st.Load(&buf)
+	if err != nil || len(loaded) != 1 || loaded[0].ID != id {
+		t.Fatalf("load = %v, %v", loaded, err)
+	}
+	if got, err := st.Resolve("busybox:latest"); err != nil || got != id {
+		t.Errorf("resolve busybox:latest = %s, %v", got, err)
+	}
+	if !st.HasLayer(Digest(layer)) {
+		t.Errorf("layer should be stored uncompressed")
+	}
+}
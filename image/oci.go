@@ -0,0 +1,62 @@
+package image
+
+import "runtime"
+
+// OCI image-spec 和 docker镜像格式里用到的媒体类型
+const (
+	MediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// AnnotationRefName index.json里记录镜像名的注解
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// Platform 镜像适用的平台
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Descriptor 指向一个blob
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Manifest 一个镜像：配置加上各个layer
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Index 多个manifest的列表，OCI layout的index.json和多平台镜像都是这个格式
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// IsIndex 判断媒体类型是不是manifest列表
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// MatchesHost 多平台镜像里选和本机一致的那个，没写平台的也接受
+func MatchesHost(p *Platform) bool {
+	return p == nil || (p.OS == "linux" && p.Architecture == runtime.GOARCH)
+}
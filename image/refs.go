@@ -0,0 +1,132 @@
+package image
+
+import (
+	"cocin_dokcer/store"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+	{Root}/refs.json 记录每个容器用到了哪些layer，一个layer的引用计数就是用到它的容器个数
+	容器创建时在解包之前加引用，删除容器时去掉，有引用的layer不会被rmi删掉
+	引用的增删和DeleteImage都在refs.json.lock里完成，rmi和run不会交错执行
+*/
+const refsFile = "refs.json"
+
+// readRefs 读取容器名到layer列表的映射，文件不存在时返回空的映射
+func (s *Store) readRefs() (map[string][]string, error) {
+	refs := make(map[string][]string)
+	content, err := ioutil.ReadFile(filepath.Join(s.Root, refsFile))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &refs); err != nil {
+		return nil, fmt.Errorf("parse %s error %v", refsFile, err)
+	}
+	return refs, nil
+}
+
+// lockRefs 对引用计数加写锁
+func (s *Store) lockRefs() (*store.Lock, error) {
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		return nil, err
+	}
+	return store.LockFile(filepath.Join(s.Root, refsFile+".lock"), true)
+}
+
+// writeRefs 写回引用计数，调用方需持有锁
+func (s *Store) writeRefs(refs map[string][]string) error {
+	content, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(filepath.Join(s.Root, refsFile), content, 0644)
+}
+
+// updateRefs 加锁修改引用计数
+func (s *Store) updateRefs(fn func(refs map[string][]string) error) error {
+	lock, err := s.lockRefs()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return err
+	}
+	if err := fn(refs); err != nil {
+		return err
+	}
+	return s.writeRefs(refs)
+}
+
+// AddRef 记录容器用到了镜像的所有layer，layer已经被删掉时返回错误，要在LowerDirs之前调用
+func (s *Store) AddRef(containerName string, img *Image) error {
+	return s.updateRefs(func(refs map[string][]string) error {
+		for _, diffID := range img.RootFS.DiffIDs {
+			if !s.HasLayer(diffID) {
+				return fmt.Errorf("layer %s not found", diffID)
+			}
+		}
+		refs[containerName] = append([]string(nil), img.RootFS.DiffIDs...)
+		return nil
+	})
+}
+
+// ReleaseRef 删除容器之后去掉它的引用，重复调用没有影响
+// layer不在这里删除：build的中间layer只被缓存用到，没有引用也不能删
+func (s *Store) ReleaseRef(containerName string) error {
+	return s.updateRefs(func(refs map[string][]string) error {
+		delete(refs, containerName)
+		return nil
+	})
+}
+
+// PruneRefs 去掉已经不存在的容器留下的引用，exists判断容器是否还在
+func (s *Store) PruneRefs(exists func(containerName string) bool) error {
+	lock, err := s.lockRefs()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for name := range refs {
+		if !exists(name) {
+			delete(refs, name)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.writeRefs(refs)
+}
+
+// LayerRefs 每个layer的引用计数
+func (s *Store) LayerRefs() (map[string]int, error) {
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	return countRefs(refs), nil
+}
+
+func countRefs(refs map[string][]string) map[string]int {
+	counts := make(map[string]int)
+	for _, layers := range refs {
+		for _, diffID := range layers {
+			counts[diffID]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,94 @@
+package image
+
+import (
+	"cocin_dokcer/archive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentLayerDir(t *testing.T) {
+	st := New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	id, err := st.ImportRootfs(tarDir(t, rootfs), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	img, _ := st.GetImage(id)
+	diffID := img.RootFS.DiffIDs[0]
+
+	// 上次解包到一半留下的临时目录会被清掉
+	layerDir, _ := st.layerDir(diffID)
+	os.Mkdir(filepath.Join(layerDir, "."+archive.WhiteoutAufs+"-stale"), 0755)
+
+	var wg sync.WaitGroup
+	dirs := make([]string, 8)
+	errs := make([]error, 8)
+	for i := range dirs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dirs[i], errs[i] = st.LayerDir(diffID, archive.WhiteoutAufs)
+		}(i)
+	}
+	wg.Wait()
+	for i := range dirs {
+		if errs[i] != nil {
+			t.Fatalf("layer dir error %v", errs[i])
+		}
+		if dirs[i] != dirs[0] {
+			t.Errorf("got different dirs %s and %s", dirs[i], dirs[0])
+		}
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dirs[0], "hello")); string(content) != "hello" {
+		t.Errorf("unpacked content = %q", content)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(layerDir, ".*")); len(leftovers) != 0 {
+		t.Errorf("temporary dirs left behind: %v", leftovers)
+	}
+}
+
+func TestRefsProtectLayers(t *testing.T) {
+	st := New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	id, err := st.ImportRootfs(tarDir(t, rootfs), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	img, _ := st.GetImage(id)
+	diffID := img.RootFS.DiffIDs[0]
+
+	if err := st.AddRef("c1", img); err != nil {
+		t.Fatalf("add ref error %v", err)
+	}
+	st.AddRef("c2", img)
+	if counts, _ := st.LayerRefs(); counts[diffID] != 2 {
+		t.Errorf("ref count = %d, want 2", counts[diffID])
+	}
+	deleted, err := st.DeleteImage(id)
+	if err != nil {
+		t.Fatalf("delete image error %v", err)
+	}
+	if len(deleted) != 0 || !st.HasLayer(diffID) {
+		t.Errorf("layer used by containers should be kept, deleted %v", deleted)
+	}
+
+	st.ReleaseRef("c1")
+	st.ReleaseRef("c1")
+	if counts, _ := st.LayerRefs(); counts[diffID] != 1 {
+		t.Errorf("ref count after release = %d, want 1", counts[diffID])
+	}
+	st.PruneRefs(func(name string) bool { return name != "c2" })
+	if counts, _ := st.LayerRefs(); counts[diffID] != 0 {
+		t.Errorf("ref of a missing container should be pruned, count %d", counts[diffID])
+	}
+
+	st.DeleteLayer(diffID)
+	if err := st.AddRef("c3", img); err == nil {
+		t.Errorf("adding a ref to a deleted layer should fail")
+	}
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+	"cocin_dokcer/archive"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Manifest 镜像的OCI manifest，和save时写进index.json的一样，layer不压缩
+func (s *Store) Manifest(id string) (Manifest, error) {
+	config, err := s.RawConfig(id)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var img Image
+	if err := json.Unmarshal(config, &img); err != nil {
+		return Manifest{}, err
+	}
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        Descriptor{MediaType: MediaTypeConfig, Digest: id, Size: int64(len(config))},
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		size, err := s.LayerSize(diffID)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("layer %s not found", diffID)
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeLayer, Digest: diffID, Size: size})
+	}
+	return manifest, nil
+}
+
+/*
+	Squash 把镜像的所有layer合并成一层，生成一个新镜像返回它的ID，原镜像不动
+	新镜像的配置和原镜像一样，原来每一步的历史都保留下来但不再对应layer，最后加一条squash的记录
+*/
+func (s *Store) Squash(id, createdBy string) (string, error) {
+	img, err := s.GetImage(id)
+	if err != nil {
+		return "", err
+	}
+	if len(img.RootFS.DiffIDs) < 2 {
+		return "", fmt.Errorf("image %s has %d layer, nothing to squash", id, len(img.RootFS.DiffIDs))
+	}
+	var blobs []string
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !s.HasLayer(diffID) {
+			return "", fmt.Errorf("layer %s not found", diffID)
+		}
+		blob, _ := s.LayerBlob(diffID)
+		blobs = append(blobs, blob)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive.MergeLayers(blobs, writer))
+	}()
+	diffID, err := s.PutLayer(reader)
+	reader.Close()
+	if err != nil {
+		return "", fmt.Errorf("squash layers error %v", err)
+	}
+
+	squashed := img.Child()
+	squashed.RootFS.DiffIDs = nil
+	for i := range squashed.History {
+		squashed.History[i].EmptyLayer = true
+	}
+	squashed.AddLayer(diffID, History{Created: time.Now().UTC(), CreatedBy: createdBy, Comment: "squashed from " + id})
+	return s.CreateImage(squashed)
+}
@@ -0,0 +1,92 @@
+package image
+
+import (
+	"bytes"
+	"cocin_dokcer/archive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	st := New(t.TempDir())
+	base := t.TempDir()
+	ioutil.WriteFile(filepath.Join(base, "hello"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "old"), []byte("old"), 0644)
+	os.Mkdir(filepath.Join(base, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "dir", "a"), []byte("a"), 0644)
+	id, err := st.ImportRootfs(tarDir(t, base), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+
+	// 第二层删掉old，改写hello，dir变成不透明目录
+	upper := t.TempDir()
+	ioutil.WriteFile(filepath.Join(upper, archive.WhiteoutPrefix+"old"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "hello"), []byte("world"), 0644)
+	os.Mkdir(filepath.Join(upper, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "dir", archive.WhiteoutOpaqueDir), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "dir", "b"), []byte("b"), 0644)
+	var layer bytes.Buffer
+	if err := archive.TarLayer(upper, &layer); err != nil {
+		t.Fatalf("tar layer error %v", err)
+	}
+	diffID, err := st.PutLayer(&layer)
+	if err != nil {
+		t.Fatalf("put layer error %v", err)
+	}
+	parent, _ := st.GetImage(id)
+	child := parent.Child()
+	child.Config.Cmd = []string{"/bin/sh"}
+	child.AddLayer(diffID, History{CreatedBy: "commit"})
+	childID, err := st.CreateImage(child)
+	if err != nil {
+		t.Fatalf("create image error %v", err)
+	}
+
+	squashedID, err := st.Squash(childID, "squash")
+	if err != nil {
+		t.Fatalf("squash error %v", err)
+	}
+	squashed, err := st.GetImage(squashedID)
+	if err != nil {
+		t.Fatalf("get image error %v", err)
+	}
+	if len(squashed.RootFS.DiffIDs) != 1 || len(squashed.History) != 3 || squashed.History[2].EmptyLayer {
+		t.Fatalf("squashed image = %+v", squashed)
+	}
+	if len(squashed.Config.Cmd) != 1 || squashed.Config.Cmd[0] != "/bin/sh" {
+		t.Errorf("config should be kept, got %+v", squashed.Config)
+	}
+	if _, err := st.Squash(squashedID, "squash"); err == nil {
+		t.Errorf("an image with one layer should not be squashed again")
+	}
+
+	blob, _ := st.LayerBlob(squashed.RootFS.DiffIDs[0])
+	f, err := os.Open(blob)
+	if err != nil {
+		t.Fatalf("open layer error %v", err)
+	}
+	defer f.Close()
+	rootfs := t.TempDir()
+	if err := archive.Untar(f, rootfs); err != nil {
+		t.Fatalf("untar squashed layer error %v", err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(rootfs, "hello")); string(content) != "world" {
+		t.Errorf("hello = %q, want the upper content", content)
+	}
+	for _, name := range []string{"old", "dir/a", archive.WhiteoutPrefix + "old", "dir/" + archive.WhiteoutOpaqueDir} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be in the squashed layer, %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "dir", "b")); err != nil {
+		t.Errorf("dir/b should be in the squashed layer, %v", err)
+	}
+
+	manifest, err := st.Manifest(squashedID)
+	if err != nil || len(manifest.Layers) != 1 || manifest.Config.Digest != squashedID {
+		t.Errorf("manifest = %+v, %v", manifest, err)
+	}
+}
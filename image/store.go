@@ -0,0 +1,511 @@
+package image
+
+import (
+	"cocin_dokcer/archive"
+	"cocin_dokcer/reference"
+	"cocin_dokcer/store"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Store 按内容寻址的镜像存储，目录结构：
+	{Root}/layers/sha256/<hex>/layer.tar    layer的原始内容，不压缩，摘要就是它的sha256
+	{Root}/layers/sha256/<hex>/<format>/    按存储驱动的whiteout格式解包出来的目录，用作联合挂载的只读层
+	{Root}/imagedb/sha256/<hex>             镜像配置，镜像ID是它的sha256
+	{Root}/repositories.json                镜像名(repository:tag)到镜像ID的映射
+	{Root}/buildcache/<hex>                 build每一步的缓存
+	{Root}/refs.json                        每个容器用到的layer，也就是layer的引用计数
+	{Root}/.locks/layer-<hex>.lock          解包和删除layer时加的锁
+*/
+type Store struct {
+	Root string
+}
+
+const (
+	layerBlobName = "layer.tar"
+	namesFile     = "repositories.json"
+)
+
+func New(root string) *Store {
+	return &Store{Root: root}
+}
+
+func (s *Store) layerDir(digest string) (string, error) {
+	hexPart, err := DigestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "layers", digestAlgorithm, hexPart), nil
+}
+
+func (s *Store) imagePath(id string) (string, error) {
+	hexPart, err := DigestHex(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "imagedb", digestAlgorithm, hexPart), nil
+}
+
+// LayerBlob 返回layer原始tar的路径
+func (s *Store) LayerBlob(digest string) (string, error) {
+	dir, err := s.layerDir(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, layerBlobName), nil
+}
+
+// HasLayer 判断layer是否已经存在
+func (s *Store) HasLayer(digest string) bool {
+	blob, err := s.LayerBlob(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(blob)
+	return err == nil
+}
+
+/*
+	PutLayer 把一个未压缩的layer tar流存进来，返回它的摘要
+	边写临时文件边算sha256，写完再rename到以摘要命名的目录，相同内容的layer只存一份
+*/
+func (s *Store) PutLayer(r io.Reader) (string, error) {
+	tmpRoot := filepath.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(tmpRoot, "layer-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write layer error %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	digest := digestAlgorithm + ":" + hex.EncodeToString(hash.Sum(nil))
+	if s.HasLayer(digest) {
+		return digest, nil
+	}
+	dir, _ := s.layerDir(digest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, layerBlobName)); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// LayerSize layer原始tar的大小
+func (s *Store) LayerSize(digest string) (int64, error) {
+	blob, err := s.LayerBlob(digest)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(blob)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+/*
+	LayerDir 返回按format解包好的layer目录，第一次用到时才解包
+	同时启动的多个容器在layer锁里排队，只有第一个真正解包，后面的直接用它的结果
+	先解到临时目录再rename，解包失败或者进程中途退出都不会留下只有一半内容的目录
+*/
+func (s *Store) LayerDir(digest, format string) (string, error) {
+	dir, err := s.layerDir(digest)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, format)
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+	lock, err := s.lockLayer(digest)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	// 等锁的时候别的进程可能已经解包好了
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+	blob, err := os.Open(filepath.Join(dir, layerBlobName))
+	if err != nil {
+		return "", fmt.Errorf("layer %s not found", digest)
+	}
+	defer blob.Close()
+	// 之前解包到一半就退出的进程留下的临时目录
+	if leftovers, err := filepath.Glob(filepath.Join(dir, "."+format+"-*")); err == nil {
+		for _, leftover := range leftovers {
+			os.RemoveAll(leftover)
+		}
+	}
+	tmp, err := ioutil.TempDir(dir, "."+format+"-")
+	if err != nil {
+		return "", err
+	}
+	if err := archive.UntarLayer(blob, tmp, format); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("unpack layer %s error %v", digest, err)
+	}
+	os.Chmod(tmp, 0755)
+	if err := os.Rename(tmp, target); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return target, nil
+}
+
+// lockLayer 对一个layer加写锁，解包和删除layer都要先拿到它
+// 锁文件放在layer目录外面，删除layer目录不会把锁一起删掉
+func (s *Store) lockLayer(digest string) (*store.Lock, error) {
+	hexPart, err := DigestHex(digest)
+	if err != nil {
+		return nil, err
+	}
+	return store.LockFile(filepath.Join(s.Root, ".locks", "layer-"+hexPart+".lock"), true)
+}
+
+// LowerDirs 镜像所有layer解包后的目录，按联合挂载的要求从最上层开始排列
+func (s *Store) LowerDirs(img *Image, format string) ([]string, error) {
+	if len(img.RootFS.DiffIDs) == 0 {
+		return nil, fmt.Errorf("image has no layers")
+	}
+	var dirs []string
+	for i := len(img.RootFS.DiffIDs) - 1; i >= 0; i-- {
+		dir, err := s.LayerDir(img.RootFS.DiffIDs[i], format)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// CreateImage 保存镜像配置，返回镜像ID，所有layer必须已经存在
+func (s *Store) CreateImage(img *Image) (string, error) {
+	content, err := json.Marshal(img)
+	if err != nil {
+		return "", err
+	}
+	return s.PutImageConfig(content)
+}
+
+// PutImageConfig 原样保存别处来的镜像配置，这样镜像ID和来源处一致
+func (s *Store) PutImageConfig(content []byte) (string, error) {
+	var img Image
+	if err := json.Unmarshal(content, &img); err != nil {
+		return "", fmt.Errorf("parse image config error %v", err)
+	}
+	for _, diffID := range img.RootFS.DiffIDs {
+		if !s.HasLayer(diffID) {
+			return "", fmt.Errorf("layer %s not found", diffID)
+		}
+	}
+	id := Digest(content)
+	path, _ := s.imagePath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := store.WriteFileAtomic(path, content, 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RawConfig 读取镜像配置的原始内容，它的摘要就是镜像ID
+func (s *Store) RawConfig(id string) ([]byte, error) {
+	path, err := s.imagePath(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image %s not found", id)
+		}
+		return nil, err
+	}
+	return content, nil
+}
+
+// GetImage 读取镜像配置
+func (s *Store) GetImage(id string) (*Image, error) {
+	content, err := s.RawConfig(id)
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	if err := json.Unmarshal(content, &img); err != nil {
+		return nil, fmt.Errorf("parse image %s error %v", id, err)
+	}
+	return &img, nil
+}
+
+// Names 所有镜像名到镜像ID的映射
+func (s *Store) Names() (map[string]string, error) {
+	names := make(map[string]string)
+	content, err := ioutil.ReadFile(filepath.Join(s.Root, namesFile))
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s error %v", namesFile, err)
+	}
+	// 以前保存的名字没有tag，读出来统一补上
+	for name, id := range raw {
+		if normalized, err := NormalizeName(name); err == nil {
+			name = normalized
+		}
+		names[name] = id
+	}
+	return names, nil
+}
+
+// NormalizeName 镜像名统一写成 repository:tag 的简写形式，没写tag时是latest，不能带digest
+func NormalizeName(name string) (string, error) {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", fmt.Errorf("image name %s must not contain a digest", name)
+	}
+	return ref.WithDefaultTag().Familiar(), nil
+}
+
+// updateNames 加锁修改镜像名的映射
+func (s *Store) updateNames(fn func(names map[string]string) error) error {
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		return err
+	}
+	lock, err := store.LockFile(filepath.Join(s.Root, namesFile+".lock"), true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	names, err := s.Names()
+	if err != nil {
+		return err
+	}
+	if err := fn(names); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(filepath.Join(s.Root, namesFile), content, 0644)
+}
+
+// SetName 让镜像名指向镜像ID，原来指向别的镜像的会被覆盖
+func (s *Store) SetName(name, id string) error {
+	name, err := NormalizeName(name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.GetImage(id); err != nil {
+		return err
+	}
+	return s.updateNames(func(names map[string]string) error {
+		names[name] = id
+		return nil
+	})
+}
+
+// LookupName 按镜像名找镜像ID，busybox和busybox:latest是同一个名字
+func (s *Store) LookupName(name string) (string, bool, error) {
+	names, err := s.Names()
+	if err != nil {
+		return "", false, err
+	}
+	normalized, err := NormalizeName(name)
+	if err != nil {
+		return "", false, nil
+	}
+	id, ok := names[normalized]
+	return id, ok, nil
+}
+
+// Resolve 把镜像名、完整ID或者ID前缀解析成镜像ID，同时能当成名字和ID前缀时名字优先
+func (s *Store) Resolve(nameOrID string) (string, error) {
+	id, ok, err := s.LookupName(nameOrID)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return id, nil
+	}
+	prefix := strings.TrimPrefix(nameOrID, digestAlgorithm+":")
+	if len(prefix) == 0 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("image %s not found", nameOrID)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(s.Root, "imagedb", digestAlgorithm))
+	var found string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			if found != "" {
+				return "", fmt.Errorf("image id prefix %s is ambiguous", prefix)
+			}
+			found = digestAlgorithm + ":" + entry.Name()
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("image %s not found", nameOrID)
+	}
+	return found, nil
+}
+
+// Images 所有镜像的ID
+func (s *Store) Images() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Root, "imagedb", digestAlgorithm))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if validHex.MatchString(entry.Name()) {
+			ids = append(ids, digestAlgorithm+":"+entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Size 镜像所有layer的大小之和
+func (s *Store) Size(img *Image) int64 {
+	var size int64
+	for _, diffID := range img.RootFS.DiffIDs {
+		if n, err := s.LayerSize(diffID); err == nil {
+			size += n
+		}
+	}
+	return size
+}
+
+// RemoveName 删除一个镜像名，镜像本身不动
+func (s *Store) RemoveName(name string) error {
+	name, err := NormalizeName(name)
+	if err != nil {
+		return err
+	}
+	return s.updateNames(func(names map[string]string) error {
+		if _, ok := names[name]; !ok {
+			return fmt.Errorf("image name %s not found", name)
+		}
+		delete(names, name)
+		return nil
+	})
+}
+
+/*
+	DeleteImage 删除镜像配置和指向它的所有镜像名
+	镜像的layer如果没有被别的镜像用到、也没有容器在用，一起删除，返回被删除的layer
+	整个过程持有引用计数的锁，正在启动的容器要么已经加上了引用，要么会发现layer不在了
+*/
+func (s *Store) DeleteImage(id string) ([]string, error) {
+	lock, err := s.lockRefs()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.GetImage(id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.updateNames(func(names map[string]string) error {
+		for name, target := range names {
+			if target == id {
+				delete(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	path, _ := s.imagePath(id)
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	used, err := s.usedLayers()
+	if err != nil {
+		return nil, err
+	}
+	counts := countRefs(refs)
+	var deleted []string
+	for _, diffID := range img.RootFS.DiffIDs {
+		if used[diffID] || counts[diffID] > 0 {
+			continue
+		}
+		if err := s.DeleteLayer(diffID); err != nil {
+			return deleted, err
+		}
+		used[diffID] = true
+		deleted = append(deleted, diffID)
+	}
+	return deleted, nil
+}
+
+// usedLayers 现有镜像用到的所有layer
+func (s *Store) usedLayers() (map[string]bool, error) {
+	ids, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, id := range ids {
+		img, err := s.GetImage(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, diffID := range img.RootFS.DiffIDs {
+			used[diffID] = true
+		}
+	}
+	return used, nil
+}
+
+// DeleteLayer 删除layer的原始内容和所有解包出来的目录，正在解包的layer等解包结束再删
+func (s *Store) DeleteLayer(digest string) error {
+	dir, err := s.layerDir(digest)
+	if err != nil {
+		return err
+	}
+	lock, err := s.lockLayer(digest)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return os.RemoveAll(dir)
+}
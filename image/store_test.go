@@ -0,0 +1,124 @@
+package image
+
+import (
+	"bytes"
+	"cocin_dokcer/archive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tarDir(t *testing.T, dir string) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := archive.Tar(dir, &buf); err != nil {
+		t.Fatalf("tar %s error %v", dir, err)
+	}
+	return &buf
+}
+
+func TestLayeredImage(t *testing.T) {
+	st := New(t.TempDir())
+	base := t.TempDir()
+	ioutil.WriteFile(filepath.Join(base, "hello"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "old"), []byte("old"), 0644)
+	id, err := st.ImportRootfs(tarDir(t, base), "base", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+
+	// 第二层删掉old，新增new
+	upper := t.TempDir()
+	ioutil.WriteFile(filepath.Join(upper, archive.WhiteoutPrefix+"old"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(upper, "new"), []byte("new"), 0644)
+	var layer bytes.Buffer
+	if err := archive.TarLayer(upper, &layer); err != nil {
+		t.Fatalf("tar layer error %v", err)
+	}
+	diffID, err := st.PutLayer(&layer)
+	if err != nil {
+		t.Fatalf("put layer error %v", err)
+	}
+	parent, err := st.GetImage(id)
+	if err != nil {
+		t.Fatalf("get image error %v", err)
+	}
+	child := parent.Child()
+	child.AddLayer(diffID, History{CreatedBy: "commit"})
+	childID, err := st.CreateImage(child)
+	if err != nil || childID == id {
+		t.Fatalf("create child image error %v", err)
+	}
+	if len(parent.RootFS.DiffIDs) != 1 {
+		t.Errorf("parent image should not be changed by Child")
+	}
+
+	dirs, err := st.LowerDirs(child, archive.WhiteoutAufs)
+	if err != nil || len(dirs) != 2 {
+		t.Fatalf("lower dirs = %v, %v", dirs, err)
+	}
+	if _, err := os.Stat(filepath.Join(dirs[0], archive.WhiteoutPrefix+"old")); err != nil {
+		t.Errorf("top layer should keep the aufs whiteout, %v", err)
+	}
+	if _, ok := archive.LookupLower(dirs, "old"); ok {
+		t.Errorf("old should be hidden by the whiteout")
+	}
+	if _, ok := archive.LookupLower(dirs, "hello"); !ok {
+		t.Errorf("hello should be visible from the base layer")
+	}
+
+	if err := st.SetName("child", childID); err != nil {
+		t.Fatalf("set name error %v", err)
+	}
+	if got, err := st.Resolve("child"); err != nil || got != childID {
+		t.Errorf("resolve child = %s, %v", got, err)
+	}
+	if got, err := st.Resolve(childID[len("sha256:") : len("sha256:")+12]); err != nil || got != childID {
+		t.Errorf("resolve id prefix = %s, %v", got, err)
+	}
+}
+
+func TestPutLayerDeduplicates(t *testing.T) {
+	st := New(t.TempDir())
+	a, err := st.PutLayer(bytes.NewReader([]byte("same")))
+	if err != nil {
+		t.Fatalf("put layer error %v", err)
+	}
+	b, err := st.PutLayer(bytes.NewReader([]byte("same")))
+	if err != nil || a != b {
+		t.Errorf("same content should give the same digest, %s %s %v", a, b, err)
+	}
+	if _, err := DigestHex("sha256:../../etc"); err == nil {
+		t.Errorf("invalid digest should be rejected")
+	}
+}
+
+func TestNames(t *testing.T) {
+	st := New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), []byte("hello"), 0644)
+	id, err := st.ImportRootfs(tarDir(t, rootfs), "ubuntu", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	if err := st.SetName("localhost:5000/team/ubuntu:22.04", id); err != nil {
+		t.Fatalf("set name error %v", err)
+	}
+	for _, name := range []string{"ubuntu", "ubuntu:latest", "docker.io/library/ubuntu", "localhost:5000/team/ubuntu:22.04"} {
+		if got, err := st.Resolve(name); err != nil || got != id {
+			t.Errorf("resolve %s = %s, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"../etc", "Ubuntu", "ubuntu@sha256:" + strings.Repeat("a", 64)} {
+		if err := st.SetName(name, id); err == nil {
+			t.Errorf("set name %q should fail", name)
+		}
+	}
+	if _, ok := LegacyName("team/ubuntu"); ok {
+		t.Errorf("names with a namespace have no legacy image")
+	}
+	if name, ok := LegacyName("busybox:latest"); !ok || name != "busybox" {
+		t.Errorf("legacy name = %s, %v", name, ok)
+	}
+}
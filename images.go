@@ -0,0 +1,155 @@
+package main
+
+import (
+	"cocin_dokcer/container"
+	"cocin_dokcer/image"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ListImages 列出镜像存储里的所有镜像，没有名字的镜像显示成<none>
+func (eng *engine) ListImages() {
+	images := eng.newImageStore()
+	ids, err := images.Images()
+	if err != nil {
+		log.Errorf("List images error %v", err)
+		return
+	}
+	names, err := images.Names()
+	if err != nil {
+		log.Errorf("List image names error %v", err)
+		return
+	}
+	// 镜像ID -> 镜像名
+	named := make(map[string][]string)
+	for name, id := range names {
+		named[id] = append(named[id], name)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+	for _, id := range ids {
+		img, err := images.GetImage(id)
+		if err != nil {
+			log.Warnf("Get image %s error %v", id, err)
+			continue
+		}
+		imageNames := named[id]
+		if len(imageNames) == 0 {
+			imageNames = []string{"<none>:<none>"}
+		}
+		sort.Strings(imageNames)
+		for _, name := range imageNames {
+			repository, tag := splitImageName(name)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				repository,
+				tag,
+				shortImageID(id),
+				img.Created.Local().Format("2006-01-02 15:04:05"),
+				humanSize(images.Size(img)))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+}
+
+// splitImageName 把 repository:tag 拆开，仓库地址里的端口号不算tag
+func splitImageName(name string) (string, string) {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+	return name, "<none>"
+}
+
+// shortImageID 展示用的短镜像ID
+func shortImageID(id string) string {
+	return container.ShortID(strings.TrimPrefix(id, "sha256:"))
+}
+
+// humanSize 把字节数转换成 1.5MB 这样的形式
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
+
+/*
+	removeImage 删除镜像
+	1. 参数是镜像名并且还有别的名字(包括同一个仓库的其他tag)指向同一个镜像时，只删除这个名字
+	2. 还有容器(包括已经停止的)在用这个镜像时拒绝删除
+	3. 删除镜像配置，没有被别的镜像用到的layer也一起删掉
+*/
+func (eng *engine) removeImage(nameOrID string) error {
+	images := eng.newImageStore()
+	id, err := images.Resolve(nameOrID)
+	if err != nil {
+		return err
+	}
+	names, err := images.Names()
+	if err != nil {
+		return err
+	}
+	if name, err := image.NormalizeName(nameOrID); err == nil && names[name] == id {
+		for other, otherID := range names {
+			if other != name && otherID == id {
+				if err := images.RemoveName(name); err != nil {
+					return err
+				}
+				fmt.Printf("Untagged: %s\n", name)
+				return nil
+			}
+		}
+	}
+	if err := eng.checkImageUnused(id, names); err != nil {
+		return err
+	}
+	deleted, err := images.DeleteImage(id)
+	for _, layer := range deleted {
+		fmt.Printf("Deleted: %s\n", layer)
+	}
+	if err != nil {
+		return fmt.Errorf("remove image %s error %v", nameOrID, err)
+	}
+	fmt.Printf("Deleted: %s\n", id)
+	return nil
+}
+
+// checkImageUnused 镜像被容器用着时返回错误，早期的容器只记录了镜像名
+func (eng *engine) checkImageUnused(id string, names map[string]string) error {
+	containers, err := eng.newStateStore().ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, info := range containers {
+		if info.ImageID == id {
+			return fmt.Errorf("image %s is being used by container %s", shortImageID(id), info.Name)
+		}
+		if name, err := image.NormalizeName(info.ImageName); err == nil && info.ImageID == "" && names[name] == id {
+			return fmt.Errorf("image %s is being used by container %s", shortImageID(id), info.Name)
+		}
+	}
+	return nil
+}
+
+// tagImage 给镜像起一个新名字，target已经指向别的镜像时改为指向source
+func (eng *engine) tagImage(source, target string) error {
+	images := eng.newImageStore()
+	id, err := images.Resolve(source)
+	if err != nil {
+		return err
+	}
+	return images.SetName(target, id)
+}
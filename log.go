@@ -1,17 +1,15 @@
 package main
 
 import (
-	"cocin_dokcer/container"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 )
 
-func logContainer(containerName string) {
+func (eng *engine) logContainer(containerName string) {
 	// 找到对应文件夹的位置
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	logFileLocation := dirURL + container.ContainerLogFile
+	logFileLocation := eng.containerPaths().LogFile(containerName)
 	// 打开日志文件
 	file, err := os.Open(logFileLocation)
 	defer file.Close()
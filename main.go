@@ -1,9 +1,17 @@
 package main
 
 import (
+	"cocin_dokcer/config"
+	"cocin_dokcer/container"
+	"cocin_dokcer/events"
+	"cocin_dokcer/image"
+	"cocin_dokcer/network"
+	"cocin_dokcer/storage"
+	"cocin_dokcer/store"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"os"
+	"path/filepath"
 )
 
 const usage = `cocin_docker is a simple container runtime implementation.`
@@ -13,23 +21,78 @@ func main() {
 	app.Name = "cocin_docker"
 	app.Usage = usage
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "config file with root, exec-root and storage-driver",
+			Value: config.DefaultFile,
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "root directory of images, write layers and mount points, overrides $" + config.EnvRoot + " (default " + container.DefaultRoot + ")",
+		},
+		cli.StringFlag{
+			Name:  "exec-root",
+			Usage: "root directory of container, network and event state, overrides $" + config.EnvExecRoot + " (default " + container.DefaultExecRoot + ")",
+		},
+		cli.StringFlag{
+			Name:  "storage-driver",
+			Usage: "storage driver for new containers (overlay, aufs, vfs), overrides $" + config.EnvStorageDriver + ", detected automatically by default",
+		},
+	}
+
 	// 定义基本命令
 	app.Commands = []cli.Command{
 		initCommand,
 		runCommand,
 		commitCommand,
+		buildCommand,
+		exportCommand,
+		importCommand,
+		saveCommand,
+		loadCommand,
+		pullCommand,
+		pushCommand,
+		cpCommand,
+		diffCommand,
+		imagesCommand,
+		imageCommand,
+		tagCommand,
+		removeImageCommand,
 		listCommand,
 		logCommand,
 		execCommand,
 		stopCommand,
 		removeCommand,
 		networkCommand,
+		systemCommand,
+		eventsCommand,
+		createCommand,
+		startCommand,
+		stateCommand,
+		killCommand,
+		deleteCommand,
 	}
 
 	// 初始化日志配置，失败不会执行命令
 	app.Before = func(context *cli.Context) error {
 		log.SetFormatter(&log.JSONFormatter{})
 		log.SetOutput(os.Stdout)
+		// export、save和cp会把tar写到标准输出，image inspect输出json，日志不能混进去
+		if writesToStdout(context.Args()) {
+			log.SetOutput(os.Stderr)
+		}
+		eng, err := loadEngine(context)
+		if err != nil {
+			return err
+		}
+		context.App.Metadata = map[string]interface{}{engineKey: eng}
+		// 每个命令执行前先修复一次状态，清理崩溃或重启留下的容器
+		if needReconcile(context.Args().First()) {
+			if err := eng.reconcileContainers(eng.newStateStore()); err != nil {
+				log.Warnf("Reconcile containers error %v", err)
+			}
+		}
 		return nil
 	}
 
@@ -37,3 +100,88 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// writesToStdout 判断命令是不是要把数据写到标准输出
+func writesToStdout(args cli.Args) bool {
+	switch args.First() {
+	case "export", "save":
+		return true
+	case "cp":
+		return args.Get(2) == "-"
+	case "image":
+		return args.Get(1) == "inspect"
+	}
+	return false
+}
+
+// newStateStore 返回管理容器、网络和IPAM状态的store
+func (eng *engine) newStateStore() *store.Store {
+	return store.New(eng.config.ExecRoot)
+}
+
+// newNetworkManager 返回管理网络和IPAM的Manager，网络状态和容器状态在同一个store里
+func (eng *engine) newNetworkManager() (*network.Manager, error) {
+	return network.NewManager(eng.newStateStore())
+}
+
+// newStorageDriver 新建容器时使用的存储驱动，没有用--storage-driver指定时自动选择宿主机支持的
+func (eng *engine) newStorageDriver() (storage.Driver, error) {
+	return storage.New(eng.config.StorageDriver, eng.containerPaths().WriteLayerRoot())
+}
+
+// containerStorageDriver 容器创建时使用的存储驱动，早期的容器没有记录驱动，都是aufs
+func (eng *engine) containerStorageDriver(info *container.ContainerInfo) (storage.Driver, error) {
+	name := info.StorageDriver
+	if name == "" {
+		name = storage.Aufs
+	}
+	return storage.New(name, eng.containerPaths().WriteLayerRoot())
+}
+
+// newImageStore 返回按内容寻址的镜像存储
+func (eng *engine) newImageStore() *image.Store {
+	return image.New(eng.containerPaths().ImageRoot())
+}
+
+// resolveImage 按镜像名或ID找到镜像，镜像存储里没有时尝试导入存储根目录下以前的扁平镜像
+func (eng *engine) resolveImage(images *image.Store, nameOrID string) (string, *image.Image, error) {
+	id, err := images.Resolve(nameOrID)
+	if err != nil {
+		if id, err = images.ImportLegacy(nameOrID, eng.config.Root); err != nil {
+			return "", nil, err
+		}
+	}
+	img, err := images.GetImage(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, img, nil
+}
+
+// containerLowerDirs 容器的只读层，早期的容器没有记录，只读层就是解包好的镜像目录
+func (eng *engine) containerLowerDirs(info *container.ContainerInfo) []string {
+	if len(info.LowerDirs) > 0 {
+		return info.LowerDirs
+	}
+	if name, ok := image.LegacyName(info.ImageName); ok {
+		return []string{filepath.Join(eng.config.Root, name)}
+	}
+	return nil
+}
+
+// newJournal 返回记录生命周期事件的日志
+func (eng *engine) newJournal() *events.Journal {
+	return events.NewJournal(eng.config.ExecRoot)
+}
+
+// containerAttributes 容器事件里附带的属性
+func containerAttributes(info *container.ContainerInfo) map[string]string {
+	attributes := map[string]string{"name": info.Name}
+	if info.ImageName != "" {
+		attributes["image"] = info.ImageName
+	}
+	if info.Rootfs != "" {
+		attributes["rootfs"] = info.Rootfs
+	}
+	return attributes
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"cocin_dokcer/Cgroups/subsystems"
 	"cocin_dokcer/container"
-	"cocin_dokcer/network"
+	"cocin_dokcer/events"
+	"cocin_dokcer/storage"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"os"
+	"strings"
+	"time"
 )
 
 // run命令
@@ -55,6 +58,18 @@ var runCommand = cli.Command{
 			Name:  "p",
 			Usage: "port mapping",
 		},
+		cli.StringFlag{
+			Name:  "hooks",
+			Usage: "json file of OCI hooks (prestart, createRuntime, poststart, poststop)",
+		},
+		cli.StringSliceFlag{
+			Name:  "storage-opt",
+			Usage: "storage driver options, size=10G limits the size of the write layer",
+		},
+		cli.StringFlag{
+			Name:  "rootfs",
+			Usage: "use a host directory as the read-only rootfs instead of an image, all arguments are the command",
+		},
 	},
 	/* 这里是run命令执行的真正函数
 	1. 判断参数是否包含command
@@ -62,8 +77,12 @@ var runCommand = cli.Command{
 	3. 调用Run function 去准备启动容器
 	*/
 	Action: func(context *cli.Context) error {
+		rootfs := context.String("rootfs")
 		if len(context.Args()) < 1 {
-			return fmt.Errorf("Missing container command")
+			if rootfs != "" {
+				return fmt.Errorf("Missing container command")
+			}
+			return fmt.Errorf("Missing image name")
 		}
 		var cmdArray []string
 		for _, arg := range context.Args() {
@@ -88,11 +107,27 @@ var runCommand = cli.Command{
 		network := context.String("net")
 		portmapping := context.StringSlice("p")
 
-		// imageName作为第一个参数输入
-		imageName := cmdArray[0]
-		cmdArray = cmdArray[1:]
-		Run(tty, cmdArray, resConf, volume, containerName, imageName, envSlice, network, portmapping)
-		return nil
+		// hook配置随容器一起保存，poststop在容器删除时还要用到
+		var hooks *container.Hooks
+		if hooksFile := context.String("hooks"); hooksFile != "" {
+			var err error
+			if hooks, err = container.LoadHooks(hooksFile); err != nil {
+				return err
+			}
+		}
+
+		storageSize, err := storage.ParseStorageOpts(context.StringSlice("storage-opt"))
+		if err != nil {
+			return err
+		}
+
+		// imageName作为第一个参数输入，后面没有命令时用镜像的默认命令；用--rootfs时没有镜像，参数全是命令
+		var imageName string
+		if rootfs == "" {
+			imageName = cmdArray[0]
+			cmdArray = cmdArray[1:]
+		}
+		return engineFrom(context).Run(tty, cmdArray, resConf, volume, containerName, imageName, rootfs, envSlice, network, portmapping, hooks, storageSize)
 	},
 }
 
@@ -113,15 +148,296 @@ var initCommand = cli.Command{
 
 // commit命令
 var commitCommand = cli.Command{
-	Name:  "commit",
-	Usage: "commit a container into image",
+	Name:      "commit",
+	Usage:     "commit a container into image",
+	ArgsUsage: "<container> <image>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "author, a",
+			Usage: "author of the new image",
+		},
+		cli.StringFlag{
+			Name:  "message, m",
+			Usage: "commit message",
+		},
+		cli.StringSliceFlag{
+			Name:  "change, c",
+			Usage: "apply a Containerfile instruction (CMD, ENTRYPOINT, ENV, EXPOSE, LABEL, USER, WORKDIR) to the image config",
+		},
+		cli.BoolTFlag{
+			Name:  "pause, p",
+			Usage: "pause the container while committing (default true)",
+		},
+	},
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 2 {
 			return fmt.Errorf("Missing image name")
 		}
 		containerName := context.Args().Get(0)
 		imageName := context.Args().Get(1)
-		commitContainer(containerName, imageName)
+		id, err := engineFrom(context).commitContainer(containerName, imageName, commitOptions{
+			Author:  context.String("author"),
+			Message: context.String("message"),
+			Changes: context.StringSlice("change"),
+			Pause:   context.BoolT("pause"),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	},
+}
+
+// export命令
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export a container's filesystem as a tar archive",
+	ArgsUsage: "<container>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o",
+			Usage: "write to a file instead of stdout",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return engineFrom(context).exportContainer(context.Args().Get(0), context.String("o"))
+	},
+}
+
+// import命令
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "import a rootfs tarball as an image, use - to read from stdin",
+	ArgsUsage: "<file|-> <image>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("Missing file or image name")
+		}
+		return engineFrom(context).importImage(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+var registryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "creds",
+		Usage: "registry credentials as user:password",
+	},
+	cli.BoolFlag{
+		Name:  "insecure",
+		Usage: "use plain http to talk to the registry",
+	},
+}
+
+// pull命令
+var pullCommand = cli.Command{
+	Name:      "pull",
+	Usage:     "pull an image from a registry",
+	ArgsUsage: "<[registry/]repository[:tag|@digest]>",
+	Flags:     registryFlags,
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		return engineFrom(context).pullImage(context.Args().Get(0), context.String("creds"), context.Bool("insecure"))
+	},
+}
+
+// push命令
+var pushCommand = cli.Command{
+	Name:      "push",
+	Usage:     "push an image to the registry in its name",
+	ArgsUsage: "<[registry/]repository[:tag]>",
+	Flags:     registryFlags,
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		return engineFrom(context).pushImage(context.Args().Get(0), context.String("creds"), context.Bool("insecure"))
+	},
+}
+
+// build命令
+var buildCommand = cli.Command{
+	Name:      "build",
+	Usage:     "build an image from a Containerfile",
+	ArgsUsage: "<context>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "f",
+			Usage: "path of the Containerfile, default <context>/Containerfile or <context>/Dockerfile",
+		},
+		cli.StringSliceFlag{
+			Name:  "t",
+			Usage: "name of the built image, can be given more than once",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "do not use the build cache",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing build context")
+		}
+		return engineFrom(context).buildImage(context.Args().Get(0), context.String("f"), context.StringSlice("t"), context.Bool("no-cache"))
+	},
+}
+
+// tag命令
+var tagCommand = cli.Command{
+	Name:      "tag",
+	Usage:     "create a name that refers to an image, the default tag is latest",
+	ArgsUsage: "<source image> <[registry/]repository[:tag]>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("Missing source or target image name")
+		}
+		return engineFrom(context).tagImage(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// save命令
+var saveCommand = cli.Command{
+	Name:      "save",
+	Usage:     "save images to a tar archive in OCI image layout",
+	ArgsUsage: "<image> [image...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o",
+			Usage: "write to a file instead of stdout",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		return engineFrom(context).saveImages(context.Args(), context.String("o"))
+	},
+}
+
+// load命令
+var loadCommand = cli.Command{
+	Name:  "load",
+	Usage: "load images from an OCI image layout or docker save archive",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "i",
+			Usage: "read from a file instead of stdin",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return engineFrom(context).loadImages(context.String("i"))
+	},
+}
+
+// cp命令
+var cpCommand = cli.Command{
+	Name:      "cp",
+	Usage:     "copy files between a container and the host, use - for a tar stream on stdin/stdout",
+	ArgsUsage: "<container>:<path> <hostpath|->  or  <hostpath|-> <container>:<path>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("Missing source or destination")
+		}
+		return engineFrom(context).copyFiles(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// diff命令
+var diffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "list files added (A), changed (C) and deleted (D) in a container",
+	ArgsUsage: "<container>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return engineFrom(context).diffContainer(context.Args().Get(0))
+	},
+}
+
+// images命令
+var imagesCommand = cli.Command{
+	Name:  "images",
+	Usage: "list images",
+	Action: func(context *cli.Context) error {
+		engineFrom(context).ListImages()
+		return nil
+	},
+}
+
+// image命令
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "image history, inspect and squash commands",
+	Subcommands: []cli.Command{
+		{
+			Name:      "history",
+			Usage:     "show the layers of an image and the step that created each of them",
+			ArgsUsage: "<image>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "no-trunc",
+					Usage: "don't truncate layer ids and commands",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing image name")
+				}
+				return engineFrom(context).imageHistory(context.Args().Get(0), context.Bool("no-trunc"))
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "output the config and manifest of images as json",
+			ArgsUsage: "<image> [image...]",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing image name")
+				}
+				return engineFrom(context).inspectImages(context.Args())
+			},
+		},
+		{
+			Name:      "squash",
+			Usage:     "flatten all layers of an image into one layer as a new image",
+			ArgsUsage: "<image>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "t",
+					Usage: "name of the new image",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing image name")
+				}
+				return engineFrom(context).squashImage(context.Args().Get(0), context.String("t"))
+			},
+		},
+	},
+}
+
+// rmi命令
+var removeImageCommand = cli.Command{
+	Name:      "rmi",
+	Usage:     "remove images that are not used by any container",
+	ArgsUsage: "<image> [image...]",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		eng := engineFrom(context)
+		for _, nameOrID := range context.Args() {
+			if err := eng.removeImage(nameOrID); err != nil {
+				return err
+			}
+		}
 		return nil
 	},
 }
@@ -130,8 +446,14 @@ var commitCommand = cli.Command{
 var listCommand = cli.Command{
 	Name:  "ps",
 	Usage: "list all the containers",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "size, s",
+			Usage: "display the disk usage of each write layer",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		ListContainers()
+		engineFrom(context).ListContainers(context.Bool("size"))
 		return nil
 	},
 }
@@ -145,7 +467,7 @@ var logCommand = cli.Command{
 			return fmt.Errorf("Please input your container name")
 		}
 		containerName := context.Args().Get(0)
-		logContainer(containerName)
+		engineFrom(context).logContainer(containerName)
 		return nil
 	},
 }
@@ -157,7 +479,7 @@ var execCommand = cli.Command{
 	Action: func(context *cli.Context) error {
 		// 当执行这个命令的时候，设置完环境变量，会重新打开一个子进程执行exec命令，这时候父进程可退出
 		if os.Getenv(ENV_EXEC_PID) != "" {
-			log.Infof("pid callback pid %s", os.Getpid())
+			log.Infof("pid callback pid %d", os.Getpid())
 			return nil
 		}
 		// 命令格式是 cocin_docker exec 容器名 命令
@@ -171,7 +493,7 @@ var execCommand = cli.Command{
 			commandArray = append(commandArray, arg)
 		}
 		// 执行命令
-		ExecContainer(containerName, commandArray)
+		engineFrom(context).ExecContainer(containerName, commandArray)
 		return nil
 	},
 }
@@ -185,7 +507,7 @@ var stopCommand = cli.Command{
 			return fmt.Errorf("Missing container name")
 		}
 		containerName := context.Args().Get(0)
-		stopContainer(containerName)
+		engineFrom(context).stopContainer(containerName)
 		return nil
 	},
 }
@@ -199,7 +521,9 @@ var removeCommand = cli.Command{
 			return fmt.Errorf("Missing container name")
 		}
 		containerName := context.Args().Get(0)
-		removeContainer(containerName)
+		if err := engineFrom(context).removeContainer(containerName); err != nil {
+			log.Errorf("Remove container error %v", err)
+		}
 		return nil
 	},
 }
@@ -226,8 +550,11 @@ var networkCommand = cli.Command{
 				if len(context.Args()) < 1 {
 					return fmt.Errorf("Missing network name")
 				}
-				network.Init()
-				err := network.CreateNetwork(context.String("driver"), context.String("subnet"), context.Args()[0])
+				networks, err := engineFrom(context).newNetworkManager()
+				if err != nil {
+					return err
+				}
+				err = networks.CreateNetwork(context.String("driver"), context.String("subnet"), context.Args()[0])
 				if err != nil {
 					return fmt.Errorf("create network error: %+v", err)
 				}
@@ -238,8 +565,11 @@ var networkCommand = cli.Command{
 			Name:  "list",
 			Usage: "list container network",
 			Action: func(context *cli.Context) error {
-				network.Init()
-				network.ListNetwork()
+				networks, err := engineFrom(context).newNetworkManager()
+				if err != nil {
+					return err
+				}
+				networks.ListNetwork()
 				return nil
 			},
 		},
@@ -250,8 +580,11 @@ var networkCommand = cli.Command{
 				if len(context.Args()) < 1 {
 					return fmt.Errorf("Missing network name")
 				}
-				network.Init()
-				err := network.DeleteNetwork(context.Args()[0])
+				networks, err := engineFrom(context).newNetworkManager()
+				if err != nil {
+					return err
+				}
+				err = networks.DeleteNetwork(context.Args()[0])
 				if err != nil {
 					return fmt.Errorf("remove network error: %+v", err)
 				}
@@ -260,3 +593,169 @@ var networkCommand = cli.Command{
 		},
 	},
 }
+
+// system命令
+var systemCommand = cli.Command{
+	Name:  "system",
+	Usage: "manage cocin_docker runtime state",
+	Subcommands: []cli.Command{
+		{
+			Name:  "recover",
+			Usage: "reconcile container state after a crash or reboot and clean up leaked resources",
+			Action: func(context *cli.Context) error {
+				eng := engineFrom(context)
+				return eng.reconcileContainers(eng.newStateStore())
+			},
+		},
+		{
+			Name:  "df",
+			Usage: "show disk usage of images, containers, volumes, logs and build cache",
+			Action: func(context *cli.Context) error {
+				return engineFrom(context).systemDiskUsage()
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "remove stopped containers, unused networks, dangling images, build cache and unreferenced layers",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "remove all images not used by any container, not just dangling ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "until=<timestamp|duration>, only remove objects created before it",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				options := pruneOptions{All: context.Bool("all")}
+				for _, filter := range context.StringSlice("filter") {
+					kv := strings.SplitN(filter, "=", 2)
+					if len(kv) != 2 || kv[0] != "until" {
+						return fmt.Errorf("unsupported prune filter %q, only until=<timestamp> is supported", filter)
+					}
+					until, err := events.ParseTime(kv[1], time.Now())
+					if err != nil {
+						return err
+					}
+					options.Until = until
+				}
+				return engineFrom(context).systemPrune(options)
+			},
+		},
+	},
+}
+
+// events命令
+var eventsCommand = cli.Command{
+	Name:  "events",
+	Usage: "stream container and network lifecycle events",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "show events created since timestamp (RFC3339, unix seconds or duration like 10m)",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "stream events until this timestamp",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "filter events, e.g. type=container, event=die, container=name, label=exitCode=0",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		now := time.Now()
+		since, err := events.ParseTime(context.String("since"), now)
+		if err != nil {
+			return err
+		}
+		until, err := events.ParseTime(context.String("until"), now)
+		if err != nil {
+			return err
+		}
+		filter, err := events.ParseFilter(context.StringSlice("filter"))
+		if err != nil {
+			return err
+		}
+		return engineFrom(context).streamEvents(since, until, filter)
+	},
+}
+
+// create命令，OCI runtime接口
+var createCommand = cli.Command{
+	Name:      "create",
+	Usage:     "create a container from an OCI bundle",
+	ArgsUsage: "<container-id>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "bundle, b",
+			Value: ".",
+			Usage: "path to the OCI bundle directory",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container id")
+		}
+		return engineFrom(context).createContainer(context.Args().Get(0), context.String("bundle"))
+	},
+}
+
+// start命令，执行create好的容器里的用户进程
+var startCommand = cli.Command{
+	Name:      "start",
+	Usage:     "start the user process of a created container",
+	ArgsUsage: "<container-id>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container id")
+		}
+		return engineFrom(context).startContainer(context.Args().Get(0))
+	},
+}
+
+// state命令，输出OCI状态json
+var stateCommand = cli.Command{
+	Name:      "state",
+	Usage:     "output the OCI state of a container",
+	ArgsUsage: "<container-id>",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container id")
+		}
+		return engineFrom(context).printContainerState(context.Args().Get(0))
+	},
+}
+
+// kill命令，给容器init进程发信号
+var killCommand = cli.Command{
+	Name:      "kill",
+	Usage:     "send a signal to the container init process",
+	ArgsUsage: "<container-id> [signal]",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container id")
+		}
+		return engineFrom(context).killContainer(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// delete命令，删除已停止的容器
+var deleteCommand = cli.Command{
+	Name:      "delete",
+	Usage:     "delete a stopped container",
+	ArgsUsage: "<container-id>",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "kill the container first if it is still running",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container id")
+		}
+		return engineFrom(context).deleteContainer(context.Args().Get(0), context.Bool("force"))
+	},
+}
@@ -81,8 +81,16 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	return nil
 }
 
+// Disconnect 删除宿主机一端的Veth，容器的网络namespace销毁时Veth通常已经跟着没了
 func (d *BridgeNetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
-	return nil
+	link, err := netlink.LinkByName(endpoint.ID[:5])
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
 }
 
 func (d *BridgeNetworkDriver) initBridge(n *Network) error {
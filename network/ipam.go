@@ -1,98 +1,37 @@
 package network
 
 import (
-	"encoding/json"
-	log "github.com/sirupsen/logrus"
+	"cocin_dokcer/store"
+	"fmt"
 	"net"
-	"os"
-	"path"
 	"strings"
 )
 
-const ipamDefaultAllocatorPath = "/var/run/cocin_docker/network/ipam/subnet.json"
-
 // IPAM 存放IP地址的分配信息
 type IPAM struct {
-	SubnetAllocatorPath string             // 分配文件存放位置
-	Subnets             *map[string]string // 网段和位图算法的数组map，key是网段，value是分配的位图数组
-}
-
-var ipAllocator = &IPAM{SubnetAllocatorPath: ipamDefaultAllocatorPath}
-
-// 加载网段地址分配信息
-func (ipam *IPAM) load() error {
-	if _, err := os.Stat(ipam.SubnetAllocatorPath); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return err
-		}
-	}
-	// 打开并读取存储文件
-	subnetConfigFile, err := os.Open(ipam.SubnetAllocatorPath)
-	defer subnetConfigFile.Close()
-	if err != nil {
-		return err
-	}
-	subnetJson := make([]byte, 2000)
-	n, err := subnetConfigFile.Read(subnetJson)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(subnetJson[:n], ipam.Subnets)
-	if err != nil {
-		log.Errorf("Error dump allocation info, %v", err)
-		return err
-	}
-	return nil
-}
-
-// 存储网段地址分配信息
-func (ipam *IPAM) dump() error {
-	// 判断文件夹是否存在 path.Split函数能够分隔目录和文件，返回的是path = dir+file.
-	ipamConfigFileDir, _ := path.Split(ipam.SubnetAllocatorPath)
-	if _, err := os.Stat(ipamConfigFileDir); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(ipamConfigFileDir, 0644)
-		} else {
-			return err
-		}
-	}
-	// 打开文件，O_TRUNC 表示如果存在则清空  O_CREATE 表示如果不存在則創建
-	subnetConfigFile, err := os.OpenFile(ipam.SubnetAllocatorPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	defer subnetConfigFile.Close()
-	if err != nil {
-		return err
-	}
-
-	ipamConfigJson, err := json.Marshal(ipam.Subnets)
-	if err != nil {
-		return err
-	}
-
-	_, err = subnetConfigFile.Write(ipamConfigJson)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	Store   *store.Store       // 分配信息由store统一落盘和加锁
+	Subnets *map[string]string // 网段和位图算法的数组map，key是网段，value是分配的位图数组
 }
 
 // Allocate 在網段中分配一個可用的IP地址
 func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
-	// 存放網段中地址分配信息的數組
-	ipam.Subnets = &map[string]string{}
-
-	// 从文件中加载已经分配的网段信息
-	err = ipam.load()
-	if err != nil {
-		log.Errorf("Error dump allocation info, %v", err)
-	}
-
 	// 必须要加！！！
 	_, subnet, _ = net.ParseCIDR(subnet.String())
 
+	// 从文件中加载已经分配的网段信息，整个分配过程在IPAM锁内完成
+	err = ipam.Store.UpdateIPAM(func(subnets map[string]string) error {
+		// 存放網段中地址分配信息的數組
+		ipam.Subnets = &subnets
+		ip = ipam.allocate(subnet)
+		if ip == nil {
+			return fmt.Errorf("no available ip in subnet %s", subnet.String())
+		}
+		return nil
+	})
+	return
+}
+
+func (ipam *IPAM) allocate(subnet *net.IPNet) (ip net.IP) {
 	// 比如127.0.0.0/8 子網掩碼是255.0.0.0 返回8 和 32，8就是網段前面固定位的長度，32就是子網掩碼長度，應該是分辨ipv4還是ipv6
 	one, size := subnet.Mask.Size()
 
@@ -123,24 +62,28 @@ func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
 			break
 		}
 	}
-	ipam.dump()
 	return
 }
 
 func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
-	ipam.Subnets = &map[string]string{}
-
 	// 必须要加！！！
 	_, subnet, _ = net.ParseCIDR(subnet.String())
 
-	err := ipam.load()
-	if err != nil {
-		log.Errorf("Error dump allocation info, %v", err)
+	return ipam.Store.UpdateIPAM(func(subnets map[string]string) error {
+		ipam.Subnets = &subnets
+		return ipam.release(subnet, ipaddr)
+	})
+}
+
+func (ipam *IPAM) release(subnet *net.IPNet, ipaddr *net.IP) error {
+	if _, exist := (*ipam.Subnets)[subnet.String()]; !exist {
+		return fmt.Errorf("subnet %s is not allocated", subnet.String())
 	}
 
 	// 计算IP地址在网段位图数组中的索引位置
 	c := 0
-	releaseIP := ipaddr.To4()
+	// 复制一份，避免下面的减1改到调用方传进来的IP
+	releaseIP := append(net.IP{}, ipaddr.To4()...)
 	// 由于IP是从1开始分配的，所以转换成索引应该减1
 	releaseIP[3] -= 1
 	for t := uint(4); t > 0; t -= 1 {
@@ -150,7 +93,5 @@ func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
 	ipalloc := []byte((*ipam.Subnets)[subnet.String()])
 	ipalloc[c] = '0'
 	(*ipam.Subnets)[subnet.String()] = string(ipalloc)
-
-	ipam.dump()
 	return nil
 }
@@ -1,17 +1,34 @@
 package network
 
 import (
+	"cocin_dokcer/store"
 	"net"
 	"testing"
 )
 
 func TestAllocate(t *testing.T) {
+	ipAllocator := &IPAM{Store: store.New(t.TempDir())}
 	_, ipnet, _ := net.ParseCIDR("192.168.1.1/24")
 	ip, _ := ipAllocator.Allocate(ipnet)
 	t.Logf("alloc ip: %v", ip)
+	if ip.String() != "192.168.1.1" {
+		t.Errorf("first allocated ip should be 192.168.1.1, got %v", ip)
+	}
+	ip, _ = ipAllocator.Allocate(ipnet)
+	if ip.String() != "192.168.1.2" {
+		t.Errorf("second allocated ip should be 192.168.1.2, got %v", ip)
+	}
 }
 
 func TestRelease(t *testing.T) {
-	ip, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
-	ipAllocator.Release(ipnet, &ip)
+	ipAllocator := &IPAM{Store: store.New(t.TempDir())}
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
+	ip, _ := ipAllocator.Allocate(ipnet)
+	if err := ipAllocator.Release(ipnet, &ip); err != nil {
+		t.Fatalf("release ip error %v", err)
+	}
+	again, _ := ipAllocator.Allocate(ipnet)
+	if !again.Equal(ip) {
+		t.Errorf("released ip %v should be allocated again, got %v", ip, again)
+	}
 }
@@ -2,7 +2,8 @@ package network
 
 import (
 	"cocin_dokcer/container"
-	"encoding/json"
+	"cocin_dokcer/events"
+	"cocin_dokcer/store"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -10,23 +11,18 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"path"
-	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"text/tabwriter"
-)
-
-var (
-	defaultNetworkPath = "/var/run/cocin_docker/network/network/"
-	drivers            = map[string]NetworkDriver{}
-	networks           = map[string]*Network{}
+	"time"
 )
 
 type Network struct {
 	Name    string     // 网络名
 	IpRange *net.IPNet // 地址段
 	Driver  string     // 网络驱动名
+	Created time.Time  // 创建时间，早期创建的网络没有记录
 }
 
 type Endpoint struct {
@@ -46,14 +42,55 @@ type NetworkDriver interface {
 	Disconnect(network Network, endpoint *Endpoint) error // 从网络上移除容器网络端点
 }
 
+/*
+	Manager 管理网络和容器的网络端点，网络和IPAM的状态都通过store读写
+	由NewManager从store创建，不再依赖包级变量，不同的状态根目录互不影响
+*/
+type Manager struct {
+	store    *store.Store
+	ipam     *IPAM
+	drivers  map[string]NetworkDriver
+	networks map[string]*Network
+}
+
+// NewManager 从store中加载所有的网络配置信息
+func NewManager(st *store.Store) (*Manager, error) {
+	m := &Manager{
+		store:    st,
+		ipam:     &IPAM{Store: st},
+		drivers:  map[string]NetworkDriver{},
+		networks: map[string]*Network{},
+	}
+	// 加载网络驱动	目前只实现Bridge方式的
+	var bridgeDriver = BridgeNetworkDriver{}
+	m.drivers[bridgeDriver.Name()] = &bridgeDriver
+
+	// 检查网络配置目录中的所有文件，文件名就是网络名
+	nwNames, err := st.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, nwName := range nwNames {
+		nw := &Network{Name: nwName}
+		// 加载网络配置信息
+		if err := st.LoadNetwork(nwName, nw); err != nil {
+			logrus.Errorf("error load network: %s", err)
+			continue
+		}
+		// 将网络的配置信息加入到networks字典中
+		m.networks[nwName] = nw
+	}
+	return m, nil
+}
+
 // CreateNetwork 创建网络
-func CreateNetwork(driver, subnet, name string) error {
+func (m *Manager) CreateNetwork(driver, subnet, name string) error {
 	// ParseCIDR 的功能是将网段的字符串转换成net.IPNet 的对象
 	// For example, ParseCIDR("192.0.2.1/24")
 	// returns the IP address 192.0.2.1 and the network 192.0.2.0/24.
 	_, cidr, _ := net.ParseCIDR(subnet)
 	// 通过IPAM分配网关IP，获取到网段中第一个IP作为网关IP。和普通分配IP的流程一样的。
-	gatewayIP, err := ipAllocator.Allocate(cidr)
+	gatewayIP, err := m.ipam.Allocate(cidr)
 	if err != nil {
 		return err
 	}
@@ -61,70 +98,22 @@ func CreateNetwork(driver, subnet, name string) error {
 
 	// 调用指定的网络驱动创建网络， 这里的drivers字典是各个网络驱动的实例字典
 	// 通过调用网络驱动的Create方法创建网络，目前主要创建的是Bridge驱动
-	nw, err := drivers[driver].Create(cidr.String(), name)
+	nw, err := m.drivers[driver].Create(cidr.String(), name)
 	if err != nil {
 		return err
 	}
+	nw.Created = time.Now()
 	//保存网络信息，将网络的信息保存在文件系统中，以便查询和在网络上连接网络端点
-	return nw.dump(defaultNetworkPath)
-}
-
-// dump 将这个网络的配置信息保存在文件系统中
-func (nw *Network) dump(dumpPath string) error {
-	// 检查保存的目录是否存在，不存在则创建
-	if _, err := os.Stat(dumpPath); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(dumpPath, 0644)
-		} else {
-			return err
-		}
-	}
-
-	// 保存的文件名是网络的名字
-	nwPath := path.Join(dumpPath, nw.Name)
-	// 打开保存的文件用于写入，后面打开的模式参数分别是 存在内容则清空、只写入、不存在则创建
-	nwFile, err := os.OpenFile(nwPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		logrus.Errorf("error：", err)
-		return err
-	}
-	defer nwFile.Close()
-
-	// 序列化网络对象
-	nwJson, err := json.Marshal(nw)
-	if err != nil {
-		logrus.Errorf("error：", err)
-		return err
-	}
-	// 把序列化内容写入文件
-	_, err = nwFile.Write(nwJson)
-	if err != nil {
-		logrus.Errorf("error：", err)
+	if err := m.store.SaveNetwork(nw.Name, nw); err != nil {
 		return err
 	}
+	m.journal().Log(events.TypeNetwork, "create", nw.Name, map[string]string{"driver": nw.Driver, "subnet": nw.IpRange.String()})
 	return nil
 }
 
-// load 加载网络配置
-func (nw *Network) load(dumpPath string) error {
-	// 打开配置文件 只读的方式
-	nwConfigFile, err := os.Open(dumpPath)
-	defer nwConfigFile.Close()
-	if err != nil {
-		return err
-	}
-	// 从配置文件中读取网络的配置json字符串
-	nwJson := make([]byte, 2000)
-	n, err := nwConfigFile.Read(nwJson)
-	if err != nil {
-		return err
-	}
-	// 反序列化
-	if err = json.Unmarshal(nwJson[:n], nw); err != nil {
-		logrus.Errorf("Error load nw info", err)
-		return err
-	}
-	return nil
+// journal 网络的生命周期事件和容器的写在同一个事件日志里
+func (m *Manager) journal() *events.Journal {
+	return events.NewJournal(m.store.Root)
 }
 
 /*
@@ -255,14 +244,14 @@ func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
 }
 
 // Connect 连接到容器之前创建的网络中
-func Connect(networkName string, cinfo *container.ContainerInfo) error {
+func (m *Manager) Connect(networkName string, cinfo *container.ContainerInfo) error {
 	// 从networks字典中取出容器连接的网络的信息，networks字典中保存了当前已经创建的网络
-	network, ok := networks[networkName]
+	network, ok := m.networks[networkName]
 	if !ok {
 		return fmt.Errorf("No Such Network: %s", networkName)
 	}
 	// 通过调用IPAM从网络的网段中获得可用的IP作为容器IP地址
-	ip, err := ipAllocator.Allocate(network.IpRange)
+	ip, err := m.ipam.Allocate(network.IpRange)
 	if err != nil {
 		return err
 	}
@@ -276,7 +265,7 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 	}
 
 	// 调用网络驱动的Connect方法去连接和配置网络端点，这里以Bridge为例
-	if err = drivers[network.Driver].Connect(network, ep); err != nil {
+	if err = m.drivers[network.Driver].Connect(network, ep); err != nil {
 		return err
 	}
 
@@ -285,55 +274,63 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 		return err
 	}
 
+	// 记录分到的网络和IP，容器退出或者崩溃后靠它们释放资源
+	cinfo.Network = networkName
+	cinfo.IPAddress = ip.String()
+	m.journal().Log(events.TypeNetwork, "connect", networkName, map[string]string{"container": cinfo.Id, "name": cinfo.Name, "ip": cinfo.IPAddress})
+
 	// 配置容器到宿主机的端口映射
 	return configPortMapping(ep, cinfo)
 }
 
-// Init 从网络配置的目录中加载所有的网络配置信息到networks字典中
-func Init() error {
-	// 加载网络驱动	目前只实现Bridge方式的
-	var bridgeDriver = BridgeNetworkDriver{}
-	drivers[bridgeDriver.Name()] = &bridgeDriver
-
-	// 判断网络的配置目录是否存在，不存在则创建
-	if _, err := os.Stat(defaultNetworkPath); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(defaultNetworkPath, 0644)
-		} else {
-			return err
-		}
+// Disconnect 释放容器在网络上占用的资源：端口映射的DNAT规则、宿主机上的Veth和IPAM分配的IP
+// 容器可能早已退出，单项清理失败只记录日志，尽量把能清的都清掉
+func (m *Manager) Disconnect(networkName string, cinfo *container.ContainerInfo) error {
+	network, ok := m.networks[networkName]
+	if !ok {
+		return fmt.Errorf("No Such Network: %s", networkName)
+	}
+	ip := net.ParseIP(cinfo.IPAddress)
+	if ip == nil {
+		return fmt.Errorf("invalid container ip %q", cinfo.IPAddress)
 	}
+	ep := &Endpoint{
+		ID:          fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+		IPAddress:   ip,
+		PortMapping: cinfo.PortMapping,
+		Network:     network,
+	}
+	removePortMapping(ep)
+	if err := m.drivers[network.Driver].Disconnect(*network, ep); err != nil {
+		logrus.Warnf("disconnect endpoint %s error %v", ep.ID, err)
+	}
+	if err := m.ipam.Release(network.IpRange, &ip); err != nil {
+		return err
+	}
+	m.journal().Log(events.TypeNetwork, "disconnect", networkName, map[string]string{"container": cinfo.Id, "name": cinfo.Name})
+	return nil
+}
 
-	// 检查网络配置目录中的所有文件
-	// filepath.Walk(path, func(string, os.FileInfo, error)) 函数会遍历指定的path目录
-	// 并执行第二个参数中的函数指针去处理目录下的每一个文件
-	filepath.Walk(defaultNetworkPath, func(nwPath string, info os.FileInfo, err error) error {
-		// 如果是目录，跳过
-		if info.IsDir() {
-			return nil
+// 删除configPortMapping添加的DNAT规则
+func removePortMapping(ep *Endpoint) {
+	for _, pm := range ep.PortMapping {
+		portMapping := strings.Split(pm, ":")
+		if len(portMapping) != 2 {
+			continue
 		}
-
-		// 加载文件名作为网络名
-		_, nwName := path.Split(nwPath)
-		nw := &Network{Name: nwName}
-
-		// 调用load方法加载网络配置信息
-		if err := nw.load(nwPath); err != nil {
-			logrus.Errorf("error load network: %s", err)
+		iptablesCmd := fmt.Sprintf("-t nat -D PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
+			portMapping[0], ep.IPAddress.String(), portMapping[1])
+		if output, err := exec.Command("iptables", strings.Split(iptablesCmd, " ")...).CombinedOutput(); err != nil {
+			logrus.Warnf("iptables delete rule %s error %v %s", iptablesCmd, err, output)
 		}
-
-		// 将网络的配置信息加入到networks字典中
-		networks[nwName] = nw
-		return nil
-	})
-	return nil
+	}
 }
 
 // ListNetwork 其实就是遍历那个networks字典
-func ListNetwork() {
+func (m *Manager) ListNetwork() {
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
 	fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
-	for _, nw := range networks {
+	for _, nw := range m.networks {
 		fmt.Fprintf(w, "%s\t%s\t%s\n",
 			nw.Name,
 			nw.IpRange.String(),
@@ -346,34 +343,36 @@ func ListNetwork() {
 	}
 }
 
-func DeleteNetwork(networkName string) error {
+// Networks 按名字排序的所有网络
+func (m *Manager) Networks() []Network {
+	var result []Network
+	for _, nw := range m.networks {
+		result = append(result, *nw)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (m *Manager) DeleteNetwork(networkName string) error {
 	// 查找网络是否存在
-	nw, ok := networks[networkName]
+	nw, ok := m.networks[networkName]
 	if !ok {
 		return fmt.Errorf("No Such Network: %s", networkName)
 	}
 	// 释放网络网关的IP
-	if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
+	if err := m.ipam.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
 		return fmt.Errorf("Error Remove Network gateway ip: %s", err)
 	}
 
 	// 调用网络驱动删除网络创建的设备与配置
-	if err := drivers[nw.Driver].Delete(*nw); err != nil {
+	if err := m.drivers[nw.Driver].Delete(*nw); err != nil {
 		return fmt.Errorf("Error Remove Network DriverError: %s", err)
 	}
 
 	// 删除该网络对应的配置文件
-	return nw.remove(defaultNetworkPath)
-}
-
-func (nw *Network) remove(dumpPath string) error {
-	if _, err := os.Stat(path.Join(dumpPath, nw.Name)); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return err
-		}
-	} else {
-		return os.Remove(path.Join(dumpPath, nw.Name))
+	if err := m.store.RemoveNetwork(nw.Name); err != nil {
+		return err
 	}
+	m.journal().Log(events.TypeNetwork, "destroy", nw.Name, map[string]string{"driver": nw.Driver})
+	return nil
 }
@@ -0,0 +1,41 @@
+package network
+
+import (
+	"cocin_dokcer/store"
+	"net"
+	"testing"
+)
+
+func TestNewManagerLoadsNetworks(t *testing.T) {
+	st := store.New(t.TempDir())
+	_, ipnet, _ := net.ParseCIDR("192.168.10.0/24")
+	for _, name := range []string{"web", "db"} {
+		if err := st.SaveNetwork(name, &Network{Name: name, IpRange: ipnet, Driver: "bridge"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewManager(st)
+	if err != nil {
+		t.Fatalf("new manager error %v", err)
+	}
+	networks := m.Networks()
+	if len(networks) != 2 || networks[0].Name != "db" || networks[1].Name != "web" {
+		t.Fatalf("networks should be loaded and sorted by name, got %+v", networks)
+	}
+	if networks[1].IpRange.String() != "192.168.10.0/24" {
+		t.Errorf("subnet not loaded, got %v", networks[1].IpRange)
+	}
+
+	// 另一个状态根目录下的Manager看不到这些网络
+	other, err := NewManager(store.New(t.TempDir()))
+	if err != nil {
+		t.Fatalf("new manager error %v", err)
+	}
+	if got := other.Networks(); len(got) != 0 {
+		t.Errorf("managers of different stores should not share networks, got %+v", got)
+	}
+	if err := other.DeleteNetwork("web"); err == nil {
+		t.Errorf("delete a network of another store should fail")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cocin_dokcer/Cgroups"
+	"cocin_dokcer/container"
+	"cocin_dokcer/events"
+	"cocin_dokcer/oci"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// startFifoName create和start之间同步用的fifo，放在容器状态目录下
+const startFifoName = "exec.fifo"
+
+/*
+	createContainer 实现OCI的create命令
+	1. 读取bundle里的config.json，转换成clone flag、cgroup配置和init进程的配置
+	2. 以bundle的rootfs为根启动init进程，init准备好namespace和挂载后阻塞在exec.fifo上
+	3. 记录状态为created，执行prestart和createRuntime hook
+	之后由start命令打开fifo，init才会真正执行用户进程
+*/
+func (eng *engine) createContainer(containerID, bundle string) error {
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return err
+	}
+	spec, err := oci.LoadSpec(bundle)
+	if err != nil {
+		return err
+	}
+	cloneflags, err := spec.CloneFlags()
+	if err != nil {
+		return err
+	}
+	initConfig, err := spec.InitConfig()
+	if err != nil {
+		return err
+	}
+	rootfs := spec.RootfsPath(bundle)
+	if exist, _ := container.PathExists(rootfs); !exist {
+		return fmt.Errorf("rootfs %s does not exist", rootfs)
+	}
+	// OCI的容器ID同时作为容器名
+	if err := container.ReserveName(eng.containerPaths(), containerID); err != nil {
+		return err
+	}
+	st := eng.newStateStore()
+	initConfig.StartFifo = filepath.Join(st.ContainerDir(containerID), startFifoName)
+	if err := syscall.Mkfifo(initConfig.StartFifo, 0622); err != nil {
+		container.ReleaseName(eng.containerPaths(), containerID)
+		return fmt.Errorf("create start fifo error %v", err)
+	}
+
+	parent, writePipe, err := container.NewBundleProcess(eng.containerPaths(), rootfs, cloneflags, containerID)
+	if err != nil {
+		container.ReleaseName(eng.containerPaths(), containerID)
+		return err
+	}
+	if err := parent.Start(); err != nil {
+		container.ReleaseName(eng.containerPaths(), containerID)
+		return err
+	}
+	startTime, err := container.ProcessStartTime(parent.Process.Pid)
+	if err != nil {
+		log.Warnf("Get start time of pid %d error %v", parent.Process.Pid, err)
+	}
+	containerInfo := &container.ContainerInfo{
+		Pid:         strconv.Itoa(parent.Process.Pid),
+		Id:          containerID,
+		Name:        containerID,
+		Command:     strings.Join(initConfig.Args, " "),
+		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
+		Status:      container.CREATED,
+		StartTime:   startTime,
+		CgroupPath:  Cgroups.ContainerCgroupPath(containerID),
+		Hooks:       spec.Hooks,
+		Bundle:      bundle,
+	}
+	if err := eng.recordContainerInfo(containerInfo); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
+	eng.newJournal().Log(events.TypeContainer, "create", containerID, containerAttributes(containerInfo))
+
+	cgroupManager := Cgroups.NewCgroupManager(containerInfo.CgroupPath)
+	if err := cgroupManager.Set(spec.ResourceConfig()); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
+
+	if err := container.SendInitConfig(initConfig, writePipe); err != nil {
+		eng.abortContainer(parent, containerInfo)
+		return fmt.Errorf("send init config error %v", err)
+	}
+	if spec.Hooks != nil {
+		state := containerInfo.OCIState(eng.containerPaths(), container.StateCreated)
+		if err := container.RunHooks(append(spec.Hooks.Prestart, spec.Hooks.CreateRuntime...), state); err != nil {
+			eng.abortContainer(parent, containerInfo)
+			return fmt.Errorf("run prestart hooks of container %s error %v", containerID, err)
+		}
+	}
+	return nil
+}
+
+// startContainer 实现OCI的start命令，打开fifo放行阻塞在里面的init进程
+func (eng *engine) startContainer(containerID string) error {
+	st := eng.newStateStore()
+	containerInfo, err := st.LoadContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if status := containerInfo.RuntimeStatus(); status != container.StateCreated {
+		return fmt.Errorf("container %s is %s, not created", containerID, status)
+	}
+	fifo := filepath.Join(st.ContainerDir(containerID), startFifoName)
+	// 以读方式打开fifo会一直阻塞到init以写方式打开它，init中途退出的话就不能一直等下去
+	opened := make(chan error, 1)
+	go func() {
+		f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+		if err == nil {
+			_, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+		opened <- err
+	}()
+	for waiting := true; waiting; {
+		select {
+		case err := <-opened:
+			if err != nil {
+				return fmt.Errorf("open start fifo error %v", err)
+			}
+			waiting = false
+		case <-time.After(100 * time.Millisecond):
+			if !container.IsProcessAlive(containerInfo.Pid, containerInfo.StartTime) {
+				return fmt.Errorf("container %s init process exited before start", containerID)
+			}
+		}
+	}
+	os.Remove(fifo)
+
+	err = st.UpdateContainer(containerID, func(info *container.ContainerInfo) error {
+		info.Status = container.RUNNING
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	eng.newJournal().Log(events.TypeContainer, "start", containerID, containerAttributes(containerInfo))
+	if containerInfo.Hooks != nil {
+		if err := container.RunHooks(containerInfo.Hooks.Poststart, containerInfo.OCIState(eng.containerPaths(), container.StateRunning)); err != nil {
+			log.Warnf("Run poststart hooks of container %s error %v", containerID, err)
+		}
+	}
+	return nil
+}
+
+// ociState 根据记录的状态和进程是否存活得出OCI定义的状态
+func (eng *engine) ociState(containerInfo *container.ContainerInfo) *container.State {
+	status := containerInfo.RuntimeStatus()
+	state := containerInfo.OCIState(eng.containerPaths(), status)
+	if status == container.StateStopped {
+		state.Pid = 0
+	}
+	return state
+}
+
+// printContainerState 实现OCI的state命令，输出标准的状态json
+func (eng *engine) printContainerState(containerID string) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerID)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(eng.ociState(containerInfo), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(content))
+	return nil
+}
+
+// killContainer 实现OCI的kill命令，给容器的init进程发送信号
+func (eng *engine) killContainer(containerID, signal string) error {
+	sig, err := oci.ParseSignal(signal)
+	if err != nil {
+		return err
+	}
+	containerInfo, err := eng.newStateStore().LoadContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if containerInfo.RuntimeStatus() == container.StateStopped {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	pid, _ := strconv.Atoi(containerInfo.Pid)
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("kill container %s error %v", containerID, err)
+	}
+	attributes := containerAttributes(containerInfo)
+	attributes["signal"] = strconv.Itoa(int(sig))
+	eng.newJournal().Log(events.TypeContainer, "kill", containerID, attributes)
+	return nil
+}
+
+// deleteContainer 实现OCI的delete命令，容器必须已经停止，force时先杀掉它
+func (eng *engine) deleteContainer(containerID string, force bool) error {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if containerInfo.RuntimeStatus() != container.StateStopped {
+		if !force {
+			return fmt.Errorf("container %s is still running, stop it first or use --force", containerID)
+		}
+		pid, _ := strconv.Atoi(containerInfo.Pid)
+		syscall.Kill(pid, syscall.SIGKILL)
+		if !container.WaitProcessExit(containerInfo.Pid, containerInfo.StartTime, 5*time.Second) {
+			return fmt.Errorf("container %s did not exit after SIGKILL", containerID)
+		}
+		if err := eng.containerExited(eng.newStateStore(), containerInfo, container.Exit, ""); err != nil {
+			return err
+		}
+	}
+	eng.destroyContainer(containerInfo)
+	return nil
+}
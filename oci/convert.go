@@ -0,0 +1,175 @@
+package oci
+
+import (
+	"cocin_dokcer/Cgroups/subsystems"
+	"cocin_dokcer/container"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// namespace类型到clone flag的映射
+var namespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+	"mount":   syscall.CLONE_NEWNS,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"cgroup":  unix.CLONE_NEWCGROUP,
+}
+
+// CloneFlags 把spec里的namespace转换成clone flag
+// 加入已有namespace(path)和user namespace暂不支持，直接报错而不是悄悄忽略
+// spec里没有mount namespace也总是加上CLONE_NEWNS，init要在自己的mount namespace里挂载和pivot_root，否则改的是宿主机
+func (s *Spec) CloneFlags() (uintptr, error) {
+	flags := uintptr(syscall.CLONE_NEWNS)
+	if s.Linux == nil {
+		return flags, nil
+	}
+	for _, ns := range s.Linux.Namespaces {
+		flag, ok := namespaceFlags[ns.Type]
+		if !ok {
+			return 0, fmt.Errorf("unsupported namespace type %q", ns.Type)
+		}
+		if ns.Path != "" {
+			return 0, fmt.Errorf("joining %s namespace %s is not supported", ns.Type, ns.Path)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// ResourceConfig 把spec里的资源限制转换成cgroup配置
+func (s *Spec) ResourceConfig() *subsystems.ResourceConfig {
+	res := &subsystems.ResourceConfig{}
+	if s.Linux == nil || s.Linux.Resources == nil {
+		return res
+	}
+	if mem := s.Linux.Resources.Memory; mem != nil && mem.Limit != nil {
+		res.MemoryLimit = strconv.FormatInt(*mem.Limit, 10)
+	}
+	if cpu := s.Linux.Resources.CPU; cpu != nil {
+		if cpu.Shares != nil {
+			res.CpuShare = strconv.FormatUint(*cpu.Shares, 10)
+		}
+		res.CpuSet = cpu.Cpus
+	}
+	return res
+}
+
+// 挂载选项到mount flag的映射，值为true表示清除该flag
+var mountOptions = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":          {false, syscall.MS_RDONLY},
+	"rw":          {true, syscall.MS_RDONLY},
+	"nosuid":      {false, syscall.MS_NOSUID},
+	"suid":        {true, syscall.MS_NOSUID},
+	"nodev":       {false, syscall.MS_NODEV},
+	"dev":         {true, syscall.MS_NODEV},
+	"noexec":      {false, syscall.MS_NOEXEC},
+	"exec":        {true, syscall.MS_NOEXEC},
+	"sync":        {false, syscall.MS_SYNCHRONOUS},
+	"async":       {true, syscall.MS_SYNCHRONOUS},
+	"noatime":     {false, syscall.MS_NOATIME},
+	"atime":       {true, syscall.MS_NOATIME},
+	"nodiratime":  {false, syscall.MS_NODIRATIME},
+	"relatime":    {false, syscall.MS_RELATIME},
+	"strictatime": {false, syscall.MS_STRICTATIME},
+	"bind":        {false, syscall.MS_BIND},
+	"rbind":       {false, syscall.MS_BIND | syscall.MS_REC},
+	"private":     {false, syscall.MS_PRIVATE},
+	"rprivate":    {false, syscall.MS_PRIVATE | syscall.MS_REC},
+	"slave":       {false, syscall.MS_SLAVE},
+	"rslave":      {false, syscall.MS_SLAVE | syscall.MS_REC},
+}
+
+// ParseMountOptions 把挂载选项分成mount flag和交给文件系统的data
+func ParseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, o := range options {
+		if opt, ok := mountOptions[o]; ok {
+			if opt.clear {
+				flags &^= opt.flag
+			} else {
+				flags |= opt.flag
+			}
+			continue
+		}
+		data = append(data, o)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// rlimit名字到数值的映射
+var rlimitTypes = map[string]int{
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+}
+
+// InitConfig 把spec转换成容器init进程的配置
+func (s *Spec) InitConfig() (*container.InitConfig, error) {
+	p := s.Process
+	if p.Terminal {
+		return nil, fmt.Errorf("process.terminal is not supported for bundles")
+	}
+	config := &container.InitConfig{
+		Args:     p.Args,
+		Env:      p.Env,
+		Cwd:      p.Cwd,
+		Hostname: s.Hostname,
+		UID:      int(p.User.UID),
+		GID:      int(p.User.GID),
+	}
+	if config.Env == nil {
+		config.Env = []string{}
+	}
+	config.ReadonlyRootfs = s.Root.Readonly
+	for _, gid := range p.User.AdditionalGids {
+		config.AdditionalGids = append(config.AdditionalGids, int(gid))
+	}
+	for _, rl := range p.Rlimits {
+		rlType, ok := rlimitTypes[rl.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown rlimit type %q", rl.Type)
+		}
+		config.Rlimits = append(config.Rlimits, container.Rlimit{Type: rlType, Hard: rl.Hard, Soft: rl.Soft})
+	}
+	for _, m := range s.Mounts {
+		flags, data := ParseMountOptions(m.Options)
+		mountType := m.Type
+		if flags&syscall.MS_BIND != 0 {
+			mountType = "bind"
+		}
+		source := m.Source
+		if source == "" {
+			source = mountType
+		}
+		config.Mounts = append(config.Mounts, container.Mount{
+			Source:      source,
+			Destination: m.Destination,
+			Type:        mountType,
+			Flags:       flags,
+			Data:        data,
+		})
+	}
+	return config, nil
+}
@@ -0,0 +1,41 @@
+package oci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 常用信号名
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal 支持 9、KILL、SIGKILL 三种写法
+func ParseSignal(signal string) (syscall.Signal, error) {
+	if signal == "" {
+		return syscall.SIGTERM, nil
+	}
+	if n, err := strconv.Atoi(signal); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal %s", signal)
+		}
+		return syscall.Signal(n), nil
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %s", signal)
+	}
+	return sig, nil
+}
@@ -0,0 +1,116 @@
+package oci
+
+import (
+	"cocin_dokcer/container"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// SpecConfigFile bundle目录下的配置文件名
+const SpecConfigFile = "config.json"
+
+// Spec OCI runtime-spec 中config.json的一个子集，只包含cocin_docker能够支持的字段
+type Spec struct {
+	Version     string            `json:"ociVersion"`
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Hooks       *container.Hooks  `json:"hooks,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux,omitempty"`
+}
+
+// Process 容器内要运行的进程
+type Process struct {
+	Terminal bool          `json:"terminal,omitempty"`
+	User     User          `json:"user"`
+	Args     []string      `json:"args"`
+	Env      []string      `json:"env,omitempty"`
+	Cwd      string        `json:"cwd"`
+	Rlimits  []POSIXRlimit `json:"rlimits,omitempty"`
+}
+
+// User 进程的用户和组
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// POSIXRlimit 资源限制，Type形如RLIMIT_NOFILE
+type POSIXRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// Root 容器的根文件系统，Path是相对bundle的路径或者绝对路径
+type Root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// Mount 挂载点
+type Mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// Linux Linux平台相关的配置
+type Linux struct {
+	Namespaces []LinuxNamespace `json:"namespaces,omitempty"`
+	Resources  *LinuxResources  `json:"resources,omitempty"`
+}
+
+// LinuxNamespace 需要新建的namespace，Path不为空表示加入已有的namespace
+type LinuxNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+// LinuxResources 映射到cgroup的资源限制
+type LinuxResources struct {
+	Memory *LinuxMemory `json:"memory,omitempty"`
+	CPU    *LinuxCPU    `json:"cpu,omitempty"`
+}
+
+type LinuxMemory struct {
+	Limit *int64 `json:"limit,omitempty"`
+}
+
+type LinuxCPU struct {
+	Shares *uint64 `json:"shares,omitempty"`
+	Cpus   string  `json:"cpus,omitempty"`
+}
+
+// LoadSpec 读取bundle目录下的config.json
+func LoadSpec(bundle string) (*Spec, error) {
+	content, err := ioutil.ReadFile(filepath.Join(bundle, SpecConfigFile))
+	if err != nil {
+		return nil, fmt.Errorf("read bundle config error %v", err)
+	}
+	var spec Spec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, fmt.Errorf("parse bundle config error %v", err)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil, fmt.Errorf("bundle config has no process args")
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, fmt.Errorf("bundle config has no root path")
+	}
+	return &spec, nil
+}
+
+// RootfsPath 返回rootfs的绝对路径
+func (s *Spec) RootfsPath(bundle string) string {
+	if filepath.IsAbs(s.Root.Path) {
+		return s.Root.Path
+	}
+	return filepath.Join(bundle, s.Root.Path)
+}
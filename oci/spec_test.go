@@ -0,0 +1,74 @@
+package oci
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := ParseMountOptions([]string{"nosuid", "strictatime", "mode=755", "size=65536k"})
+	if flags != syscall.MS_NOSUID|syscall.MS_STRICTATIME {
+		t.Errorf("unexpected flags %x", flags)
+	}
+	if data != "mode=755,size=65536k" {
+		t.Errorf("unexpected data %q", data)
+	}
+	flags, _ = ParseMountOptions([]string{"rbind", "ro", "rw"})
+	if flags != syscall.MS_BIND|syscall.MS_REC {
+		t.Errorf("rw should clear ro, got %x", flags)
+	}
+}
+
+func TestCloneFlags(t *testing.T) {
+	spec := &Spec{Linux: &Linux{Namespaces: []LinuxNamespace{{Type: "pid"}, {Type: "mount"}}}}
+	flags, err := spec.CloneFlags()
+	if err != nil || flags != syscall.CLONE_NEWPID|syscall.CLONE_NEWNS {
+		t.Errorf("unexpected clone flags %x %v", flags, err)
+	}
+	// 没有mount namespace也要加上，不能在宿主机的mount namespace里pivot_root
+	for _, spec := range []*Spec{{}, {Linux: &Linux{Namespaces: []LinuxNamespace{{Type: "pid"}}}}} {
+		if flags, err := spec.CloneFlags(); err != nil || flags&syscall.CLONE_NEWNS == 0 {
+			t.Errorf("clone flags %x %v should always include CLONE_NEWNS", flags, err)
+		}
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, LinuxNamespace{Type: "network", Path: "/proc/1/ns/net"})
+	if _, err := spec.CloneFlags(); err == nil {
+		t.Errorf("joining an existing namespace should be rejected")
+	}
+}
+
+func TestReadonlyRootfsWithoutMounts(t *testing.T) {
+	spec := &Spec{Root: &Root{Path: "rootfs", Readonly: true}, Process: &Process{Args: []string{"sh"}}}
+	config, err := spec.InitConfig()
+	if err != nil {
+		t.Fatalf("convert init config error %v", err)
+	}
+	if !config.ReadonlyRootfs || len(config.Mounts) != 0 {
+		t.Errorf("readonly rootfs should not depend on mounts, got %+v", config)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		signal string
+		want   syscall.Signal
+	}{
+		{"", syscall.SIGTERM},
+		{"9", syscall.SIGKILL},
+		{"KILL", syscall.SIGKILL},
+		{"SIGKILL", syscall.SIGKILL},
+		{"sigusr1", syscall.SIGUSR1},
+		{"hup", syscall.SIGHUP},
+		{"64", syscall.Signal(64)},
+	}
+	for _, test := range tests {
+		if sig, err := ParseSignal(test.signal); err != nil || sig != test.want {
+			t.Errorf("ParseSignal(%q) = %v, %v, want %v", test.signal, sig, err, test.want)
+		}
+	}
+	for _, signal := range []string{"0", "-9", "65", "SIGFOO", "SIG", "9x"} {
+		if _, err := ParseSignal(signal); err == nil {
+			t.Errorf("signal %q should be rejected", signal)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"cocin_dokcer/reference"
+	"cocin_dokcer/registry"
+	"fmt"
+	"strings"
+)
+
+// newRegistryClient 按引用里的仓库地址新建客户端，creds是 user:password
+func newRegistryClient(ref reference.Reference, creds string, insecure bool) *registry.Client {
+	client := registry.NewClient(ref.Domain)
+	if insecure {
+		client.Insecure = true
+	}
+	if creds != "" {
+		parts := strings.SplitN(creds, ":", 2)
+		client.Username = parts[0]
+		if len(parts) == 2 {
+			client.Password = parts[1]
+		}
+	}
+	return client
+}
+
+// pullImage 从仓库拉取镜像，没写tag时拉取latest
+func (eng *engine) pullImage(name, creds string, insecure bool) error {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return err
+	}
+	ref = ref.WithDefaultTag()
+	images := eng.newImageStore()
+	id, err := newRegistryClient(ref, creds, insecure).Pull(images, ref)
+	if err != nil {
+		return fmt.Errorf("pull %s error %v", ref, err)
+	}
+	// 按digest拉取的镜像没有tag，不起名字
+	if ref.Tag != "" {
+		if err := images.SetName(ref.Familiar(), id); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Pulled %s\n%s\n", ref, id)
+	return nil
+}
+
+// pushImage 把镜像推送到镜像名里的仓库
+func (eng *engine) pushImage(name, creds string, insecure bool) error {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return err
+	}
+	ref = ref.WithDefaultTag()
+	images := eng.newImageStore()
+	id, err := images.Resolve(name)
+	if err != nil {
+		return err
+	}
+	digest, err := newRegistryClient(ref, creds, insecure).Push(images, id, ref)
+	if err != nil {
+		return fmt.Errorf("push %s error %v", ref, err)
+	}
+	fmt.Printf("Pushed %s\n%s\n", ref, digest)
+	return nil
+}
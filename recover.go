@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cocin_dokcer/Cgroups"
+	"cocin_dokcer/Cgroups/subsystems"
+	"cocin_dokcer/container"
+	"cocin_dokcer/events"
+	"cocin_dokcer/storage"
+	"cocin_dokcer/store"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+	宿主机重启或者cocin_docker自身崩溃之后，状态根目录(--exec-root)里会留下一些标记为running、
+	但进程早已不在(或者PID已被别的进程复用)的容器，以及它们的aufs挂载、cgroup、Veth、IP和iptables规则。
+	reconcileContainers 负责把这些状态修正过来：
+	1. 用PID加上进程启动时间核对每个running的容器，死掉的标记为exited
+	2. 不在运行的容器释放cgroup、IP、Veth和DNAT规则
+	3. 可写层还在、但挂载点因为重启丢失的容器，重新挂载，保证commit/rm等命令可用
+	4. 没有任何容器状态对应的挂载点，卸载并删除
+	5. 状态目录已经不在的容器(比如启动到一半崩溃)，去掉它们对镜像layer的引用
+	每个命令启动时都会执行一次，也可以通过 system recover 单独执行
+*/
+func (eng *engine) reconcileContainers(st *store.Store) error {
+	// 同一时间只允许一个修复流程
+	l, err := st.LockGlobal("reconcile")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	containers, err := st.ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, info := range containers {
+		if info.Status == container.RUNNING || info.Status == container.CREATED {
+			if container.IsProcessAlive(info.Pid, info.StartTime) {
+				continue
+			}
+			log.Infof("container %s is marked running but its process %s is gone, mark it exited", info.Name, info.Pid)
+			if err := eng.containerExited(st, info, container.Exit, ""); err != nil {
+				log.Errorf("Update container %s status error %v", info.Name, err)
+				continue
+			}
+		}
+		// PID只在进程确认退出后才清空，stop等不到进程退出时还留着，这时不能释放资源
+		if info.Pid != "" && container.IsProcessAlive(info.Pid, info.StartTime) {
+			continue
+		}
+		if info.CgroupPath != "" || info.IPAddress != "" {
+			eng.releaseContainerResources(info)
+			err := st.UpdateContainer(info.Name, func(c *container.ContainerInfo) error {
+				c.CgroupPath = info.CgroupPath
+				c.Network = info.Network
+				c.IPAddress = info.IPAddress
+				return nil
+			})
+			if err != nil {
+				log.Errorf("Update container %s resources error %v", info.Name, err)
+			}
+		}
+		eng.restoreMountPoint(info)
+	}
+	eng.cleanOrphanMountPoints(st)
+	// 正在启动的容器已经占用了容器名，状态目录是在加引用之前创建的
+	err = eng.newImageStore().PruneRefs(func(containerName string) bool {
+		_, err := os.Stat(st.ContainerDir(containerName))
+		return err == nil
+	})
+	if err != nil {
+		log.Errorf("Prune image layer references error %v", err)
+	}
+	return nil
+}
+
+/*
+	containerExited 确认容器进程退出后，在容器锁内把还标记为运行中的容器改成status、清空PID，并记录die事件
+	stop、前台等待和状态修复可能同时发现同一个容器退出，只有完成状态转换的一方记录die，事件不会重复
+*/
+func (eng *engine) containerExited(st *store.Store, info *container.ContainerInfo, status, exitCode string) error {
+	exited := false
+	err := st.UpdateContainer(info.Name, func(c *container.ContainerInfo) error {
+		if c.Status != container.RUNNING && c.Status != container.CREATED {
+			return nil
+		}
+		c.Status = status
+		c.Pid = ""
+		c.StartTime = 0
+		exited = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if exited {
+		info.Status = status
+		info.Pid = ""
+		info.StartTime = 0
+		eng.recordContainerExit(info, exitCode)
+	}
+	return nil
+}
+
+// recordContainerExit 记录容器退出的事件，内存超限被杀的额外记一条oom
+// 要在释放cgroup之前调用，cgroup删掉之后就读不到OOM计数了
+func (eng *engine) recordContainerExit(info *container.ContainerInfo, exitCode string) {
+	journal := eng.newJournal()
+	attributes := containerAttributes(info)
+	if info.CgroupPath != "" {
+		memory := &subsystems.MemorySubSystem{}
+		if memory.OOMKilled(info.CgroupPath) {
+			journal.Log(events.TypeContainer, "oom", info.Id, attributes)
+		}
+	}
+	if exitCode != "" {
+		attributes["exitCode"] = exitCode
+	}
+	journal.Log(events.TypeContainer, "die", info.Id, attributes)
+}
+
+// releaseContainerResources 释放容器占用的cgroup和网络资源，释放成功的项会从info中清掉
+func (eng *engine) releaseContainerResources(info *container.ContainerInfo) {
+	if info.CgroupPath != "" {
+		cgroupManager := Cgroups.NewCgroupManager(info.CgroupPath)
+		if err := cgroupManager.Destroy(); err == nil {
+			info.CgroupPath = ""
+		}
+	}
+	if info.Network != "" && info.IPAddress != "" {
+		networks, err := eng.newNetworkManager()
+		if err != nil {
+			log.Errorf("Init network error %v", err)
+			return
+		}
+		if err := networks.Disconnect(info.Network, info); err != nil {
+			log.Errorf("Disconnect container %s from network %s error %v", info.Name, info.Network, err)
+			return
+		}
+		info.Network = ""
+		info.IPAddress = ""
+	}
+}
+
+// restoreMountPoint 可写层还在但没有挂载的容器(比如宿主机重启过)，重新挂载它的文件系统
+func (eng *engine) restoreMountPoint(info *container.ContainerInfo) {
+	if !info.HasWriteLayer() {
+		return
+	}
+	driver, err := eng.containerStorageDriver(info)
+	if err != nil {
+		log.Errorf("Get storage driver of container %s error %v", info.Name, err)
+		return
+	}
+	// 限制了大小的可写层在重启后没有挂载，UpperDir看不到，由驱动的Mount重新挂上
+	exist, _ := container.PathExists(driver.UpperDir(info.Name))
+	if !exist && !storage.HasQuota(eng.containerPaths().WriteLayerRoot(), info.Name) {
+		return
+	}
+	mntURL := eng.containerPaths().MntDir(info.Name)
+	if mounted, err := container.IsMounted(mntURL); err != nil || mounted {
+		return
+	}
+	log.Infof("restore mount point %s of container %s", mntURL, info.Name)
+	if err := container.CreateMountPoint(eng.containerPaths(), driver, info.Name, eng.containerLowerDirs(info)); err != nil {
+		log.Errorf("Restore mount point of container %s error %v", info.Name, err)
+	}
+}
+
+// cleanOrphanMountPoints 卸载并删除没有容器状态目录对应的挂载点
+// 状态目录在挂载之前就由ReserveName创建了，所以正在启动的容器不会被误删
+func (eng *engine) cleanOrphanMountPoints(st *store.Store) {
+	mntRoot := eng.containerPaths().MntRoot()
+	dirs, err := ioutil.ReadDir(mntRoot)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(st.ContainerDir(dir.Name())); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		mntURL := eng.containerPaths().MntDir(dir.Name())
+		if mounted, err := container.IsMounted(mntURL); err != nil || !mounted {
+			// 没有挂载的空目录直接删，非空的不动，避免误删数据
+			os.Remove(mntURL)
+			continue
+		}
+		log.Infof("remove orphan mount point of container %s", dir.Name())
+		container.DeleteMountPoint(eng.containerPaths(), dir.Name())
+	}
+}
+
+// needReconcile 容器内执行的init和exec回调进程不能做状态修复
+func needReconcile(command string) bool {
+	if os.Getenv(ENV_EXEC_PID) != "" {
+		return false
+	}
+	switch strings.TrimSpace(command) {
+	case "", "init", "help", "h":
+		return false
+	}
+	return true
+}
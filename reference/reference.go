@@ -0,0 +1,127 @@
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultDomain 没写仓库地址的镜像都在docker hub上
+	DefaultDomain = "docker.io"
+	DefaultTag    = "latest"
+	// docker hub上官方镜像的命名空间
+	officialRepoPrefix = "library/"
+	// 镜像名最长255个字符
+	nameTotalLengthMax = 255
+)
+
+// 和docker distribution的规则一致
+var (
+	domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domainRegexp    = regexp.MustCompile(`^` + domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?$`)
+	pathComponent   = `[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*`
+	pathRegexp      = regexp.MustCompile(`^` + pathComponent + `(?:/` + pathComponent + `)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference 一个镜像引用 domain/path:tag@digest，tag和digest都可能为空
+type Reference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+/*
+	Parse 解析并校验镜像引用，结果已经补全成完整的形式
+	1. 第一段带 . 或 : 或者是localhost时是仓库地址，否则是docker hub
+	2. docker hub上的官方镜像只有一段，要补上library/
+	3. 仓库路径只能是小写字母、数字和分隔符，不会包含 .. 这样的路径
+*/
+func Parse(s string) (Reference, error) {
+	var ref Reference
+	name := s
+	if i := strings.Index(name, "@"); i != -1 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid reference %q: invalid digest", s)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid reference %q: invalid tag", s)
+		}
+	}
+	if len(name) > nameTotalLengthMax {
+		return ref, fmt.Errorf("invalid reference %q: name longer than %d characters", s, nameTotalLengthMax)
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Domain, ref.Path = parts[0], parts[1]
+		if !domainRegexp.MatchString(ref.Domain) {
+			return ref, fmt.Errorf("invalid reference %q: invalid registry", s)
+		}
+	} else {
+		ref.Domain, ref.Path = DefaultDomain, name
+	}
+	if !pathRegexp.MatchString(ref.Path) {
+		return ref, fmt.Errorf("invalid reference %q: repository name must be lowercase letters, digits and separators", s)
+	}
+	if ref.Domain == DefaultDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = officialRepoPrefix + ref.Path
+	}
+	return ref, nil
+}
+
+// WithDefaultTag 没有tag也没有digest时用latest
+func (r Reference) WithDefaultTag() Reference {
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+	return r
+}
+
+// Reference 请求manifest时用的tag或者digest，两个都有时以digest为准
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Name 完整的仓库名 domain/path
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// FamiliarName 平时写的仓库名，省略docker.io和library/
+func (r Reference) FamiliarName() string {
+	if r.Domain != DefaultDomain {
+		return r.Name()
+	}
+	return strings.TrimPrefix(r.Path, officialRepoPrefix)
+}
+
+// String 完整的引用
+func (r Reference) String() string {
+	return r.Name() + r.suffix()
+}
+
+// Familiar 平时写的引用，比如 busybox:latest
+func (r Reference) Familiar() string {
+	return r.FamiliarName() + r.suffix()
+}
+
+func (r Reference) suffix() string {
+	s := ""
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,33 @@
+package reference
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for in, want := range map[string][2]string{
+		"busybox":                 {"docker.io/library/busybox:latest", "busybox:latest"},
+		"ubuntu:22.04":            {"docker.io/library/ubuntu:22.04", "ubuntu:22.04"},
+		"team/app:v1":             {"docker.io/team/app:v1", "team/app:v1"},
+		"localhost:5000/app":      {"localhost:5000/app:latest", "localhost:5000/app:latest"},
+		"reg.example.com/a/b:1.0": {"reg.example.com/a/b:1.0", "reg.example.com/a/b:1.0"},
+		"app@" + digest:           {"docker.io/library/app@" + digest, "app@" + digest},
+	} {
+		ref, err := Parse(in)
+		if err != nil {
+			t.Errorf("Parse(%q) error %v", in, err)
+			continue
+		}
+		ref = ref.WithDefaultTag()
+		if ref.String() != want[0] || ref.Familiar() != want[1] {
+			t.Errorf("Parse(%q) = %s / %s, want %s / %s", in, ref, ref.Familiar(), want[0], want[1])
+		}
+	}
+	for _, in := range []string{"", "Upper", "../etc", "a/../b", "a//b", "app@md5:1", "app:-bad", "app:", "-app", "a/b/"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) should fail", in)
+		}
+	}
+}
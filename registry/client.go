@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"cocin_dokcer/reference"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// docker hub的API地址和镜像名里的不一样
+const dockerHubHost = "registry-1.docker.io"
+
+// Client 访问一个仓库的registry v2 API
+type Client struct {
+	Domain string
+	// Insecure 用http而不是https访问仓库
+	Insecure bool
+	Username string
+	Password string
+	HTTP     *http.Client
+	// ChunkSize 推送时分块上传每块的大小，为0时用defaultChunkSize
+	ChunkSize int64
+
+	mu     sync.Mutex
+	basic  bool              // 仓库要求basic认证
+	tokens map[string]string // scope -> bearer token
+}
+
+// NewClient 返回访问domain的客户端，localhost和127.0.0.1默认用http
+func NewClient(domain string) *Client {
+	host := strings.Split(domain, ":")[0]
+	return &Client{
+		Domain:   domain,
+		Insecure: host == "localhost" || host == "127.0.0.1",
+		HTTP:     http.DefaultClient,
+		tokens:   make(map[string]string),
+	}
+}
+
+func (c *Client) url(path string) string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	host := c.Domain
+	if host == reference.DefaultDomain {
+		host = dockerHubHost
+	}
+	return scheme + "://" + host + "/v2/" + path
+}
+
+func pullScope(repo string) string {
+	return "repository:" + repo + ":pull"
+}
+
+func pushScope(repo string) string {
+	return "repository:" + repo + ":pull,push"
+}
+
+/*
+	do 发送请求，仓库返回401时按WWW-Authenticate的要求认证以后重试一次
+	Bearer认证向realm申请scope对应的token，token按scope缓存
+	带body的请求只有设置了GetBody才能重试
+*/
+func (c *Client) do(req *http.Request, scope string) (*http.Response, error) {
+	c.authorize(req, scope)
+	resp, err := c.HTTP.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.login(challenge, scope); err != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("%s %s unauthorized", req.Method, req.URL)
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(req, scope)
+	return c.HTTP.Do(req)
+}
+
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.tokens[scope]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basic {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func (c *Client) login(challenge, scope string) error {
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		if c.Username == "" {
+			return fmt.Errorf("registry %s requires credentials", c.Domain)
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		params := make(map[string]string)
+		for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+		token, err := c.fetchToken(params["realm"], params["service"], scope)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[scope] = token
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unsupported auth challenge %q from %s", challenge, c.Domain)
+}
+
+func (c *Client) fetchToken(realm, service, scope string) (string, error) {
+	if realm == "" {
+		return "", fmt.Errorf("auth challenge from %s has no realm", c.Domain)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s error %s", realm, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("parse token error %v", err)
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	return body.Token, nil
+}
+
+// statusError 把仓库返回的错误信息带上
+func statusError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s error %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,309 @@
+package registry
+
+import (
+	"cocin_dokcer/image"
+	"cocin_dokcer/reference"
+	"cocin_dokcer/store"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// 同时传输的blob数
+	maxConcurrentTransfers = 3
+	// 下载中断以后续传的次数
+	maxDownloadAttempts = 3
+	// manifest和镜像配置最大4M，防止仓库返回过大的内容
+	maxManifestSize = 4 << 20
+)
+
+var manifestMediaTypes = []string{
+	image.MediaTypeManifest,
+	image.MediaTypeIndex,
+	image.MediaTypeDockerManifest,
+	image.MediaTypeDockerManifestList,
+}
+
+/*
+	Pull 从仓库拉取镜像存进images，返回镜像ID
+	1. 取manifest，是多平台的manifest列表时选本机平台的那个
+	2. 取镜像配置，校验摘要
+	3. 并发下载本地还没有的layer，中断了从已下载的位置续传，下载完校验摘要
+	4. layer解压后的摘要和配置里的diff_ids一致才保存镜像
+*/
+func (c *Client) Pull(images *image.Store, ref reference.Reference) (string, error) {
+	content, mediaType, err := c.fetchManifest(ref.Path, ref.Reference())
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" && image.Digest(content) != ref.Digest {
+		return "", fmt.Errorf("manifest digest mismatch for %s", ref)
+	}
+	if image.IsIndex(mediaType) {
+		var index image.Index
+		if err := json.Unmarshal(content, &index); err != nil {
+			return "", fmt.Errorf("parse manifest list error %v", err)
+		}
+		desc, err := selectPlatform(index)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", ref, err)
+		}
+		if content, _, err = c.fetchManifest(ref.Path, desc.Digest); err != nil {
+			return "", err
+		}
+		if image.Digest(content) != desc.Digest {
+			return "", fmt.Errorf("manifest digest mismatch for %s", desc.Digest)
+		}
+	}
+	var manifest image.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("parse manifest error %v", err)
+	}
+	config, err := c.fetchBlob(ref.Path, manifest.Config)
+	if err != nil {
+		return "", err
+	}
+	var img image.Image
+	if err := json.Unmarshal(config, &img); err != nil {
+		return "", fmt.Errorf("parse image config error %v", err)
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return "", fmt.Errorf("image has %d layers but config lists %d diff ids", len(manifest.Layers), len(img.RootFS.DiffIDs))
+	}
+	downloads := filepath.Join(images.Root, "tmp", "downloads")
+	if err := os.MkdirAll(downloads, 0700); err != nil {
+		return "", err
+	}
+	layers, diffIDs, err := uniqueLayers(manifest.Layers, img.RootFS.DiffIDs)
+	if err != nil {
+		return "", err
+	}
+	err = parallel(len(layers), func(i int) error {
+		diffID, layer := diffIDs[i], layers[i]
+		if images.HasLayer(diffID) {
+			log.Infof("Layer %s already exists", layer.Digest)
+			return nil
+		}
+		return c.pullLayer(images, ref.Path, layer, diffID, downloads)
+	})
+	if err != nil {
+		return "", err
+	}
+	return images.PutImageConfig(config)
+}
+
+// uniqueLayers 去掉manifest里重复的layer(比如多个空layer)，同一个blob只下载一次，不然几个goroutine会同时写同一个下载文件
+func uniqueLayers(layers []image.Descriptor, diffIDs []string) ([]image.Descriptor, []string, error) {
+	seen := make(map[string]string)
+	var uniqueDescs []image.Descriptor
+	var uniqueDiffIDs []string
+	for i, layer := range layers {
+		if diffID, ok := seen[layer.Digest]; ok {
+			if diffID != diffIDs[i] {
+				return nil, nil, fmt.Errorf("layer %s has different diff ids %s and %s", layer.Digest, diffID, diffIDs[i])
+			}
+			continue
+		}
+		seen[layer.Digest] = diffIDs[i]
+		uniqueDescs = append(uniqueDescs, layer)
+		uniqueDiffIDs = append(uniqueDiffIDs, diffIDs[i])
+	}
+	return uniqueDescs, uniqueDiffIDs, nil
+}
+
+func selectPlatform(index image.Index) (image.Descriptor, error) {
+	for _, desc := range index.Manifests {
+		if desc.Platform != nil && image.MatchesHost(desc.Platform) {
+			return desc, nil
+		}
+	}
+	return image.Descriptor{}, fmt.Errorf("no image for linux/%s", runtime.GOARCH)
+}
+
+func (c *Client) fetchManifest(repo, reference string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(repo+"/manifests/"+reference), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", statusError(resp)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	// 有的仓库不返回准确的Content-Type，以manifest里写的为准
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(content, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+	return content, mediaType, nil
+}
+
+// fetchBlob 把小的blob读到内存里，校验摘要
+func (c *Client) fetchBlob(repo string, desc image.Descriptor) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(repo+"/blobs/"+desc.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	if image.Digest(content) != desc.Digest {
+		return nil, fmt.Errorf("blob %s digest mismatch", desc.Digest)
+	}
+	return content, nil
+}
+
+/*
+	pullLayer 下载一个layer并导入镜像存储
+	下载文件按摘要命名，中断了下次还能续传；同时进行的另一个pull可能在下载同一个layer，
+	先对这个摘要加锁，拿到锁以后layer可能已经被导入了
+*/
+func (c *Client) pullLayer(images *image.Store, repo string, desc image.Descriptor, diffID, downloads string) error {
+	hexPart, err := image.DigestHex(desc.Digest)
+	if err != nil {
+		return err
+	}
+	lock, err := store.LockFile(filepath.Join(downloads, hexPart+".lock"), true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if images.HasLayer(diffID) {
+		log.Infof("Layer %s already exists", desc.Digest)
+		return nil
+	}
+	partial := filepath.Join(downloads, hexPart+".partial")
+	for attempt := 1; ; attempt++ {
+		if err = c.downloadBlob(repo, desc, partial); err == nil {
+			break
+		}
+		if attempt == maxDownloadAttempts {
+			return fmt.Errorf("download layer %s error %v", desc.Digest, err)
+		}
+		log.Warnf("Download layer %s error %v, resuming", desc.Digest, err)
+	}
+	defer os.Remove(partial)
+	if err := verifyFile(partial, desc.Digest); err != nil {
+		return err
+	}
+	log.Infof("Downloaded layer %s", desc.Digest)
+	return images.ImportLayer(partial, desc.Digest, diffID)
+}
+
+// downloadBlob 把blob下载到path，path里已经有的部分用Range请求跳过
+func (c *Client) downloadBlob(repo string, desc image.Descriptor, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset == desc.Size {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, c.url(repo+"/blobs/"+desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 仓库不支持Range，从头下载
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 已下载的部分不对，下次从头开始
+		f.Truncate(0)
+		return statusError(resp)
+	default:
+		return statusError(resp)
+	}
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// verifyFile 校验文件的摘要，不对的话删掉，下次重新下载
+func verifyFile(path, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		os.Remove(path)
+		return fmt.Errorf("blob %s digest mismatch", digest)
+	}
+	return nil
+}
+
+// parallel 最多maxConcurrentTransfers个并发执行fn(0..n-1)，返回第一个错误
+func parallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, maxConcurrentTransfers)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(i); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
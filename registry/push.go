@@ -0,0 +1,289 @@
+package registry
+
+import (
+	"bytes"
+	"cocin_dokcer/image"
+	"cocin_dokcer/reference"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 分块上传时每个PATCH请求的大小，中断了只需要重传当前这一块
+	defaultChunkSize = 8 << 20
+	// 一块上传失败以后按仓库记录的进度续传的次数
+	maxUploadAttempts = 3
+)
+
+/*
+	Push 把镜像推送到仓库，返回manifest的摘要
+	1. 并发上传仓库里还没有的layer，layer按不压缩的tar上传，摘要就是diff_id
+	   每个blob分块PATCH上传，一块失败了向仓库查询已收到的范围，从那里续传
+	2. 上传镜像配置
+	3. 最后上传manifest，打上ref的tag
+*/
+func (c *Client) Push(images *image.Store, id string, ref reference.Reference) (string, error) {
+	if ref.Tag == "" {
+		return "", fmt.Errorf("push %s: a tag is required", ref)
+	}
+	config, err := images.RawConfig(id)
+	if err != nil {
+		return "", err
+	}
+	var img image.Image
+	if err := json.Unmarshal(config, &img); err != nil {
+		return "", err
+	}
+	manifest := image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeConfig, Digest: id, Size: int64(len(config))},
+		Layers:        make([]image.Descriptor, len(img.RootFS.DiffIDs)),
+	}
+	err = parallel(len(img.RootFS.DiffIDs), func(i int) error {
+		diffID := img.RootFS.DiffIDs[i]
+		size, err := images.LayerSize(diffID)
+		if err != nil {
+			return err
+		}
+		desc := image.Descriptor{MediaType: image.MediaTypeLayer, Digest: diffID, Size: size}
+		manifest.Layers[i] = desc
+		blob, err := images.LayerBlob(diffID)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(blob)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.pushBlob(ref.Path, desc, f)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := c.pushBlob(ref.Path, manifest.Config, bytes.NewReader(config)); err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.url(ref.Path+"/manifests/"+ref.Tag), bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", image.MediaTypeManifest)
+	resp, err := c.do(req, pushScope(ref.Path))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+	return image.Digest(content), nil
+}
+
+// chunkSize 分块上传每块的大小
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+/*
+	pushBlob 仓库里没有这个blob时，申请一个上传会话，分块PATCH上传content，最后PUT带上摘要完成上传
+	每块上传成功后仓库在Range里返回已收到的范围，失败时用GET查询上传会话的进度，从仓库已收到的位置续传
+*/
+func (c *Client) pushBlob(repo string, desc image.Descriptor, content io.ReaderAt) error {
+	exists, err := c.blobExists(repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Infof("Blob %s already exists", desc.Digest)
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url(repo+"/blobs/uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return statusError(resp)
+	}
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	attempt := 1
+	for offset < desc.Size {
+		end := offset + c.chunkSize()
+		if end > desc.Size {
+			end = desc.Size
+		}
+		next, received, err := c.uploadChunk(repo, location, content, offset, end)
+		if err == nil && received <= offset {
+			return fmt.Errorf("upload blob %s error registry did not accept bytes from %d", desc.Digest, offset)
+		}
+		if err == nil {
+			location, offset, attempt = next, received, 1
+			continue
+		}
+		if attempt == maxUploadAttempts {
+			return fmt.Errorf("upload blob %s error %v", desc.Digest, err)
+		}
+		attempt++
+		next, received, statusErr := c.uploadStatus(repo, location)
+		if statusErr != nil {
+			return fmt.Errorf("upload blob %s error %v, get upload status error %v", desc.Digest, err, statusErr)
+		}
+		log.Warnf("Upload blob %s error %v, resuming from %d", desc.Digest, err, received)
+		location, offset = next, received
+	}
+	return c.finishUpload(repo, location, desc)
+}
+
+// uploadChunk 上传content的[offset, end)，返回下一个请求要用的上传地址和仓库已收到的字节数
+func (c *Client) uploadChunk(repo string, location *url.URL, content io.ReaderAt, offset, end int64) (*url.URL, int64, error) {
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(content, offset, end-offset)), nil
+	}
+	body, _ := open()
+	req, err := http.NewRequest(http.MethodPatch, location.String(), body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = end - offset
+	req.GetBody = open
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, end-1))
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, 0, statusError(resp)
+	}
+	next, err := uploadLocation(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	received, err := uploadedSize(resp, end)
+	return next, received, err
+}
+
+// uploadStatus 查询上传会话的进度，返回上传地址和仓库已收到的字节数
+func (c *Client) uploadStatus(repo string, location *url.URL) (*url.URL, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, 0, statusError(resp)
+	}
+	next, err := uploadLocation(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	received, err := uploadedSize(resp, 0)
+	return next, received, err
+}
+
+// finishUpload 所有内容都上传以后，PUT带上摘要结束上传会话，仓库校验摘要
+func (c *Client) finishUpload(repo string, location *url.URL, desc image.Descriptor) error {
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodPut, location.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+	log.Infof("Pushed blob %s", desc.Digest)
+	return nil
+}
+
+// uploadLocation 仓库返回的上传地址，可能是相对路径；没有返回新地址时继续用原来的
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return resp.Request.URL, nil
+	}
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location error %v", err)
+	}
+	return u, nil
+}
+
+/*
+	uploadedSize 按Range头 "0-<最后一个字节的位置>" 算出仓库已收到的字节数，没有Range头时返回defaultSize
+	仓库对空的上传会话也返回 0-0，和收到1个字节分不开：查询进度时当作没收到，重传的部分仓库会拒绝；上传成功以后当作收到了1个字节
+*/
+func uploadedSize(resp *http.Response, defaultSize int64) (int64, error) {
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return defaultSize, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 || parts[0] != "0" {
+		return 0, fmt.Errorf("invalid upload range %q", rng)
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || last < 0 {
+		return 0, fmt.Errorf("invalid upload range %q", rng)
+	}
+	if last == 0 && defaultSize <= 1 {
+		return defaultSize, nil
+	}
+	return last + 1, nil
+}
+
+func (c *Client) blobExists(repo, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url(repo+"/blobs/"+digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD blob %s error %s", digest, resp.Status)
+}
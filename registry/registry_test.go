@@ -0,0 +1,373 @@
+package registry
+
+import (
+	"bytes"
+	"cocin_dokcer/archive"
+	"cocin_dokcer/image"
+	"cocin_dokcer/reference"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry 测试用的仓库，需要bearer token，blob支持Range请求，上传支持分块PATCH
+type fakeRegistry struct {
+	*httptest.Server
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte // 上传会话 -> 已收到的内容
+	fetches   map[string]int    // blob摘要 -> GET的次数
+	ranges    int
+	patches   int
+	failPatch int // 接下来这么多个PATCH只收一半内容就返回500
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		uploads:   make(map[string][]byte),
+		fetches:   make(map[string]int),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer t0ken" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.URL+`/token",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, path)
+	case strings.Contains(path, "/blobs/"):
+		content, ok := r.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodGet {
+			r.fetches[path[strings.LastIndex(path, "/")+1:]]++
+		}
+		if req.Header.Get("Range") != "" {
+			r.ranges++
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	case strings.Contains(path, "/manifests/"):
+		if req.Method == http.MethodPut {
+			content, _ := ioutil.ReadAll(req.Body)
+			r.putManifest(path, req.Header.Get("Content-Type"), content)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		content, ok := r.manifests[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", r.types[path])
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveUpload 上传会话：POST创建，PATCH按Content-Range追加，GET查询进度，PUT校验摘要后完成
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, path string) {
+	if req.Method == http.MethodPost {
+		session := fmt.Sprintf("session%d", len(r.uploads)+1)
+		r.uploads[session] = []byte{}
+		w.Header().Set("Location", "/v2/"+path+session)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	session := path[strings.LastIndex(path, "/")+1:]
+	received, ok := r.uploads[session]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	content, _ := ioutil.ReadAll(req.Body)
+	switch req.Method {
+	case http.MethodPatch:
+		r.patches++
+		if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", len(received), len(received)+len(content)-1) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if r.failPatch > 0 {
+			r.failPatch--
+			r.uploads[session] = append(received, content[:len(content)/2]...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.uploads[session] = append(received, content...)
+		w.Header().Set("Location", req.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.uploads[session])-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		w.Header().Set("Location", req.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(received)-1))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		received = append(received, content...)
+		if image.Digest(received) != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, session)
+		r.blobs[image.Digest(received)] = received
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// putManifest 按tag和摘要都能取到
+func (r *fakeRegistry) putManifest(path, mediaType string, content []byte) {
+	byDigest := path[:strings.LastIndex(path, "/")+1] + image.Digest(content)
+	for _, p := range []string{path, byDigest} {
+		r.manifests[p] = content
+		r.types[p] = mediaType
+	}
+}
+
+func (r *fakeRegistry) client() *Client {
+	c := NewClient(strings.TrimPrefix(r.URL, "http://"))
+	c.Username, c.Password = "user", "secret"
+	return c
+}
+
+func newTestImage(t *testing.T) (*image.Store, string) {
+	st := image.New(t.TempDir())
+	rootfs := t.TempDir()
+	ioutil.WriteFile(filepath.Join(rootfs, "hello"), bytes.Repeat([]byte("hello"), 1000), 0644)
+	var buf bytes.Buffer
+	if err := archive.Tar(rootfs, &buf); err != nil {
+		t.Fatalf("tar rootfs error %v", err)
+	}
+	id, err := st.ImportRootfs(&buf, "app", "test")
+	if err != nil {
+		t.Fatalf("import rootfs error %v", err)
+	}
+	return st, id
+}
+
+func TestPushPull(t *testing.T) {
+	reg := newFakeRegistry(t)
+	src, id := newTestImage(t)
+	ref := reference.Reference{Domain: reg.client().Domain, Path: "team/app", Tag: "v1"}
+	if _, err := reg.client().Push(src, id, ref); err != nil {
+		t.Fatalf("push error %v", err)
+	}
+
+	dst := image.New(t.TempDir())
+	got, err := reg.client().Pull(dst, ref)
+	if err != nil || got != id {
+		t.Fatalf("pull = %s, %v, want %s", got, err, id)
+	}
+
+	// 没有凭据拿不到token
+	anonymous := NewClient(ref.Domain)
+	if _, err := anonymous.Pull(image.New(t.TempDir()), ref); err == nil {
+		t.Errorf("pull without credentials should fail")
+	}
+}
+
+func TestPullManifestListAndResume(t *testing.T) {
+	reg := newFakeRegistry(t)
+	src, id := newTestImage(t)
+	ref := reference.Reference{Domain: reg.client().Domain, Path: "team/app", Tag: "v1"}
+	manifestDigest, err := reg.client().Push(src, id, ref)
+	if err != nil {
+		t.Fatalf("push error %v", err)
+	}
+	index, _ := json.Marshal(image.Index{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeIndex,
+		Manifests: []image.Descriptor{
+			{MediaType: image.MediaTypeManifest, Digest: image.Digest([]byte("other")), Platform: &image.Platform{OS: "linux", Architecture: "s390x"}},
+			{MediaType: image.MediaTypeManifest, Digest: manifestDigest, Platform: &image.Platform{OS: "linux", Architecture: runtime.GOARCH}},
+		},
+	})
+	reg.putManifest("team/app/manifests/multi", image.MediaTypeIndex, index)
+
+	// 模拟上次下载到一半中断了
+	dst := image.New(t.TempDir())
+	img, _ := src.GetImage(id)
+	diffID := img.RootFS.DiffIDs[0]
+	blob, _ := ioutil.ReadFile(mustLayerBlob(t, src, diffID))
+	hexPart, _ := image.DigestHex(diffID)
+	downloads := filepath.Join(dst.Root, "tmp", "downloads")
+	os.MkdirAll(downloads, 0700)
+	ioutil.WriteFile(filepath.Join(downloads, hexPart+".partial"), blob[:len(blob)/2], 0600)
+
+	got, err := reg.client().Pull(dst, reference.Reference{Domain: ref.Domain, Path: ref.Path, Tag: "multi"})
+	if err != nil || got != id {
+		t.Fatalf("pull = %s, %v, want %s", got, err, id)
+	}
+	if reg.ranges != 1 {
+		t.Errorf("expected the layer download to resume with a Range request, got %d", reg.ranges)
+	}
+}
+
+func mustLayerBlob(t *testing.T, st *image.Store, digest string) string {
+	blob, err := st.LayerBlob(digest)
+	if err != nil {
+		t.Fatalf("layer blob error %v", err)
+	}
+	return blob
+}
+
+func TestPushChunkedResume(t *testing.T) {
+	reg := newFakeRegistry(t)
+	src, id := newTestImage(t)
+	ref := reference.Reference{Domain: reg.client().Domain, Path: "team/app", Tag: "v1"}
+	client := reg.client()
+	client.ChunkSize = 1000
+	// 第一块只传了一半仓库就出错，要查询进度以后从仓库收到的位置续传
+	reg.failPatch = 1
+	if _, err := client.Push(src, id, ref); err != nil {
+		t.Fatalf("push error %v", err)
+	}
+	img, _ := src.GetImage(id)
+	blob, _ := ioutil.ReadFile(mustLayerBlob(t, src, img.RootFS.DiffIDs[0]))
+	if !bytes.Equal(reg.blobs[img.RootFS.DiffIDs[0]], blob) {
+		t.Fatalf("uploaded layer differs from the local blob")
+	}
+	if chunks := len(blob)/1000 + 1; reg.patches <= chunks {
+		t.Errorf("expected more than %d PATCH requests for a %d byte layer with one failure, got %d", chunks, len(blob), reg.patches)
+	}
+	if len(reg.uploads) != 0 {
+		t.Errorf("upload sessions should be finished, got %d left", len(reg.uploads))
+	}
+
+	got, err := reg.client().Pull(image.New(t.TempDir()), ref)
+	if err != nil || got != id {
+		t.Fatalf("pull = %s, %v, want %s", got, err, id)
+	}
+}
+
+func TestPushGivesUpAfterRetries(t *testing.T) {
+	reg := newFakeRegistry(t)
+	src, id := newTestImage(t)
+	ref := reference.Reference{Domain: reg.client().Domain, Path: "team/app", Tag: "v1"}
+	reg.failPatch = 100
+	if _, err := reg.client().Push(src, id, ref); err == nil {
+		t.Errorf("push should fail when every chunk fails")
+	}
+}
+
+func TestUploadedSize(t *testing.T) {
+	tests := []struct {
+		rng         string
+		defaultSize int64
+		want        int64
+		ok          bool
+	}{
+		{"", 42, 42, true},
+		{"0-1023", 0, 1024, true},
+		{"bytes=0-9", 0, 10, true},
+		{"0-0", 0, 0, true},
+		{"0-0", 1, 1, true},
+		{"0-0", 1000, 1, true},
+		{"5-9", 0, 0, false},
+		{"0-x", 0, 0, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.rng != "" {
+			resp.Header.Set("Range", test.rng)
+		}
+		got, err := uploadedSize(resp, test.defaultSize)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("uploadedSize(%q, %d) = %d, %v, want %d", test.rng, test.defaultSize, got, err, test.want)
+		}
+	}
+}
+
+func TestPullDuplicateLayers(t *testing.T) {
+	reg := newFakeRegistry(t)
+	src, id := newTestImage(t)
+	ref := reference.Reference{Domain: reg.client().Domain, Path: "team/app", Tag: "v1"}
+	manifestDigest, err := reg.client().Push(src, id, ref)
+	if err != nil {
+		t.Fatalf("push error %v", err)
+	}
+	// 同一个layer在manifest里出现两次，比如两个空layer
+	var manifest image.Manifest
+	json.Unmarshal(reg.manifests["team/app/manifests/"+manifestDigest], &manifest)
+	config, _ := src.RawConfig(id)
+	var img image.Image
+	json.Unmarshal(config, &img)
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, img.RootFS.DiffIDs[0])
+	img.History = append(img.History, img.History[0])
+	config, _ = json.Marshal(img)
+	reg.blobs[image.Digest(config)] = config
+	manifest.Config.Digest, manifest.Config.Size = image.Digest(config), int64(len(config))
+	manifest.Layers = append(manifest.Layers, manifest.Layers[0])
+	content, _ := json.Marshal(manifest)
+	reg.putManifest("team/app/manifests/dup", image.MediaTypeManifest, content)
+
+	// 两个pull同时拉同一个镜像到同一个存储里
+	dst := image.New(t.TempDir())
+	dup := reference.Reference{Domain: ref.Domain, Path: ref.Path, Tag: "dup"}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = reg.client().Pull(dst, dup)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("concurrent pull error %v", err)
+		}
+	}
+	if got := reg.fetches[manifest.Layers[0].Digest]; got != 1 {
+		t.Errorf("a repeated layer should be downloaded once, got %d downloads", got)
+	}
+	if !dst.HasLayer(img.RootFS.DiffIDs[0]) {
+		t.Errorf("layer not imported")
+	}
+}
+
+func TestUniqueLayersConflict(t *testing.T) {
+	layers := []image.Descriptor{{Digest: "sha256:a"}, {Digest: "sha256:a"}}
+	if _, _, err := uniqueLayers(layers, []string{"sha256:x", "sha256:y"}); err == nil {
+		t.Errorf("the same blob with different diff ids should fail")
+	}
+	descs, diffIDs, err := uniqueLayers(layers, []string{"sha256:x", "sha256:x"})
+	if err != nil || len(descs) != 1 || len(diffIDs) != 1 {
+		t.Errorf("uniqueLayers = %v, %v, %v", descs, diffIDs, err)
+	}
+}
@@ -4,144 +4,314 @@ import (
 	"cocin_dokcer/Cgroups"
 	"cocin_dokcer/Cgroups/subsystems"
 	"cocin_dokcer/container"
-	"cocin_dokcer/network"
-	"encoding/json"
+	"cocin_dokcer/events"
+	"cocin_dokcer/image"
+	"cocin_dokcer/storage"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"math/rand"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const containerIDLength = 10
-
 // Run 运行命令
-func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, containerName, imageName string, envSlice []string, nw string, portmapping []string) {
+func (eng *engine) Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, containerName, imageName, rootfs string, envSlice []string, nw string, portmapping []string, hooks *container.Hooks, storageSize int64) error {
 	// 生成ID
-	id := randStringBytes(containerIDLength)
-	// 没指定名字，按照ID来
+	id, err := container.GenerateContainerID()
+	if err != nil {
+		return err
+	}
+	// 没指定名字，按照短ID来
 	if containerName == "" {
-		containerName = id
+		containerName = container.ShortID(id)
 	}
-
-	parent, writePipe := container.NewParentProcess(tty, volume, containerName, imageName, envSlice)
-	if parent == nil {
-		log.Errorf("New parent process error")
-		return
+	driver, err := eng.newStorageDriver()
+	if err != nil {
+		return err
 	}
-	if err := parent.Start(); err != nil {
-		log.Error(err)
+	var imageID string
+	img := &image.Image{}
+	if rootfs != "" {
+		// 宿主机目录直接作为唯一的只读层，不经过镜像存储，也就没有镜像的默认配置
+		if rootfs, err = eng.containerPaths().HostRootfs(rootfs); err != nil {
+			return err
+		}
+	} else if imageID, img, err = eng.resolveImage(eng.newImageStore(), imageName); err != nil {
+		return err
 	}
-	// 记录容器信息
-	containerName, err := recordContainerInfo(parent.Process.Pid, comArray, containerName, id, volume)
+	// 没有给命令时用镜像的Entrypoint和Cmd，镜像里的环境变量可以被-e覆盖
+	comArray = img.Config.Command(comArray)
+	if len(comArray) == 0 {
+		return fmt.Errorf("no command specified and image %s has no default command", imageName)
+	}
+	parent, writePipe, containerInfo, err := eng.launchContainer(driver, launchSpec{
+		ID:          id,
+		Name:        containerName,
+		Image:       img,
+		ImageID:     imageID,
+		ImageName:   imageName,
+		Rootfs:      rootfs,
+		Command:     comArray,
+		Env:         append(append([]string(nil), img.Config.Env...), envSlice...),
+		TTY:         tty,
+		Volume:      volume,
+		PortMapping: portmapping,
+		StorageSize: storageSize,
+		CgroupPath:  Cgroups.ContainerCgroupPath(id),
+		Hooks:       hooks,
+	})
 	if err != nil {
-		log.Errorf("Record container info error %v", err)
-		return
+		return err
 	}
+	journal := eng.newJournal()
 
-	// 创建cgroup manager
-	cgroupManager := Cgroups.NewCgroupManager("cocin_docker-cgroup")
-	defer cgroupManager.Destroy()
-	// 设置资源限制
-	cgroupManager.Set(res)
-	cgroupManager.Apply(parent.Process.Pid)
+	// 创建cgroup manager，每个容器一个cgroup，容器退出后由前台等待或者状态修复流程释放
+	cgroupManager := Cgroups.NewCgroupManager(containerInfo.CgroupPath)
+	// 设置资源限制，要求的限制不生效时不启动容器
+	if err := cgroupManager.Set(res); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
 
 	if nw != "" {
 		// config container network
-		network.Init()
-		containerInfo := &container.ContainerInfo{
-			Id:          id,
-			Pid:         strconv.Itoa(parent.Process.Pid),
-			Name:        containerName,
-			PortMapping: portmapping,
+		networks, err := eng.newNetworkManager()
+		if err != nil {
+			writePipe.Close()
+			eng.abortContainer(parent, containerInfo)
+			return fmt.Errorf("init network error %v", err)
 		}
-		if err := network.Connect(nw, containerInfo); err != nil {
-			log.Errorf("Error Connect Network %v", err)
-			return
+		if err := networks.Connect(nw, containerInfo); err != nil {
+			writePipe.Close()
+			eng.abortContainer(parent, containerInfo)
+			return fmt.Errorf("connect container %s to network %s error %v", containerName, nw, err)
+		}
+		// 把分到的IP记下来，容器退出后才能释放
+		err = eng.newStateStore().UpdateContainer(containerName, func(info *container.ContainerInfo) error {
+			info.Network = containerInfo.Network
+			info.IPAddress = containerInfo.IPAddress
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Record container %s network error %v", containerName, err)
 		}
 	}
 
-	// 设置完限制后 初始化容器
-	sendInitCommand(comArray, writePipe)
+	// namespace、cgroup和网络都准备好了，用户命令还没执行，这时调用prestart和createRuntime hook
+	// 任何一个失败都要把已经创建的容器清理掉
+	if hooks != nil {
+		state := containerInfo.OCIState(eng.containerPaths(), container.StateCreated)
+		if err := container.RunHooks(append(hooks.Prestart, hooks.CreateRuntime...), state); err != nil {
+			writePipe.Close()
+			eng.abortContainer(parent, containerInfo)
+			return fmt.Errorf("run prestart hooks of container %s error %v", containerName, err)
+		}
+	}
+
+	// 设置完限制后 初始化容器，镜像里的用户名要在容器的rootfs里查
+	initConfig, err := eng.imageInitConfig(comArray, img.Config, containerName)
+	if err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return err
+	}
+	sendInitCommand(initConfig, writePipe)
+	journal.Log(events.TypeContainer, "start", id, containerAttributes(containerInfo))
+	// poststart失败不影响已经启动的容器，只记录警告
+	if hooks != nil {
+		if err := container.RunHooks(hooks.Poststart, containerInfo.OCIState(eng.containerPaths(), container.StateRunning)); err != nil {
+			log.Warnf("Run poststart hooks of container %s error %v", containerName, err)
+		}
+	}
 	if tty {
 		parent.Wait()
-		deleteContainerInfo(containerName)
-		container.DeleteWorkSpace(volume, containerName)
+		if err := eng.containerExited(eng.newStateStore(), containerInfo, container.Exit, strconv.Itoa(parent.ProcessState.ExitCode())); err != nil {
+			log.Errorf("Update container %s status error %v", containerName, err)
+		}
+		eng.destroyContainer(containerInfo)
 	}
-
+	return nil
 }
 
-// sendInitCommand 发送用户命令进行初始化
-func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
-	log.Infof("command all is %s", command)
-	writePipe.WriteString(command)
-	writePipe.Close()
+// launchSpec 启动一个容器需要的参数，run和build的RUN共用
+type launchSpec struct {
+	ID          string
+	Name        string
+	Image       *image.Image // 只读层来自的镜像，Rootfs不为空时不用
+	ImageID     string
+	ImageName   string
+	Rootfs      string // 作为唯一只读层的宿主机目录，为空时用镜像的layer
+	Command     []string
+	Env         []string
+	TTY         bool
+	NoStdin     bool // 不从终端读输入，build的RUN用
+	Volume      string
+	PortMapping []string
+	StorageSize int64
+	CgroupPath  string
+	Hooks       *container.Hooks
 }
 
-// ID 生成器
-func randStringBytes(n int) string {
-	letterBytes := "1234567890"
-	rand.Seed(time.Now().UnixNano())
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+/*
+	launchContainer 占用容器名、引用镜像的layer、准备文件系统并启动init进程，记录容器状态
+	返回时init进程阻塞在管道上等待配置，之后的步骤失败由调用方用abortContainer清理
+	进程启动之前失败时，由这里统一回滚：只释放已经加上的镜像引用，再释放容器名
+*/
+func (eng *engine) launchContainer(driver storage.Driver, spec launchSpec) (*exec.Cmd, *os.File, *container.ContainerInfo, error) {
+	if err := container.ReserveName(eng.containerPaths(), spec.Name); err != nil {
+		return nil, nil, nil, err
 	}
-	return string(b)
-}
+	started, refAdded := false, false
+	defer func() {
+		if started {
+			return
+		}
+		if refAdded {
+			eng.releaseImageRef(spec.Name)
+		}
+		container.ReleaseName(eng.containerPaths(), spec.Name)
+	}()
 
-// 记录容器的基本信息
-func recordContainerInfo(containerPID int, commandArray []string, containerName, id, volume string) (string, error) {
-	// 当前时间作为创建时间
-	createTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandArray, "")
-	// 生成容器信息结构体
+	lowerDirs := []string{spec.Rootfs}
+	if spec.Rootfs == "" {
+		// 先加上引用再解包，解包的过程中镜像不会被rmi删掉
+		images := eng.newImageStore()
+		if err := images.AddRef(spec.Name, spec.Image); err != nil {
+			return nil, nil, nil, err
+		}
+		refAdded = true
+		var err error
+		if lowerDirs, err = images.LowerDirs(spec.Image, driver.WhiteoutFormat()); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	parent, writePipe := container.NewParentProcess(eng.containerPaths(), driver, spec.TTY, spec.Volume, spec.Name, lowerDirs, spec.Env, spec.StorageSize)
+	if parent == nil {
+		return nil, nil, nil, fmt.Errorf("New parent process error")
+	}
+	if spec.NoStdin {
+		parent.Stdin = nil
+	}
+	if err := parent.Start(); err != nil {
+		container.DeleteWorkSpace(eng.containerPaths(), driver, spec.Volume, spec.Name)
+		return nil, nil, nil, err
+	}
+	started = true
+
+	// 记录容器信息
+	startTime, err := container.ProcessStartTime(parent.Process.Pid)
+	if err != nil {
+		log.Warnf("Get start time of pid %d error %v", parent.Process.Pid, err)
+	}
 	containerInfo := &container.ContainerInfo{
-		Pid:         strconv.Itoa(containerPID),
-		Id:          id,
-		Name:        containerName,
-		Command:     command,
-		CreatedTime: createTime,
-		Status:      container.RUNNING,
-		Volume:      volume,
+		Pid:           strconv.Itoa(parent.Process.Pid),
+		Id:            spec.ID,
+		Name:          spec.Name,
+		Command:       strings.Join(spec.Command, " "),
+		CreatedTime:   time.Now().Format("2006-01-02 15:04:05"),
+		Status:        container.RUNNING,
+		Volume:        spec.Volume,
+		PortMapping:   spec.PortMapping,
+		StartTime:     startTime,
+		ImageName:     spec.ImageName,
+		ImageID:       spec.ImageID,
+		LowerDirs:     lowerDirs,
+		StorageSize:   spec.StorageSize,
+		CgroupPath:    spec.CgroupPath,
+		Hooks:         spec.Hooks,
+		StorageDriver: driver.Name(),
+		Rootfs:        spec.Rootfs,
+	}
+	if err := eng.recordContainerInfo(containerInfo); err != nil {
+		writePipe.Close()
+		eng.abortContainer(parent, containerInfo)
+		return nil, nil, nil, fmt.Errorf("record container %s info error %v", spec.Name, err)
 	}
+	eng.newJournal().Log(events.TypeContainer, "create", spec.ID, containerAttributes(containerInfo))
+	return parent, writePipe, containerInfo, nil
+}
+
+// abortContainer 启动过程中失败时杀掉容器进程并清理掉它的一切
+func (eng *engine) abortContainer(parent *exec.Cmd, containerInfo *container.ContainerInfo) {
+	parent.Process.Kill()
+	parent.Wait()
+	eng.recordContainerExit(containerInfo, strconv.Itoa(parent.ProcessState.ExitCode()))
+	eng.destroyContainer(containerInfo)
+}
 
-	// json序列化
-	jsonBytes, err := json.Marshal(containerInfo)
+// destroyContainer 释放已退出容器的资源、状态和文件系统，最后执行poststop hook
+func (eng *engine) destroyContainer(containerInfo *container.ContainerInfo) {
+	eng.releaseContainerResources(containerInfo)
+	eng.deleteContainerInfo(containerInfo.Name)
+	eng.deleteWorkSpace(containerInfo)
+	eng.releaseImageRef(containerInfo.Name)
+	eng.runPoststopHooks(containerInfo)
+	eng.newJournal().Log(events.TypeContainer, "destroy", containerInfo.Id, containerAttributes(containerInfo))
+}
+
+// releaseImageRef 去掉容器对镜像layer的引用，要在可写层卸载之后调用
+func (eng *engine) releaseImageRef(containerName string) {
+	if err := eng.newImageStore().ReleaseRef(containerName); err != nil {
+		log.Errorf("Release image layers of container %s error %v", containerName, err)
+	}
+}
+
+// deleteWorkSpace 用容器创建时的存储驱动删除它的文件系统，bundle的rootfs归调用方所有，不能删
+func (eng *engine) deleteWorkSpace(containerInfo *container.ContainerInfo) {
+	if containerInfo.Bundle != "" {
+		return
+	}
+	driver, err := eng.containerStorageDriver(containerInfo)
 	if err != nil {
-		log.Errorf("Record container info error %v", err)
-		return "", err
-	}
-	jsonStr := string(jsonBytes)
-
-	// 拼凑存储容器信息的路径
-	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	// 路径不存在，级联的创建 如果目录已经存在，也返回nil
-	if err := os.MkdirAll(dirUrl, 0622); err != nil {
-		log.Errorf("Mkdir error %s error %v", dirUrl, err)
-		return "", err
-	}
-	fileName := dirUrl + "/" + container.ConfigName
-	// 创建最终配置文件 如果文件已存在，会将文件清空
-	file, err := os.Create(fileName)
-	defer file.Close()
+		log.Errorf("Get storage driver of container %s error %v", containerInfo.Name, err)
+		return
+	}
+	container.DeleteWorkSpace(eng.containerPaths(), driver, containerInfo.Volume, containerInfo.Name)
+}
+
+// runPoststopHooks 容器删除后执行poststop hook，失败只记录警告
+func (eng *engine) runPoststopHooks(containerInfo *container.ContainerInfo) {
+	if containerInfo.Hooks == nil {
+		return
+	}
+	if err := container.RunHooks(containerInfo.Hooks.Poststop, containerInfo.OCIState(eng.containerPaths(), container.StateStopped)); err != nil {
+		log.Warnf("Run poststop hooks of container %s error %v", containerInfo.Name, err)
+	}
+}
+
+// imageInitConfig 按镜像的配置生成发给init进程的命令、工作目录和用户
+func (eng *engine) imageInitConfig(comArray []string, config image.Config, containerName string) (*container.InitConfig, error) {
+	uid, gid, err := container.LookupUser(eng.containerPaths().MntDir(containerName), config.User)
 	if err != nil {
-		log.Errorf("Create file %s error %v", fileName, err)
-		return "", err
+		return nil, err
 	}
-	// 将json序列化后的数据写入文件
-	if _, err := file.WriteString(jsonStr); err != nil {
-		log.Errorf("File write string error %v", err)
-		return "", err
+	return &container.InitConfig{Args: comArray, Cwd: config.WorkingDir, UID: uid, GID: gid}, nil
+}
+
+// sendInitCommand 发送用户命令和工作目录进行初始化
+func sendInitCommand(initConfig *container.InitConfig, writePipe *os.File) {
+	log.Infof("command all is %s", strings.Join(initConfig.Args, " "))
+	if err := container.SendInitConfig(initConfig, writePipe); err != nil {
+		log.Errorf("Send init config error %v", err)
 	}
-	return containerName, nil
 }
 
-func deleteContainerInfo(containerId string) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerId)
-	if err := os.RemoveAll(dirURL); err != nil {
-		log.Errorf("Remove dir %s error %v", dirURL, err)
+// 记录容器的基本信息
+func (eng *engine) recordContainerInfo(containerInfo *container.ContainerInfo) error {
+	// 状态目录在ReserveName时已经创建，由store原子地写入配置文件，绝不覆盖已有容器的配置
+	return eng.newStateStore().CreateContainer(containerInfo)
+}
+
+func (eng *engine) deleteContainerInfo(containerName string) {
+	if err := eng.newStateStore().RemoveContainer(containerName); err != nil {
+		log.Errorf("Remove container %s info error %v", containerName, err)
 	}
 }
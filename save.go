@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// saveImages 把镜像按OCI image layout打包，output为空或者"-"时写到标准输出
+func (eng *engine) saveImages(refs []string, output string) error {
+	images := eng.newImageStore()
+	if output == "" || output == "-" {
+		return images.Save(refs, os.Stdout)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("create %s error %v", output, err)
+	}
+	if err := images.Save(refs, f); err != nil {
+		f.Close()
+		os.Remove(output)
+		return fmt.Errorf("save images error %v", err)
+	}
+	return f.Close()
+}
+
+// loadImages 导入save或者docker save生成的tar包，input为空或者"-"时从标准输入读
+func (eng *engine) loadImages(input string) error {
+	var r io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("open %s error %v", input, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	loaded, err := eng.newImageStore().Load(r)
+	for _, img := range loaded {
+		if img.Name != "" {
+			fmt.Printf("Loaded image: %s\n", img.Name)
+		} else {
+			fmt.Printf("Loaded image ID: %s\n", img.ID)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("load images error %v", err)
+	}
+	return nil
+}
@@ -2,93 +2,94 @@ package main
 
 import (
 	"cocin_dokcer/container"
-	"encoding/json"
+	"cocin_dokcer/events"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"os"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 // 根据容器名获取对应的struct结构
-func getContainerInfoByName(containerName string) (*container.ContainerInfo, error) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	contentBytes, err := ioutil.ReadFile(configFilePath)
+func (eng *engine) getContainerInfoByName(containerName string) (*container.ContainerInfo, error) {
+	containerInfo, err := eng.newStateStore().LoadContainer(containerName)
 	if err != nil {
-		log.Errorf("Read file %s error %v", configFilePath, err)
+		log.Errorf("GetContainerInfoByName %s error %v", containerName, err)
 		return nil, err
 	}
-	var containerInfo container.ContainerInfo
-	if err := json.Unmarshal(contentBytes, &containerInfo); err != nil {
-		log.Errorf("GetContainerInfoByName unmarshal error %v", err)
-		return nil, err
-	}
-	return &containerInfo, nil
+	return containerInfo, nil
 }
 
+// stopTimeout 发送SIGTERM后等待容器退出的时间，超时再发SIGKILL
+const stopTimeout = 10 * time.Second
+
 /*
 	stopContainer 主要步骤如下
-	1. 获取容器ID
-	2. 对该PID发送kill信号
-	3. 修改容器信息
+	1. 获取容器PID
+	2. 对该PID发送SIGTERM信号，等待进程退出，超时还没退出就发SIGKILL
+	3. 确认进程退出后修改容器信息，清空PID
 	4. 重新写入存储容器信息的文件
+	进程退出之前PID和启动时间要留着，状态修复流程靠它们判断能不能释放cgroup和IP
 */
-func stopContainer(containerName string) {
-	// 获取主进程PID，杀掉容器主进程
-	pid, err := getContainerPidByName(containerName)
+func (eng *engine) stopContainer(containerName string) {
+	containerInfo, err := eng.getContainerInfoByName(containerName)
 	if err != nil {
-		log.Errorf("Get contaienr pid by name %s error %v", containerName, err)
 		return
 	}
-	pidInt, err := strconv.Atoi(pid)
+	if !container.IsProcessAlive(containerInfo.Pid, containerInfo.StartTime) {
+		log.Errorf("Container %s is not running", containerName)
+		return
+	}
+	pidInt, err := strconv.Atoi(containerInfo.Pid)
 	if err != nil {
 		log.Errorf("Conver pid from string to int error %v", err)
 		return
 	}
+	journal := eng.newJournal()
 	// 调用kill发送信号给进程，通过传递syscall.SIGTERM信号，去杀掉容器的主进程
-	if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
-		log.Errorf("Stop container %s error %v", containerName, err)
-		return
-	}
-	// 根据容器名获得容器信息
-	containerInfo, err := getContainerInfoByName(containerName)
-	if err != nil {
-		log.Errorf("Get container %s info error %v", containerName, err)
-		return
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if err := syscall.Kill(pidInt, sig); err != nil {
+			log.Errorf("Stop container %s error %v", containerName, err)
+			return
+		}
+		attributes := containerAttributes(containerInfo)
+		attributes["signal"] = strconv.Itoa(int(sig))
+		journal.Log(events.TypeContainer, "kill", containerInfo.Id, attributes)
+		if container.WaitProcessExit(containerInfo.Pid, containerInfo.StartTime, stopTimeout) {
+			break
+		}
+		if sig == syscall.SIGKILL {
+			log.Errorf("Container %s did not exit after SIGKILL", containerName)
+			return
+		}
+		log.Warnf("Container %s did not exit in %v, kill it", containerName, stopTimeout)
 	}
-	// 修改信息后序列化写入，修改状态，PID置空
-	containerInfo.Status = container.STOP
-	containerInfo.Pid = " "
-	newContentBytes, err := json.Marshal(containerInfo)
-	if err != nil {
-		log.Errorf("Json marshal %s error %v", containerName, err)
+	// 进程已经退出，在容器锁内修改状态，PID置空，状态修复流程抢先发现退出时已经记录过die
+	if err := eng.containerExited(eng.newStateStore(), containerInfo, container.STOP, ""); err != nil {
+		log.Errorf("Update container %s info error %v", containerName, err)
 		return
 	}
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	if err := ioutil.WriteFile(configFilePath, newContentBytes, 0622); err != nil {
-		log.Errorf("Write file %s error", configFilePath, err)
-	}
+	journal.Log(events.TypeContainer, "stop", containerInfo.Id, containerAttributes(containerInfo))
 }
 
-// 移除容器
-func removeContainer(containerName string) {
-	containerInfo, err := getContainerInfoByName(containerName)
+// 移除容器，运行中的容器不能移除
+func (eng *engine) removeContainer(containerName string) error {
+	containerInfo, err := eng.getContainerInfoByName(containerName)
 	if err != nil {
-		log.Errorf("Get container %s info error %v", containerName, err)
-		return
+		return fmt.Errorf("get container %s info error %v", containerName, err)
 	}
-	if containerInfo.Status != container.STOP {
-		log.Errorf("Couldn't remove running container")
-		return
+	if container.IsProcessAlive(containerInfo.Pid, containerInfo.StartTime) {
+		return fmt.Errorf("couldn't remove running container %s", containerName)
 	}
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	if err := os.RemoveAll(dirURL); err != nil {
-		log.Errorf("Remove file %s error %v", dirURL, err)
-		return
+	// 先释放cgroup和网络资源，状态删掉之后就找不到它们了
+	eng.releaseContainerResources(containerInfo)
+	if err := eng.newStateStore().RemoveContainer(containerName); err != nil {
+		return fmt.Errorf("remove container %s info error %v", containerName, err)
 	}
 	// 移除容器的时候，可写层也要删除。
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	eng.deleteWorkSpace(containerInfo)
+	eng.releaseImageRef(containerName)
+	eng.runPoststopHooks(containerInfo)
+	eng.newJournal().Log(events.TypeContainer, "destroy", containerInfo.Id, containerAttributes(containerInfo))
+	return nil
 }
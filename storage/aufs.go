@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"cocin_dokcer/archive"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// AufsDriver aufs驱动，可写层就是 {Home}/{id} 目录本身，和最早的目录结构一致
+type AufsDriver struct {
+	Home string
+}
+
+func (d *AufsDriver) Name() string {
+	return Aufs
+}
+
+func (d *AufsDriver) UpperDir(id string) string {
+	return filepath.Join(d.Home, id)
+}
+
+// CreateWriteLayer 创建名为writeLayer的文件夹作为容器唯一的可写层
+func (d *AufsDriver) CreateWriteLayer(id string, size int64) error {
+	if err := os.MkdirAll(d.Home, 0755); err != nil {
+		return err
+	}
+	writeURL := d.UpperDir(id)
+	if err := os.Mkdir(writeURL, 0777); err != nil {
+		log.Errorf("Mkdir dir %s error. %v", writeURL, err)
+		return err
+	}
+	if size > 0 {
+		if err := createQuota(d.Home, id, writeURL, size); err != nil {
+			os.RemoveAll(writeURL)
+			return err
+		}
+		// 新文件系统的根目录是0755，和不限制大小时保持一致
+		os.Chmod(writeURL, 0777)
+	}
+	return nil
+}
+
+// Mount 把writeLayer目录和镜像目录mount到挂载点下，第一个分支可写，其余只读
+func (d *AufsDriver) Mount(id string, lowerDirs []string, mountPoint string) error {
+	if err := mountQuota(d.Home, id, d.UpperDir(id)); err != nil {
+		return err
+	}
+	dirs := "dirs=" + d.UpperDir(id) + ":" + strings.Join(lowerDirs, ":")
+	if output, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount aufs error %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (d *AufsDriver) RemoveWriteLayer(id string) error {
+	if err := removeQuota(d.Home, id, d.UpperDir(id)); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.UpperDir(id))
+}
+
+func (d *AufsDriver) Size(id string) (int64, error) {
+	return DirUsage(d.UpperDir(id))
+}
+
+func (d *AufsDriver) Diff(id string, lowerDirs []string, w io.Writer) error {
+	return archive.TarLayer(d.UpperDir(id), w)
+}
+
+func (d *AufsDriver) Changes(id string, lowerDirs []string) ([]archive.Change, error) {
+	return archive.Changes(d.UpperDir(id), lowerDirs)
+}
+
+func (d *AufsDriver) WhiteoutFormat() string {
+	return archive.WhiteoutAufs
+}
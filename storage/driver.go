@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bufio"
+	"cocin_dokcer/archive"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+	Driver 存储驱动，负责容器的可写层以及把它和镜像的只读层联合挂载成容器的rootfs
+	不同的驱动可写层的目录结构不同，diff和cp通过UpperDir拿到容器修改实际写入的位置
+*/
+type Driver interface {
+	// Name 驱动名，会记录在容器信息里，删除容器时用同一个驱动
+	Name() string
+	// CreateWriteLayer 为容器创建可写层，已经存在时返回错误，size大于0时可写层最多只能写size字节
+	CreateWriteLayer(id string, size int64) error
+	// Mount 把只读层和容器的可写层挂载到mountPoint，lowerDirs按从上到下排列
+	Mount(id string, lowerDirs []string, mountPoint string) error
+	// RemoveWriteLayer 删除容器的可写层
+	RemoveWriteLayer(id string) error
+	// UpperDir 容器的修改实际写入的目录
+	UpperDir(id string) string
+	// Size 可写层当前占用的磁盘空间
+	Size(id string) (int64, error)
+	// Diff 把容器相对只读层的修改打包成OCI格式的layer，commit用
+	Diff(id string, lowerDirs []string, w io.Writer) error
+	// Changes 容器相对只读层新增、修改和删除的文件，diff命令用
+	Changes(id string, lowerDirs []string) ([]archive.Change, error)
+	// WhiteoutFormat 给这个驱动用的只读层在磁盘上怎么表示删除，见archive.UntarLayer
+	WhiteoutFormat() string
+}
+
+// 驱动名
+const (
+	Overlay = "overlay"
+	Aufs    = "aufs"
+	Vfs     = "vfs"
+)
+
+// 没有指定驱动时，按这个顺序选第一个宿主机支持的，都不支持时用vfs
+var priority = []string{Overlay, Aufs}
+
+// 驱动名 -> 构造函数，home是存放所有容器可写层的目录
+var drivers = map[string]func(home string) Driver{
+	Overlay: func(home string) Driver { return &OverlayDriver{Home: home} },
+	Aufs:    func(home string) Driver { return &AufsDriver{Home: home} },
+	Vfs:     func(home string) Driver { return &VfsDriver{Home: home} },
+}
+
+// New 按名字创建驱动，name为空时自动选择
+func New(name, home string) (Driver, error) {
+	if name == "" {
+		for _, candidate := range priority {
+			if filesystemSupported(candidate) {
+				return drivers[candidate](home), nil
+			}
+		}
+		return drivers[Vfs](home), nil
+	}
+	newDriver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %s", name)
+	}
+	return newDriver(home), nil
+}
+
+// WriteLayers home下所有可写层对应的容器，各个驱动的可写层都在 {home}/{id}，以 . 开头的是驱动自己用的目录
+func WriteLayers(home string) ([]string, error) {
+	entries, err := ioutil.ReadDir(home)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// filesystemSupported 判断内核是否支持某种文件系统，没有的话尝试加载一次内核模块
+func filesystemSupported(fs string) bool {
+	if inProcFilesystems(fs) {
+		return true
+	}
+	exec.Command("modprobe", fs).Run()
+	return inProcFilesystems(fs)
+}
+
+func inProcFilesystems(fs string) bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// nodev	overlay
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fs {
+			return true
+		}
+	}
+	return false
+}
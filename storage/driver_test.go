@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNewUnknownDriver(t *testing.T) {
+	if _, err := New("btrfs", t.TempDir()); err == nil {
+		t.Fatalf("unknown driver should be an error")
+	}
+}
+
+func TestOverlayWriteLayer(t *testing.T) {
+	home := t.TempDir()
+	d, err := New(Overlay, home)
+	if err != nil {
+		t.Fatalf("new overlay driver error %v", err)
+	}
+	if err := d.CreateWriteLayer("web", 0); err != nil {
+		t.Fatalf("create write layer error %v", err)
+	}
+	if d.UpperDir("web") != filepath.Join(home, "web", "diff") {
+		t.Errorf("unexpected upper dir %s", d.UpperDir("web"))
+	}
+	if _, err := os.Stat(filepath.Join(home, "web", "work")); err != nil {
+		t.Errorf("work dir should be created, %v", err)
+	}
+	if err := d.CreateWriteLayer("web", 0); err == nil {
+		t.Errorf("creating an existing write layer should fail")
+	}
+	if err := d.RemoveWriteLayer("web"); err != nil {
+		t.Fatalf("remove write layer error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "web")); !os.IsNotExist(err) {
+		t.Errorf("write layer should be removed, %v", err)
+	}
+}
+
+func TestVfsCopyTree(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "bin", "busybox"), []byte("binary"), 0755)
+	os.Link(filepath.Join(src, "bin", "busybox"), filepath.Join(src, "bin", "sh"))
+	os.Symlink("busybox", filepath.Join(src, "bin", "ls"))
+
+	dst := filepath.Join(t.TempDir(), "rootfs")
+	if err := CopyTree(src, dst); err != nil {
+		t.Fatalf("copy tree error %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dst, "bin", "busybox"))
+	if err != nil || string(content) != "binary" {
+		t.Errorf("busybox = %q, %v", content, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "bin", "busybox")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("mode should be kept, got %v %v", fi, err)
+	}
+	a, _ := os.Stat(filepath.Join(dst, "bin", "busybox"))
+	b, _ := os.Stat(filepath.Join(dst, "bin", "sh"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Errorf("hard links inside the tree should be kept")
+	}
+	orig, _ := os.Stat(filepath.Join(src, "bin", "busybox"))
+	if os.SameFile(orig, a) {
+		t.Errorf("copied file must not share an inode with the image")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "bin", "ls")); err != nil || link != "busybox" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+}
+
+func TestVfsChanges(t *testing.T) {
+	lower := t.TempDir()
+	os.MkdirAll(filepath.Join(lower, "etc"), 0755)
+	os.MkdirAll(filepath.Join(lower, "var", "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "hosts"), []byte("127.0.0.1 localhost"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "etc", "passwd"), []byte("root:x:0:0"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "var", "cache", "index"), []byte("index"), 0644)
+	os.Symlink("hosts", filepath.Join(lower, "etc", "hosts.link"))
+
+	d, err := New(Vfs, t.TempDir())
+	if err != nil {
+		t.Fatalf("new vfs driver error %v", err)
+	}
+	if err := d.CreateWriteLayer("web", 0); err != nil {
+		t.Fatalf("create write layer error %v", err)
+	}
+	rootfs := d.UpperDir("web")
+	if err := CopyTree(lower, rootfs); err != nil {
+		t.Fatalf("copy tree error %v", err)
+	}
+	// 没改过的文件不能算修改
+	changes, err := d.Changes("web", []string{lower})
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("unmodified rootfs changes = %v, %v", changes, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"), []byte("127.0.0.1 web"), 0644)
+	ioutil.WriteFile(filepath.Join(rootfs, "etc", "resolv.conf"), []byte("nameserver 8.8.8.8"), 0644)
+	os.Remove(filepath.Join(rootfs, "etc", "passwd"))
+	os.RemoveAll(filepath.Join(rootfs, "var", "cache"))
+
+	changes, err = d.Changes("web", []string{lower})
+	if err != nil {
+		t.Fatalf("changes error %v", err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.String())
+	}
+	// 删除的目录只报目录本身，目录里的内容变了不算目录被修改
+	want := []string{"C /etc/hosts", "A /etc/resolv.conf", "D /etc/passwd", "D /var/cache"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes = %q, want %q", got, want)
+	}
+}
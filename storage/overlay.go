@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"cocin_dokcer/archive"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/*
+	OverlayDriver overlayfs驱动，主线内核都支持
+	每个容器的目录 {Home}/{id} 下有两个子目录：
+	diff 是upperdir，容器的修改都写在这里
+	work 是overlay内部使用的workdir，必须和upperdir在同一个文件系统上
+*/
+type OverlayDriver struct {
+	Home string
+}
+
+func (d *OverlayDriver) Name() string {
+	return Overlay
+}
+
+func (d *OverlayDriver) UpperDir(id string) string {
+	return filepath.Join(d.Home, id, "diff")
+}
+
+func (d *OverlayDriver) workDir(id string) string {
+	return filepath.Join(d.Home, id, "work")
+}
+
+// CreateWriteLayer 限制大小时diff和work都建在限制了大小的文件系统上，它们必须在同一个文件系统里
+func (d *OverlayDriver) CreateWriteLayer(id string, size int64) error {
+	if err := os.MkdirAll(d.Home, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(d.Home, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", dir, err)
+	}
+	if size > 0 {
+		if err := createQuota(d.Home, id, dir, size); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	for _, sub := range []string{d.UpperDir(id), d.workDir(id)} {
+		if err := os.Mkdir(sub, 0755); err != nil {
+			d.RemoveWriteLayer(id)
+			return fmt.Errorf("mkdir %s error %v", sub, err)
+		}
+	}
+	return nil
+}
+
+func (d *OverlayDriver) Mount(id string, lowerDirs []string, mountPoint string) error {
+	if err := mountQuota(d.Home, id, filepath.Join(d.Home, id)); err != nil {
+		return err
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowerDirs, ":"), d.UpperDir(id), d.workDir(id))
+	if err := syscall.Mount("overlay", mountPoint, "overlay", 0, options); err != nil {
+		return fmt.Errorf("mount overlay error %v", err)
+	}
+	return nil
+}
+
+func (d *OverlayDriver) RemoveWriteLayer(id string) error {
+	dir := filepath.Join(d.Home, id)
+	if err := removeQuota(d.Home, id, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (d *OverlayDriver) Size(id string) (int64, error) {
+	return DirUsage(d.UpperDir(id))
+}
+
+func (d *OverlayDriver) Diff(id string, lowerDirs []string, w io.Writer) error {
+	return archive.TarLayer(d.UpperDir(id), w)
+}
+
+func (d *OverlayDriver) Changes(id string, lowerDirs []string) ([]archive.Change, error) {
+	return archive.Changes(d.UpperDir(id), lowerDirs)
+}
+
+func (d *OverlayDriver) WhiteoutFormat() string {
+	return archive.WhiteoutOverlay
+}
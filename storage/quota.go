@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+	可写层的大小限制
+	限制了大小的容器，可写层所在的目录 {Home}/{id} 是一个挂载点，
+	挂的是 {Home}/.quota/{id}.img 这个稀疏文件上格式化出来的ext4，文件有多大容器最多就能写多少，
+	写满以后容器里的写操作得到ENOSPC，不会把宿主机的磁盘写满
+	宿主机重启以后由Mount重新挂载，RemoveWriteLayer卸载并删掉镜像文件
+*/
+
+// minQuotaSize 太小的文件格式化不出ext4
+const minQuotaSize = 8 << 20
+
+func quotaImage(home, id string) string {
+	return filepath.Join(home, ".quota", id+".img")
+}
+
+// HasQuota 判断容器的可写层是否限制了大小
+func HasQuota(home, id string) bool {
+	_, err := os.Stat(quotaImage(home, id))
+	return err == nil
+}
+
+// createQuota 创建size字节的稀疏文件，格式化成ext4挂载到dir
+func createQuota(home, id, dir string, size int64) error {
+	if size < minQuotaSize {
+		return fmt.Errorf("storage size %d is too small, at least %d bytes", size, int64(minQuotaSize))
+	}
+	img := quotaImage(home, id)
+	if err := os.MkdirAll(filepath.Dir(img), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(img, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(img)
+		return err
+	}
+	// 不留给root的保留块，也不要日志，空间都给容器用
+	if output, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", "-O", "^has_journal", img).CombinedOutput(); err != nil {
+		os.Remove(img)
+		return fmt.Errorf("mkfs.ext4 error %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if err := mountQuota(home, id, dir); err != nil {
+		os.Remove(img)
+		return err
+	}
+	// lost+found会出现在aufs的可写层里，进而出现在容器的rootfs和commit出来的layer里
+	os.Remove(filepath.Join(dir, "lost+found"))
+	return nil
+}
+
+// mountQuota 可写层限制了大小、但还没挂载时(比如宿主机重启过)把它挂载到dir
+func mountQuota(home, id, dir string) error {
+	img := quotaImage(home, id)
+	if _, err := os.Stat(img); err != nil {
+		return nil
+	}
+	if mounted, err := isMountPoint(dir); err != nil || mounted {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if output, err := exec.Command("mount", "-o", "loop", img, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s error %v: %s", img, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// removeQuota 卸载并删除可写层背后的文件，没有限制大小时什么都不做
+func removeQuota(home, id, dir string) error {
+	img := quotaImage(home, id)
+	if _, err := os.Stat(img); err != nil {
+		return nil
+	}
+	if mounted, _ := isMountPoint(dir); mounted {
+		// 用 -o loop 挂载的loop设备在卸载时自动释放
+		if err := syscall.Unmount(dir, 0); err != nil {
+			return fmt.Errorf("umount %s error %v", dir, err)
+		}
+	}
+	return os.Remove(img)
+}
+
+// isMountPoint 和父目录不在同一个设备上的目录就是挂载点
+func isMountPoint(dir string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Lstat(dir, &st); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := syscall.Lstat(filepath.Dir(dir), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev, nil
+}
+
+/*
+	ParseStorageOpts 解析 --storage-opt key=value，返回可写层的大小限制，0表示不限制
+	目前只支持size，大小可以带k、m、g、t单位(1024进制)，比如 size=10G
+*/
+func ParseStorageOpts(opts []string) (int64, error) {
+	var size int64
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return 0, fmt.Errorf("invalid storage option %q, expect key=value", opt)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "size":
+			n, err := ParseSize(kv[1])
+			if err != nil {
+				return 0, err
+			}
+			size = n
+		default:
+			return 0, fmt.Errorf("unknown storage option %s", kv[0])
+		}
+	}
+	return size, nil
+}
+
+// ParseSize 解析 512M、10G 这样的大小
+func ParseSize(s string) (int64, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "b"), "i")
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte("kmgt", str[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			str = str[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// DirUsage 目录树实际占用的磁盘空间，按块计算，硬链接只算一次，目录不存在时是0
+func DirUsage(dir string) (int64, error) {
+	var total int64
+	inodes := make(map[uint64]bool)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if st.Nlink > 1 && !fi.IsDir() {
+			if inodes[st.Ino] {
+				return nil
+			}
+			inodes[st.Ino] = true
+		}
+		total += st.Blocks * 512
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseStorageOpts(t *testing.T) {
+	cases := map[string]int64{
+		"size=10G":   10 << 30,
+		"size=512m":  512 << 20,
+		"size=1.5GB": 3 << 29,
+		"size=64MiB": 64 << 20,
+		"size=4096":  4096,
+	}
+	for opt, want := range cases {
+		got, err := ParseStorageOpts([]string{opt})
+		if err != nil || got != want {
+			t.Errorf("%s = %d, %v, want %d", opt, got, err, want)
+		}
+	}
+	for _, opt := range []string{"size", "size=ten", "size=-1G", "inodes=100"} {
+		if _, err := ParseStorageOpts([]string{opt}); err == nil {
+			t.Errorf("%s should be rejected", opt)
+		}
+	}
+}
+
+func TestOverlayQuota(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to mount a loop device")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	home := t.TempDir()
+	d, _ := New(Overlay, home)
+	if err := d.CreateWriteLayer("small", 1<<20); err == nil {
+		d.RemoveWriteLayer("small")
+		t.Errorf("a size below the minimum should be rejected")
+	}
+	if err := d.CreateWriteLayer("web", 16<<20); err != nil {
+		t.Skipf("create write layer with quota error %v", err)
+	}
+	defer d.RemoveWriteLayer("web")
+	if !HasQuota(home, "web") {
+		t.Fatalf("write layer should have a quota")
+	}
+
+	// 写满以后得到ENOSPC
+	data := make([]byte, 1<<20)
+	f, err := os.Create(filepath.Join(d.UpperDir("web"), "big"))
+	if err != nil {
+		t.Fatalf("create file error %v", err)
+	}
+	for i := 0; i < 32 && err == nil; i++ {
+		_, err = f.Write(data)
+	}
+	f.Close()
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENOSPC {
+		t.Errorf("writing beyond the quota should fail with ENOSPC, got %v", err)
+	}
+	if size, err := d.Size("web"); err != nil || size < 8<<20 {
+		t.Errorf("size = %d, %v", size, err)
+	}
+
+	if err := d.RemoveWriteLayer("web"); err != nil {
+		t.Fatalf("remove write layer error %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(home, ".quota")); len(entries) != 0 {
+		t.Errorf("quota image should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(home, "web")); !os.IsNotExist(err) {
+		t.Errorf("write layer should be removed, %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"cocin_dokcer/archive"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// FICLONE ioctl，btrfs、xfs这类文件系统上可以让两个文件共享数据块，写时才复制
+const ficlone = 0x40049409
+
+/*
+	VfsDriver 复制驱动，不需要任何联合文件系统，嵌套在容器里也能用
+	第一次挂载时把镜像目录完整复制到 {Home}/{id}/rootfs，再bind mount到挂载点
+	文件数据能reflink的就reflink，不能的再真正复制
+	不用硬链接：容器里原地修改文件会直接改掉镜像里的同一个inode
+	rootfs就是容器完整的文件系统，所以UpperDir返回的不只是容器修改过的文件
+*/
+type VfsDriver struct {
+	Home string
+}
+
+func (d *VfsDriver) Name() string {
+	return Vfs
+}
+
+func (d *VfsDriver) UpperDir(id string) string {
+	return filepath.Join(d.Home, id, "rootfs")
+}
+
+// CreateWriteLayer 限制大小时完整复制的rootfs也算在里面，size要比镜像大
+func (d *VfsDriver) CreateWriteLayer(id string, size int64) error {
+	if err := os.MkdirAll(d.Home, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(d.Home, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", dir, err)
+	}
+	if size > 0 {
+		if err := createQuota(d.Home, id, dir, size); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// Mount rootfs不存在时先复制，复制到临时目录再rename，中途失败不会留下不完整的rootfs
+func (d *VfsDriver) Mount(id string, lowerDirs []string, mountPoint string) error {
+	if err := mountQuota(d.Home, id, filepath.Join(d.Home, id)); err != nil {
+		return err
+	}
+	rootfs := d.UpperDir(id)
+	if _, err := os.Stat(rootfs); os.IsNotExist(err) {
+		tmp := rootfs + ".tmp"
+		os.RemoveAll(tmp)
+		// 从最下层开始复制，上层的文件覆盖下层的
+		for i := len(lowerDirs) - 1; i >= 0; i-- {
+			if err := CopyTree(lowerDirs[i], tmp); err != nil {
+				os.RemoveAll(tmp)
+				return fmt.Errorf("copy %s error %v", lowerDirs[i], err)
+			}
+		}
+		if err := os.Rename(tmp, rootfs); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	if err := syscall.Mount(rootfs, mountPoint, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s error %v", rootfs, err)
+	}
+	return nil
+}
+
+func (d *VfsDriver) RemoveWriteLayer(id string) error {
+	dir := filepath.Join(d.Home, id)
+	if err := removeQuota(d.Home, id, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Size rootfs是完整复制出来的，包括镜像本身的大小
+func (d *VfsDriver) Size(id string) (int64, error) {
+	return DirUsage(d.UpperDir(id))
+}
+
+// Diff 没有单独的可写层，只能拿完整的rootfs和只读层逐个文件比较
+func (d *VfsDriver) Diff(id string, lowerDirs []string, w io.Writer) error {
+	return archive.TarDiff(d.UpperDir(id), lowerDirs, w)
+}
+
+// Changes 和Diff一样，拿完整的rootfs和只读层双向比较，rootfs里少了的文件就是删除
+func (d *VfsDriver) Changes(id string, lowerDirs []string) ([]archive.Change, error) {
+	return archive.RootfsChanges(d.UpperDir(id), lowerDirs)
+}
+
+// WhiteoutFormat 只读层按aufs格式解包，复制的时候由CopyTree处理 .wh. 文件
+func (d *VfsDriver) WhiteoutFormat() string {
+	return archive.WhiteoutAufs
+}
+
+/*
+	CopyTree 把src目录树复制到dst，dst已存在的同名文件会被覆盖
+	保留权限、属主、修改时间、符号链接、设备文件以及树内部的硬链接关系
+	src是aufs格式的layer时，.wh. 文件会删掉dst里对应的文件，不透明目录会先清空dst里的同名目录
+*/
+func CopyTree(src, dst string) error {
+	// 源inode -> 复制出来的第一个路径，用来还原硬链接
+	inodes := make(map[uint64]string)
+	var dirs []string
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch base := fi.Name(); {
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			return os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, archive.WhiteoutPrefix)))
+		}
+		if fi.IsDir() && rel != "." {
+			if _, err := os.Lstat(filepath.Join(path, archive.WhiteoutOpaqueDir)); err == nil {
+				os.RemoveAll(target)
+			}
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() {
+			if _, err := os.Lstat(target); err == nil {
+				os.RemoveAll(target)
+			}
+		}
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		case mode.IsRegular():
+			if st.Nlink > 1 {
+				if first, ok := inodes[st.Ino]; ok {
+					return os.Link(first, target)
+				}
+				inodes[st.Ino] = target
+			}
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, int(st.Uid), int(st.Gid))
+		case mode&(os.ModeDevice|os.ModeNamedPipe) != 0:
+			if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return err
+			}
+		default:
+			// socket不复制
+			return nil
+		}
+		return copyMetadata(target, fi, st)
+	})
+	if err != nil {
+		return err
+	}
+	// 目录的修改时间在里面的文件都写完以后再设置
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			continue
+		}
+		os.Chtimes(filepath.Join(dst, dirs[i]), fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+func copyMetadata(target string, fi os.FileInfo, st *syscall.Stat_t) error {
+	if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	// chown会清掉setuid位，权限放在后面设置
+	if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// copyFile 优先reflink，文件系统不支持时退回普通复制
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := unix.IoctlSetInt(int(out.Fd()), ficlone, int(in.Fd())); err == nil {
+		return nil
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// WriteFileAtomic 原子地写文件
+// 先写到同目录下的临时文件并fsync，再rename覆盖目标文件。rename在同一个文件系统内是原子的，
+// 读的一方要么看到旧内容，要么看到新内容，不会读到写了一半的文件
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", dir, err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("create temp file in %s error %v", dir, err)
+	}
+	tmpName := tmp.Name()
+	// 任何一步失败都要把临时文件删掉
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("write %s error %v", tmpName, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("chmod %s error %v", tmpName, err)
+	}
+	// 数据先落盘，再rename，避免掉电后得到一个空文件
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("sync %s error %v", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s error %v", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("rename %s to %s error %v", tmpName, path, err)
+	}
+	success = true
+	syncDir(dir)
+	return nil
+}
+
+// syncDir 把目录项的变化也刷到磁盘上，失败不影响结果
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Lock 基于flock的文件锁，进程退出时内核会自动释放
+type Lock struct {
+	file *os.File
+}
+
+// LockFile 对path对应的锁文件加锁，exclusive为true时加写锁，否则加读锁
+// 锁文件和数据文件分开：数据文件每次写都会被rename替换，锁在旧inode上就失效了
+func LockFile(path string, exclusive bool) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir %s error %v", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file %s error %v", path, err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s error %v", path, err)
+	}
+	return &Lock{file: f}, nil
+}
+
+// Unlock 释放锁
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
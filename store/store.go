@@ -0,0 +1,237 @@
+package store
+
+import (
+	"cocin_dokcer/container"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Store 统一管理容器、网络和IPAM的状态文件，目录结构如下：
+//
+//	{Root}/{容器名}/config.json        容器信息
+//	{Root}/network/network/{网络名}    网络信息
+//	{Root}/network/ipam/subnet.json   IPAM分配信息
+//	{Root}/.locks/                    每个对象一个锁文件
+//
+// 所有写入都是先写临时文件再rename，读改写都在对象锁内完成
+type Store struct {
+	Root string
+}
+
+func New(root string) *Store {
+	return &Store{Root: root}
+}
+
+func (s *Store) lockPath(kind, name string) string {
+	return filepath.Join(s.Root, ".locks", kind+"-"+name+".lock")
+}
+
+func (s *Store) lock(kind, name string, exclusive bool) (*Lock, error) {
+	return LockFile(s.lockPath(kind, name), exclusive)
+}
+
+// LockGlobal 获取一个和具体对象无关的全局写锁，比如状态修复流程
+func (s *Store) LockGlobal(name string) (*Lock, error) {
+	return s.lock("global", name, true)
+}
+
+// ContainerDir 容器状态目录
+func (s *Store) ContainerDir(containerName string) string {
+	return filepath.Join(s.Root, containerName)
+}
+
+func (s *Store) containerConfigPath(containerName string) string {
+	return filepath.Join(s.ContainerDir(containerName), container.ConfigName)
+}
+
+// loadContainer 读取容器信息，调用方需持有锁，旧格式会顺带写回成新格式
+func (s *Store) loadContainer(containerName string, locked bool) (*container.ContainerInfo, error) {
+	var info container.ContainerInfo
+	configPath := s.containerConfigPath(containerName)
+	migrated, err := ReadVersioned(configPath, KindContainer, &info)
+	if err != nil {
+		return nil, fmt.Errorf("read container %s state error %v", containerName, err)
+	}
+	if migrated && locked {
+		if err := WriteVersioned(configPath, KindContainer, &info, 0622); err != nil {
+			log.Warnf("write back migrated state of container %s error %v", containerName, err)
+		}
+	}
+	return &info, nil
+}
+
+// CreateContainer 写入新容器的信息，配置已存在时失败，不会覆盖其他容器
+func (s *Store) CreateContainer(info *container.ContainerInfo) error {
+	l, err := s.lock(KindContainer, info.Name, true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	configPath := s.containerConfigPath(info.Name)
+	if _, err := os.Stat(configPath); err == nil {
+		return fmt.Errorf("container %s already exists", info.Name)
+	}
+	return WriteVersioned(configPath, KindContainer, info, 0622)
+}
+
+// LoadContainer 根据容器名读取容器信息
+func (s *Store) LoadContainer(containerName string) (*container.ContainerInfo, error) {
+	l, err := s.lock(KindContainer, containerName, false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+	return s.loadContainer(containerName, false)
+}
+
+// UpdateContainer 在容器锁内完成读-改-写，fn返回错误时不写入
+func (s *Store) UpdateContainer(containerName string, fn func(info *container.ContainerInfo) error) error {
+	l, err := s.lock(KindContainer, containerName, true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	info, err := s.loadContainer(containerName, true)
+	if err != nil {
+		return err
+	}
+	if err := fn(info); err != nil {
+		return err
+	}
+	return WriteVersioned(s.containerConfigPath(containerName), KindContainer, info, 0622)
+}
+
+// RemoveContainer 删除容器的整个状态目录
+func (s *Store) RemoveContainer(containerName string) error {
+	l, err := s.lock(KindContainer, containerName, true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	return os.RemoveAll(s.ContainerDir(containerName))
+}
+
+// ListContainers 列出所有容器，单个容器读取失败只打日志
+func (s *Store) ListContainers() ([]*container.ContainerInfo, error) {
+	files, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var containers []*container.ContainerInfo
+	for _, file := range files {
+		// 只有包含config.json的目录才是容器目录，network和锁目录等都跳过
+		if !file.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(s.containerConfigPath(file.Name())); err != nil {
+			continue
+		}
+		info, err := s.LoadContainer(file.Name())
+		if err != nil {
+			log.Errorf("Get container info error %v", err)
+			continue
+		}
+		containers = append(containers, info)
+	}
+	return containers, nil
+}
+
+func (s *Store) networkDir() string {
+	return filepath.Join(s.Root, "network", "network")
+}
+
+// SaveNetwork 保存网络信息
+func (s *Store) SaveNetwork(name string, nw interface{}) error {
+	l, err := s.lock(KindNetwork, name, true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	return WriteVersioned(filepath.Join(s.networkDir(), name), KindNetwork, nw, 0644)
+}
+
+// LoadNetwork 读取网络信息
+func (s *Store) LoadNetwork(name string, nw interface{}) error {
+	l, err := s.lock(KindNetwork, name, false)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	_, err = ReadVersioned(filepath.Join(s.networkDir(), name), KindNetwork, nw)
+	return err
+}
+
+// ListNetworks 返回所有已保存网络的名字
+func (s *Store) ListNetworks() ([]string, error) {
+	files, err := ioutil.ReadDir(s.networkDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		// 跳过目录和写了一半的临时文件
+		if file.IsDir() || file.Name()[0] == '.' {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+// RemoveNetwork 删除网络信息
+func (s *Store) RemoveNetwork(name string) error {
+	l, err := s.lock(KindNetwork, name, true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	if err := os.Remove(filepath.Join(s.networkDir(), name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) ipamPath() string {
+	return filepath.Join(s.Root, "network", "ipam", "subnet.json")
+}
+
+// LoadIPAM 读取网段的地址分配位图
+func (s *Store) LoadIPAM() (map[string]string, error) {
+	l, err := s.lock(KindIPAM, "subnet", false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Unlock()
+	subnets := map[string]string{}
+	if _, err := ReadVersioned(s.ipamPath(), KindIPAM, &subnets); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return subnets, nil
+}
+
+// UpdateIPAM 在IPAM锁内读取分配位图，交给fn修改后写回
+// 整个分配过程都在锁内，两个同时启动的容器不会分到同一个IP
+func (s *Store) UpdateIPAM(fn func(subnets map[string]string) error) error {
+	l, err := s.lock(KindIPAM, "subnet", true)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	subnets := map[string]string{}
+	if _, err := ReadVersioned(s.ipamPath(), KindIPAM, &subnets); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fn(subnets); err != nil {
+		return err
+	}
+	return WriteVersioned(s.ipamPath(), KindIPAM, subnets, 0644)
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"cocin_dokcer/container"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLegacyContainer(t *testing.T) {
+	st := New(t.TempDir())
+	dir := st.ContainerDir("web")
+	os.MkdirAll(dir, 0755)
+	legacy := `{"pid":" ","id":"1234567890","name":"web","status":"stopped"}`
+	ioutil.WriteFile(filepath.Join(dir, container.ConfigName), []byte(legacy), 0644)
+
+	err := st.UpdateContainer("web", func(info *container.ContainerInfo) error {
+		if info.Pid != "" {
+			t.Errorf("legacy pid should be migrated to empty, got %q", info.Pid)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update legacy container error %v", err)
+	}
+
+	migrated, err := ReadVersioned(filepath.Join(dir, container.ConfigName), KindContainer, &container.ContainerInfo{})
+	if err != nil {
+		t.Fatalf("read migrated state error %v", err)
+	}
+	if migrated {
+		t.Errorf("state should have been written back with version %d", SchemaVersion)
+	}
+}
+
+func TestCreateContainerExists(t *testing.T) {
+	st := New(t.TempDir())
+	info := &container.ContainerInfo{Name: "web", Id: "1"}
+	if err := st.CreateContainer(info); err != nil {
+		t.Fatalf("create container error %v", err)
+	}
+	if err := st.CreateContainer(&container.ContainerInfo{Name: "web", Id: "2"}); err == nil {
+		t.Fatalf("create container with a used name should fail")
+	}
+	got, err := st.LoadContainer("web")
+	if err != nil || got.Id != "1" {
+		t.Fatalf("existing container state should be kept, got %+v %v", got, err)
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// SchemaVersion 当前状态文件的格式版本，每次改动落盘格式都要加一并注册迁移函数
+const SchemaVersion = 1
+
+const (
+	KindContainer = "container"
+	KindNetwork   = "network"
+	KindIPAM      = "ipam"
+)
+
+// record 所有状态文件统一的外层结构，Version记录写入时的格式版本
+type record struct {
+	Version int             `json:"version"`
+	Kind    string          `json:"kind"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// migration 把某个版本的数据升级到下一个版本
+type migration func(data json.RawMessage) (json.RawMessage, error)
+
+// migrations 按对象类型登记的迁移函数，migrations[kind][i] 负责把版本i的数据升级到版本i+1
+// 版本0是引入store之前直接把对象json写进文件的旧格式
+var migrations = map[string][]migration{
+	KindContainer: {migrateContainerV0},
+	KindNetwork:   {migrateNoop},
+	KindIPAM:      {migrateNoop},
+}
+
+func migrateNoop(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+// migrateContainerV0 旧版本的stop会把pid写成一个空格，这里统一清成空串
+func migrateContainerV0(data json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if pid, ok := fields["pid"].(string); ok && pid == " " {
+		fields["pid"] = ""
+	}
+	return json.Marshal(fields)
+}
+
+// decode 解析状态文件，必要时依次执行迁移，返回值migrated表示数据是否被升级过
+func decode(content []byte, kind string, v interface{}) (migrated bool, err error) {
+	var rec record
+	if err := json.Unmarshal(content, &rec); err != nil {
+		return false, err
+	}
+	// 旧格式没有外层结构，整个文件就是数据本身
+	if rec.Data == nil || rec.Kind == "" {
+		rec = record{Version: 0, Kind: kind, Data: content}
+	}
+	if rec.Kind != kind {
+		return false, fmt.Errorf("state kind mismatch, want %s got %s", kind, rec.Kind)
+	}
+	if rec.Version > SchemaVersion {
+		return false, fmt.Errorf("state version %d is newer than supported version %d", rec.Version, SchemaVersion)
+	}
+	for ver := rec.Version; ver < SchemaVersion; ver++ {
+		if rec.Data, err = migrations[kind][ver](rec.Data); err != nil {
+			return false, fmt.Errorf("migrate %s state from version %d error %v", kind, ver, err)
+		}
+		migrated = true
+	}
+	return migrated, json.Unmarshal(rec.Data, v)
+}
+
+func encode(kind string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&record{Version: SchemaVersion, Kind: kind, Data: data})
+}
+
+// ReadVersioned 读取带版本的状态文件到v中，旧版本的文件会在内存中迁移到当前版本
+func ReadVersioned(path, kind string, v interface{}) (migrated bool, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return decode(content, kind, v)
+}
+
+// WriteVersioned 以当前版本原子地写入状态文件
+func WriteVersioned(path, kind string, v interface{}, perm os.FileMode) error {
+	content, err := encode(kind, v)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, content, perm)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cocin_dokcer/container"
+	"cocin_dokcer/image"
+	"cocin_dokcer/network"
+	"cocin_dokcer/storage"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// pruneGracePeriod 这么久以内写入的layer和临时文件可能属于正在进行的commit、pull和build，prune不删
+const pruneGracePeriod = time.Hour
+
+// diskUsage system df的一行
+type diskUsage struct {
+	Type        string
+	Total       int
+	Active      int
+	Size        int64
+	Reclaimable int64
+}
+
+/*
+	systemDiskUsage 统计各类数据占用的磁盘空间，RECLAIMABLE是system prune --all最多能释放的空间
+	Images       所有镜像的layer，没有容器在用的镜像独占的layer可以回收
+	Containers   容器的可写层，停止的容器可以回收
+	Volumes      容器挂载的宿主机目录，不归cocin_docker管，不会回收
+	Logs         后台运行的容器的日志，随停止的容器一起回收
+	Build Cache  镜像和容器都用不到的layer(build的中间层等)和临时文件，ACTIVE一栏不适用
+*/
+func (eng *engine) systemDiskUsage() error {
+	containers, err := eng.newStateStore().ListContainers()
+	if err != nil {
+		return err
+	}
+	usages := []diskUsage{{Type: "Images"}, {Type: "Containers"}, {Type: "Local Volumes"}, {Type: "Logs"}, {Type: "Build Cache"}}
+	images := eng.newImageStore()
+
+	// 容器在用的镜像，早期的容器只记录了镜像名
+	names, err := images.Names()
+	if err != nil {
+		return err
+	}
+	usedImages := make(map[string]bool)
+	for _, info := range containers {
+		if info.ImageID != "" {
+			usedImages[info.ImageID] = true
+		} else if name, err := image.NormalizeName(info.ImageName); err == nil && names[name] != "" {
+			usedImages[names[name]] = true
+		}
+	}
+	// 容器引用的layer不能回收，镜像已经被删掉的也一样
+	activeLayers, err := images.LayerRefs()
+	if err != nil {
+		return err
+	}
+	ids, err := images.Images()
+	if err != nil {
+		return err
+	}
+	layerSizes := make(map[string]int64)
+	active := make(map[string]bool)
+	for _, id := range ids {
+		img, err := images.GetImage(id)
+		if err != nil {
+			log.Warnf("Get image %s error %v", id, err)
+			continue
+		}
+		usages[0].Total++
+		if usedImages[id] {
+			usages[0].Active++
+		}
+		for _, diffID := range img.RootFS.DiffIDs {
+			if size, err := images.LayerSize(diffID); err == nil {
+				layerSizes[diffID] = size
+			}
+			if usedImages[id] || activeLayers[diffID] > 0 {
+				active[diffID] = true
+			}
+		}
+	}
+	for diffID, size := range layerSizes {
+		usages[0].Size += size
+		if !active[diffID] {
+			usages[0].Reclaimable += size
+		}
+	}
+
+	volumes := make(map[string]bool)
+	for _, info := range containers {
+		running := info.Status == container.RUNNING
+		usages[1].Total++
+		size, err := eng.writeLayerSize(info)
+		if err != nil {
+			log.Warnf("Get size of container %s error %v", info.Name, err)
+		}
+		usages[1].Size += size
+		if running {
+			usages[1].Active++
+		} else {
+			usages[1].Reclaimable += size
+		}
+
+		// 多个容器挂载同一个目录只算一次，有一个在运行就算在用
+		if volumeURLs := splitVolume(info.Volume); volumeURLs != nil {
+			hostDir := volumeURLs[0]
+			if _, seen := volumes[hostDir]; !seen {
+				usages[2].Total++
+				size, _ := storage.DirUsage(hostDir)
+				usages[2].Size += size
+			}
+			volumes[hostDir] = volumes[hostDir] || running
+		}
+
+		if fi, err := os.Stat(eng.containerPaths().LogFile(info.Name)); err == nil {
+			usages[3].Total++
+			usages[3].Size += fi.Size()
+			if running {
+				usages[3].Active++
+			} else {
+				usages[3].Reclaimable += fi.Size()
+			}
+		}
+	}
+	for _, running := range volumes {
+		if running {
+			usages[2].Active++
+		}
+	}
+
+	if usages[4].Total, err = images.CacheCount(); err != nil {
+		return err
+	}
+	unused, err := images.UnusedLayers()
+	if err != nil {
+		return err
+	}
+	for _, digest := range unused {
+		if size, err := images.LayerSize(digest); err == nil {
+			usages[4].Size += size
+		}
+	}
+	usages[4].Size += images.TmpSize()
+	usages[4].Reclaimable = usages[4].Size
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+	for _, usage := range usages {
+		percent := 0
+		if usage.Size > 0 {
+			percent = int(usage.Reclaimable * 100 / usage.Size)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s (%d%%)\n",
+			usage.Type,
+			usage.Total,
+			usage.Active,
+			humanSize(usage.Size),
+			humanSize(usage.Reclaimable),
+			percent)
+	}
+	return w.Flush()
+}
+
+// splitVolume 解析 -v 宿主机目录:容器内目录，格式不对时返回nil
+func splitVolume(volume string) []string {
+	volumeURLs := strings.Split(volume, ":")
+	if len(volumeURLs) != 2 || volumeURLs[0] == "" || volumeURLs[1] == "" {
+		return nil
+	}
+	return volumeURLs
+}
+
+// pruneOptions system prune的参数
+type pruneOptions struct {
+	All   bool      // 删除所有没有容器在用的镜像，而不只是没有名字的
+	Until time.Time // 只删除这之前创建的容器、镜像、网络和build缓存，零值表示不限制
+}
+
+// createdBefore 判断创建时间是否满足--filter until，没有记录创建时间的当作很早以前创建的
+func (o pruneOptions) createdBefore(created time.Time) bool {
+	return o.Until.IsZero() || created.Before(o.Until)
+}
+
+/*
+	systemPrune 清理不再需要的数据，按依赖关系依次删除：
+	1. 停止的容器，以及没有容器状态对应的可写层(比如创建到一半崩溃留下的)
+	2. 没有容器连接的网络
+	3. 没有名字的镜像，--all时还有所有没有容器在用的镜像
+	4. build缓存
+	5. 以上都删完以后，镜像、容器和build缓存都用不到的layer，以及残留的临时文件
+	没有状态的挂载点在每个命令开始的状态修复里已经清理过了
+*/
+func (eng *engine) systemPrune(options pruneOptions) error {
+	st := eng.newStateStore()
+	var reclaimed int64
+
+	containers, err := st.ListContainers()
+	if err != nil {
+		return err
+	}
+	var deletedContainers []string
+	for _, info := range containers {
+		if container.IsProcessAlive(info.Pid, info.StartTime) {
+			continue
+		}
+		created, err := time.ParseInLocation("2006-01-02 15:04:05", info.CreatedTime, time.Local)
+		if err == nil && !options.createdBefore(created) {
+			continue
+		}
+		size, _ := eng.writeLayerSize(info)
+		if fi, err := os.Stat(eng.containerPaths().LogFile(info.Name)); err == nil {
+			size += fi.Size()
+		}
+		if err := eng.removeContainer(info.Name); err != nil {
+			log.Errorf("Remove container %s error %v", info.Name, err)
+			continue
+		}
+		deletedContainers = append(deletedContainers, info.Name)
+		reclaimed += size
+	}
+	printDeleted("Deleted Containers:", deletedContainers)
+
+	driver, err := eng.newStorageDriver()
+	if err != nil {
+		return err
+	}
+	writeLayerRoot := eng.containerPaths().WriteLayerRoot()
+	orphans, err := storage.WriteLayers(writeLayerRoot)
+	if err != nil {
+		return err
+	}
+	var deletedWriteLayers []string
+	for _, id := range orphans {
+		if _, err := os.Stat(st.ContainerDir(id)); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		// 各个驱动的可写层都在 {home}/{id} 下，用哪个驱动删都一样
+		dir := filepath.Join(writeLayerRoot, id)
+		fi, err := os.Stat(dir)
+		if err == nil && !options.createdBefore(fi.ModTime()) {
+			continue
+		}
+		size, _ := storage.DirUsage(dir)
+		if err := driver.RemoveWriteLayer(id); err != nil {
+			log.Errorf("Remove write layer %s error %v", id, err)
+			continue
+		}
+		deletedWriteLayers = append(deletedWriteLayers, id)
+		reclaimed += size
+	}
+	printDeleted("Deleted Write Layers:", deletedWriteLayers)
+
+	if containers, err = st.ListContainers(); err != nil {
+		return err
+	}
+	networks, err := network.NewManager(st)
+	if err != nil {
+		return err
+	}
+	usedNetworks := make(map[string]bool)
+	for _, info := range containers {
+		if info.Network != "" {
+			usedNetworks[info.Network] = true
+		}
+	}
+	var deletedNetworks []string
+	for _, nw := range networks.Networks() {
+		if usedNetworks[nw.Name] || !options.createdBefore(nw.Created) {
+			continue
+		}
+		if err := networks.DeleteNetwork(nw.Name); err != nil {
+			log.Errorf("Remove network %s error %v", nw.Name, err)
+			continue
+		}
+		deletedNetworks = append(deletedNetworks, nw.Name)
+	}
+	printDeleted("Deleted Networks:", deletedNetworks)
+
+	images := eng.newImageStore()
+	deletedImages, size, err := eng.pruneImages(images, options)
+	reclaimed += size
+	printDeleted("Deleted Images:", deletedImages)
+	if err != nil {
+		return err
+	}
+
+	before := options.Until
+	if before.IsZero() {
+		before = time.Now()
+	}
+	cleared, err := images.ClearCache(before)
+	if err != nil {
+		return err
+	}
+	// 刚写入的layer和临时文件可能还没被镜像配置引用，留一段时间
+	if grace := time.Now().Add(-pruneGracePeriod); grace.Before(before) {
+		before = grace
+	}
+	deletedLayers, size, err := images.PruneLayers(before)
+	reclaimed += size
+	printDeleted("Deleted Layers:", deletedLayers)
+	if err != nil {
+		return err
+	}
+	size, err = images.PruneTmp(before)
+	reclaimed += size
+	if err != nil {
+		return err
+	}
+	if cleared > 0 {
+		fmt.Printf("Deleted Build Cache: %d\n\n", cleared)
+	}
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+	return nil
+}
+
+// pruneImages 删除没有名字(--all时不管有没有名字)、也没有容器在用的镜像，返回删除的镜像和释放的空间
+func (eng *engine) pruneImages(images *image.Store, options pruneOptions) ([]string, int64, error) {
+	ids, err := images.Images()
+	if err != nil {
+		return nil, 0, err
+	}
+	names, err := images.Names()
+	if err != nil {
+		return nil, 0, err
+	}
+	named := make(map[string]bool)
+	for _, id := range names {
+		named[id] = true
+	}
+	var deleted []string
+	var reclaimed int64
+	for _, id := range ids {
+		if named[id] && !options.All {
+			continue
+		}
+		img, err := images.GetImage(id)
+		if err != nil || !options.createdBefore(img.Created) {
+			continue
+		}
+		if eng.checkImageUnused(id, names) != nil {
+			continue
+		}
+		sizes := make(map[string]int64)
+		for _, diffID := range img.RootFS.DiffIDs {
+			sizes[diffID], _ = images.LayerSize(diffID)
+		}
+		layers, err := images.DeleteImage(id)
+		for _, diffID := range layers {
+			reclaimed += sizes[diffID]
+		}
+		if err != nil {
+			return deleted, reclaimed, fmt.Errorf("remove image %s error %v", id, err)
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, reclaimed, nil
+}
+
+// printDeleted 输出一类被删除的对象，没有删除任何东西时不输出
+func printDeleted(title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Println(title)
+	for _, item := range items {
+		fmt.Println(item)
+	}
+	fmt.Println()
+}